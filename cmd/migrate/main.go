@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bufio"
 	"devops-tools.pearson.com/mysp/cassandra-migrate/cql"
 	"fmt"
 	"github.com/alecthomas/kingpin"
 	"github.com/gocql/gocql"
+	"io/ioutil"
 	"os"
 	"sort"
+	"strings"
+	"time"
 )
 
 var (
@@ -16,19 +20,66 @@ var (
 	dryRun   = app.Flag("dryrun", "Dry run").Short('d').Bool()
 	confPath = app.Flag("conf", "Path to config file.").Short('c').Default("./conf/example.toml").String()
 	env      = app.Flag("env", "Set config environment.").Short('e').Default("local").String()
+	yes      = app.Flag("yes", "Don't ask for confirmation before changing a protected environment.").Short('y').Bool()
+	scripts  = app.Flag("scripts", "Read migrations from this directory, .tar.gz or .zip instead of the configured paths.").String()
 
 	// The main commands.
-	cmdCreate = app.Command("create", "Create new migration.")
-	cmdList   = app.Command("list", "List all candidate migrations.")
-	cmdLog    = app.Command("log", "List all applied migrations.")
-	cmdUp     = app.Command("up", "Apply a first new migration.")
+	cmdCreate   = app.Command("create", "Create new migration.")
+	cmdGenerate = app.Command("generate", "Create a migration that brings the schema in line with a schema file.")
+	cmdList     = app.Command("list", "List all candidate migrations.")
+	cmdLog      = app.Command("log", "List all applied migrations.")
+	cmdUp       = app.Command("up", "Apply a first new migration.")
+	cmdPlan     = app.Command("plan", "Show the CQL 'up' would run, history writes and all.")
+	cmdBundle   = app.Command("bundle", "Write the migrations a cluster we can't reach needs into one cqlsh script.")
+	cmdDump     = app.Command("dump", "Print the schema of the keyspace, as the cluster has it, as CQL.")
+	cmdDiff     = app.Command("diff", "Compare the schema applied migrations should have built with the cluster's.")
+	cmdRestore  = app.Command("restore", "Reload data saved before a destructive migration.")
+	cmdValidate = app.Command("validate", "Check applied migrations haven't been modified since.")
+	cmdManifest = app.Command("manifest", "Manage the migrations.sum manifest.")
+	cmdBaseline = app.Command("baseline", "Record migrations up to a version as applied without running them.")
+	cmdSquash   = app.Command("squash", "Replace migrations up to a version with a snapshot of the schema they build.")
+
+	cmdManifestUpdate = cmdManifest.Command("update", "Rewrite the manifest from the migrations directory.")
 
 	// Options to the 'create' command.
 	migrationName = cmdCreate.Arg("name", "Name of new migration.").Required().String()
-	migrationEnv  = cmdCreate.Flag("target-env", "Name of new migration.").Short('t').Default("all").String()
+	migrationEnv  = cmdCreate.Flag("target-env", "Environments to run new migration in, e.g. 'uat1+uat2', '!prod' or a group.").Short('t').Default("all").String()
+	repeatable    = cmdCreate.Flag("repeatable", "Create a repeatable migration, re-run whenever it changes.").Short('r').Bool()
+	createVersion = cmdCreate.Flag("version", "Version of new migration, instead of the next one.").String()
+
+	// Options to the 'generate' command.
+	generateName    = cmdGenerate.Arg("name", "Name of new migration.").Required().String()
+	generateSchema  = cmdGenerate.Flag("schema", "The CQL file describing the schema as it should be.").Short('s').Default("schema.cql").String()
+	generateEnv     = cmdGenerate.Flag("target-env", "Environments to run new migration in, e.g. 'uat1+uat2', '!prod' or a group.").Short('t').Default("all").String()
+	generatePartial = cmdGenerate.Flag("partial", "Write what can be done even if some changes have to be made by hand.").Bool()
 
 	// Options to the 'up' command.
-	upLimit = cmdUp.Flag("limit", "Limit migrate up to a maximum version.").String()
+	upLimit            = cmdUp.Flag("limit", "Limit migrate up to a maximum version.").String()
+	upAllowDestructive = cmdUp.Flag("allow-destructive", "Allow migrations containing DROP/TRUNCATE statements.").Bool()
+	upBackupDir        = cmdUp.Flag("backup-dir", "Save data about to be dropped/truncated to this directory first.").String()
+	upBackupFormat     = cmdUp.Flag("backup-format", "Format of backed up data.").Default(cql.JSONLinesFormat).Enum(cql.JSONLinesFormat, cql.CSVFormat)
+
+	// Options to the 'plan' command.
+	planLimit  = cmdPlan.Flag("limit", "Limit the plan to a maximum version.").String()
+	planOutput = cmdPlan.Flag("output", "Write the plan to this .cql file instead of the screen.").Short('o').String()
+
+	// Options to the 'bundle' command.
+	bundleFrom   = cmdBundle.Flag("from", "The cluster has everything up to and including this version.").String()
+	bundleOutput = cmdBundle.Flag("output", "The .cql file to write the script to.").Short('o').Required().String()
+
+	// Options to the 'dump' command.
+	dumpKeyspace = cmdDump.Flag("keyspace", "Dump this keyspace instead of the environment's.").String()
+
+	// Options to the 'baseline' command.
+	baselineVersion = cmdBaseline.Flag("version", "Baseline everything up to and including this version.").Required().String()
+
+	// Options to the 'squash' command.
+	squashThrough = cmdSquash.Flag("through", "Squash everything up to and including this version.").Required().String()
+	squashKeep    = cmdSquash.Flag("keep", "Leave the squashed migration files where they are.").Bool()
+
+	// Options to the 'restore' command.
+	restoreManifest = cmdRestore.Arg("manifest", "Path to the backup's manifest.json file.").Required().ExistingFile()
+	restoreKeyspace = cmdRestore.Flag("keyspace", "Restore into this keyspace instead of the original.").String()
 
 	command = kingpin.MustParse(app.Parse(os.Args[1:]))
 )
@@ -50,7 +101,13 @@ func main() {
 	fmt.Printf("Environment: %s\n", *env)
 	fmt.Printf("Cassandra Seed Node: %s\n", conf.Environments[*env].CassandraHosts)
 	fmt.Printf("Migration Scripts Path: %s\n", conf.Scripts.Path)
+	if len(conf.Scripts.Paths) > 0 {
+		fmt.Printf("Migration Scripts Paths: %s (recursive: %v)\n", strings.Join(conf.Scripts.Paths, ", "), conf.Scripts.Recursive)
+	}
 	fmt.Printf("DRY RUN?: %v\n", *dryRun)
+	if conf.Environments[*env].Protected {
+		fmt.Printf("PROTECTED ENVIRONMENT (maintenance window: %s)\n", conf.Environments[*env].MaintenanceWindow)
+	}
 
 	switch command {
 
@@ -62,13 +119,43 @@ func main() {
 
 	case cmdUp.FullCommand():
 		fmt.Printf("Migrate up\n")
-		up(*dryRun, *upLimit, conf, *env)
+		up(*dryRun, *upLimit, *upAllowDestructive, *upBackupDir, *upBackupFormat, conf, *env)
+
+	case cmdPlan.FullCommand():
+		planUp(*planLimit, *planOutput, conf, *env)
+
+	case cmdBundle.FullCommand():
+		bundle(*bundleFrom, *bundleOutput, conf, *env)
+
+	case cmdDump.FullCommand():
+		dump(*dumpKeyspace, conf, *env)
+
+	case cmdDiff.FullCommand():
+		diff(conf, *env)
+
+	case cmdBaseline.FullCommand():
+		baseline(*dryRun, *baselineVersion, conf, *env)
+
+	case cmdSquash.FullCommand():
+		squash(*dryRun, *squashThrough, *squashKeep, conf)
+
+	case cmdManifestUpdate.FullCommand():
+		updateManifest(conf)
+
+	case cmdValidate.FullCommand():
+		validate(conf, *env)
+
+	case cmdRestore.FullCommand():
+		restore(*dryRun, *restoreManifest, *restoreKeyspace, conf, *env)
 
 	case cmdCreate.FullCommand():
-		if createErr := create(conf, *migrationName, *migrationEnv); createErr != nil {
+		if createErr := create(conf, *migrationName, *migrationEnv, *repeatable, *createVersion); createErr != nil {
 			fail("Unable to create migration file", createErr)
 		}
 
+	case cmdGenerate.FullCommand():
+		generate(*dryRun, *generateName, *generateSchema, *generateEnv, *generatePartial, conf, *env)
+
 	default:
 		app.Usage(os.Stdout)
 	}
@@ -77,7 +164,17 @@ func main() {
 func mustLoadConfig() *cql.MigrationConfig {
 	conf, confErr := cql.NewMigrationConfig(*confPath)
 	if confErr != nil {
-		fail("Failed to read configuration file: '%s'", *confPath)
+		fail("Failed to read configuration file: '%s': %s", *confPath, confErr.Error())
+	}
+	cql.DefaultChecksumAlgorithm = conf.Scripts.Checksum
+	cql.DefaultVersionScheme = conf.Scripts.VersionScheme
+	cql.FileNamePattern = conf.Scripts.FileNamePattern
+	if conf.Groups != nil {
+		cql.EnvironmentGroups = conf.Groups
+	}
+	if *scripts != "" {
+		conf.Scripts.Path = *scripts
+		conf.Scripts.Paths = nil
 	}
 	return conf
 }
@@ -101,25 +198,49 @@ func mustConnectToDB(conf *cql.MigrationConfig, env string) *gocql.Session {
 	return session
 }
 
+//
+// Guard for any command that changes the database. Refuses to go on outside of the
+// environment's maintenance window and, for protected environments, prints the plan
+// and waits for the user to type the environment name back at us. In non-interactive
+// mode (no terminal on stdin) --yes has to be given instead.
+//
+func mustConfirmChanges(conf *cql.MigrationConfig, env string, plan []string) {
+	environment := conf.Environments[env]
+
+	open, err := environment.MaintenanceWindow.Contains(time.Now())
+	if err != nil {
+		fail("Bad maintenance window for environment '%s': %s", env, err.Error())
+	}
+	if !open {
+		fail("Refusing to change environment '%s' outside of its maintenance window: %s", env, environment.MaintenanceWindow)
+	}
+
+	if !environment.Protected {
+		return
+	}
+	fmt.Printf("Environment '%s' is protected. About to:\n", env)
+	for _, p := range plan {
+		fmt.Printf("   %s\n", p)
+	}
+	if *yes {
+		return
+	}
+	if stat, statErr := os.Stdin.Stat(); statErr != nil || stat.Mode()&os.ModeCharDevice == 0 {
+		fail("Not running interactively; pass --yes to change protected environment '%s'", env)
+	}
+
+	fmt.Printf("Type the name of the environment to continue: ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if strings.TrimSpace(answer) != env {
+		fail("Confirmation did not match '%s'. Nothing has been changed.", env)
+	}
+}
+
 func fail(msg string, args ...interface{}) {
 	fmt.Printf(msg+"\n", args...)
 	os.Exit(1)
 }
 
-func initSchemaVersion(session *gocql.Session) error {
-	schemaVerCQL := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS schema_version(
-                    applied timestamp,
-                    environment text,
-                    name text,
-                    checksum blob,
-                    user text,
-                    version text,
-                    PRIMARY KEY (name, version)) WITH CLUSTERING ORDER BY (version ASC)`)
-
-	iter := session.Query(schemaVerCQL).Iter()
-	return iter.Close()
-}
-
 //
 // Just spit out the content of the schema_version table for all to see.
 //
@@ -127,11 +248,11 @@ func listLog(conf *cql.MigrationConfig, env string) {
 	session := mustConnectToDB(conf, env)
 	defer session.Close()
 
-	applied := cql.ListAppliedMigrations(session)
+	applied := mustListApplied(session)
 	fmt.Println("Previously Applied Migrations:")
-	fmt.Printf("    |%-40s|%-20s|%-15s|%-20s|%-20s\n", "Name", "Version", "Environment", "Applied By", "Applied On")
+	fmt.Printf("    |%-40s|%-20s|%-15s|%-20s|%-20s|%-10s|%s\n", "Name", "Version", "Environment", "Applied By", "Applied On", "Kind", "Description")
 	for _, a := range applied {
-		fmt.Printf("    |%-40s|%-20s|%-15s|%-20s|%-20s\n", a.Name, a.Version, a.Environment, a.User, a.Applied)
+		fmt.Printf("    |%-40s|%-20s|%-15s|%-20s|%-20s|%-10s|%s\n", a.Name, a.Version, a.Environment, a.User, a.Applied, a.Kind(), describe(a))
 	}
 }
 
@@ -142,91 +263,683 @@ func listCandidates(conf *cql.MigrationConfig, env string) {
 	session := mustConnectToDB(conf, env)
 	defer session.Close()
 
-	applied := cql.ListAppliedMigrations(session)
+	applied := mustListApplied(session)
 
-	updates, listErr := cql.ListMigrationFiles(conf.Scripts.Path)
+	updates, listErr := conf.Scripts.List()
 	if listErr != nil {
 		fail("Failed to list migration files: %s", listErr.Error())
 	}
+	updates, orderErr := cql.OrderMigrations(updates)
+	if orderErr != nil {
+		fail("Unable to order migrations: %s", orderErr.Error())
+	}
 
 	fmt.Println("Migration Candidates:")
-	fmt.Printf("    |%-40s|%-20s|%-15s|%-11s|%-50s\n", "Migration Name", "Version", "Environment", "Candidate?", "File Path")
+	fmt.Printf("    |%-40s|%-20s|%-15s|%-11s|%-50s|%s\n", "Migration Name", "Version", "Environment", "Candidate?", "File Path", "Description")
 
 	for _, m := range updates {
 		isCandidate := "yes"
-		if m.Environment != "all" && m.Environment != env {
+		if !m.AppliesTo(env) {
 			isCandidate = "no"
 		}
 
 		if applied.Contains(m) {
-			fmt.Printf("    |%-40s|%-20s|%-15s|%-11s|%-50s\n", m.Name, m.Version, m.Environment, isCandidate, m.File)
+			fmt.Printf("    |%-40s|%-20s|%-15s|%-11s|%-50s|%s\n", m.Name, displayVersion(m), m.Environment, isCandidate, m.File, describe(m))
 		} else {
-			fmt.Printf("    |%-40s|%-20s|%-15s|%-11s|%-50s\n", m.Name, m.Version, m.Environment, isCandidate, m.File)
+			fmt.Printf("    |%-40s|%-20s|%-15s|%-11s|%-50s|%s\n", m.Name, displayVersion(m), m.Environment, isCandidate, m.File, describe(m))
 		}
 	}
 }
 
+//
+// The migration's description and tags, from its annotations, and how many rows it
+// loaded if it was a data migration.
+//
+func describe(m *cql.Migration) string {
+	description := m.Description
+	if len(m.Tags) > 0 {
+		description = strings.TrimSpace(fmt.Sprintf("%s [%s]", description, strings.Join(m.Tags, ", ")))
+	}
+	if m.Rows > 0 {
+		description = strings.TrimSpace(fmt.Sprintf("%s (%d rows)", description, m.Rows))
+	}
+	return description
+}
+
+func displayVersion(m *cql.Migration) string {
+	if m.Repeatable && m.Version == "" {
+		return "(repeatable)"
+	}
+	return m.Version
+}
+
+//
+// Check that none of the migrations already applied have been edited since.
+//
+func validate(conf *cql.MigrationConfig, env string) {
+	session := mustConnectToDB(conf, env)
+	defer session.Close()
+
+	applied := mustListApplied(session)
+
+	updates, listErr := conf.Scripts.List()
+	if listErr != nil {
+		fail("Failed to list migration files: %s", listErr.Error())
+	}
+
+	mustMatchManifest(conf, updates)
+	mustBeUnmodified(applied, updates)
+	fmt.Println("All applied migrations match their files.")
+}
+
+func manifestPath(conf *cql.MigrationConfig) string {
+	return conf.Scripts.Path + "/" + cql.ManifestFileName
+}
+
+//
+// For commands which write to the migrations directory. Archives are read only.
+//
+func mustBeDirectory(conf *cql.MigrationConfig) {
+	for _, path := range append([]string{conf.Scripts.Path}, conf.Scripts.Paths...) {
+		if cql.IsArchive(path) {
+			fail("'%s' is an archive; this needs a migrations directory to write to", path)
+		}
+	}
+}
+
+//
+// Check the migrations directory against the committed manifest, if there is one.
+//
+func mustMatchManifest(conf *cql.MigrationConfig, updates cql.Migrations) {
+	manifest, err := cql.ReadScriptsManifest(conf.Scripts.Path)
+	if os.IsNotExist(err) && !conf.Scripts.RequireManifest {
+		fmt.Printf("No manifest at '%s'; not checking it\n", manifestPath(conf))
+		return
+	}
+	if err != nil {
+		fail("Unable to read manifest: %s", err.Error())
+	}
+	if verifyErr := manifest.Verify(updates); verifyErr != nil {
+		fail("Migrations directory does not match '%s':\n   %s\nIf the changes are intended run 'manifest update'.",
+			manifestPath(conf), verifyErr.Error())
+	}
+}
+
+//
+// Regenerate the manifest from whatever is in the migrations directory now, showing
+// what that changes first so nothing gets waved through without being seen.
+//
+func updateManifest(conf *cql.MigrationConfig) {
+	mustBeDirectory(conf)
+	updates, listErr := conf.Scripts.ListFiles()
+	if listErr != nil {
+		fail("Failed to list migration files: %s", listErr.Error())
+	}
+
+	if old, err := cql.ReadManifest(manifestPath(conf)); err == nil {
+		if diffs := old.Verify(updates); diffs != nil {
+			fmt.Printf("Updating manifest for:\n   %s\n", diffs.Error())
+		}
+	}
+	if err := cql.BuildManifest(updates).Write(manifestPath(conf)); err != nil {
+		fail("Unable to write manifest: %s", err.Error())
+	}
+	fmt.Printf("Wrote %d migrations to '%s'\n", len(updates), manifestPath(conf))
+}
+
+func mustBeUnmodified(applied cql.Migrations, updates cql.Migrations) {
+	modified, verifyErr := cql.FindModifiedMigrations(applied, updates)
+	if verifyErr != nil {
+		fail("Failed to verify checksums:\n   %s", verifyErr.Error())
+	}
+	if len(modified) > 0 {
+		msg := "Migrations have been modified since they were applied:"
+		for _, m := range modified {
+			msg += fmt.Sprintf("\n   %s", m.File)
+		}
+		fail(msg)
+	}
+}
+
 //
 // Function to create a new migration *file* with the correct name formatting etc such
 // that the user may add her CQL to it.
 //
-func create(conf *cql.MigrationConfig, name string, env string) error {
+func create(conf *cql.MigrationConfig, name string, env string, repeatable bool, version string) error {
+	mustBeDirectory(conf)
+	if err := conf.CheckTargetEnvironment(env); err != nil {
+		return err
+	}
+	existing, listErr := conf.Scripts.List()
+	if listErr != nil {
+		return listErr
+	}
+
 	m := cql.CreateMigration(name, env)
+	switch {
+	case repeatable && version != "":
+		return fmt.Errorf("Repeatable migrations don't have a version")
+	case repeatable:
+		m = cql.CreateRepeatableMigration(name, env)
+	case version != "":
+		if err := cql.ValidVersion(version); err != nil {
+			return err
+		}
+		m.Version = version
+	default:
+		m.Version = cql.NextVersion(existing)
+	}
+	if err := checkVersionUnused(existing, m); err != nil {
+		return err
+	}
+
 	if err := m.CreateMigrationFile(conf.Scripts.Path); err != nil {
 		return fmt.Errorf("Failed to create migration file: %s", err.Error())
 	}
+
+	if err := addToManifest(conf, m.File); err != nil {
+		return err
+	}
+	fmt.Printf("Added to '%s'. Run 'manifest update' once you've written the migration.\n", manifestPath(conf))
+	return nil
+}
+
+//
+// Check a new migration doesn't take a version one of the 'existing' ones already has.
+//
+func checkVersionUnused(existing cql.Migrations, m *cql.Migration) error {
+	if other := existing.SameVersion(m); other != nil {
+		return fmt.Errorf("Version '%s' is already used by '%s'", m.Version, other.File)
+	}
+	return nil
+}
+
+func addToManifest(conf *cql.MigrationConfig, path string) error {
+	created, err := cql.MigrationFromFile(path)
+	if err != nil {
+		return err
+	}
+	updates, listErr := conf.Scripts.ListFiles()
+	if listErr != nil {
+		return listErr
+	}
+	if err := cql.AddToManifest(manifestPath(conf), created, updates); err != nil {
+		return fmt.Errorf("Failed to add migration to manifest: %s", err.Error())
+	}
 	return nil
 }
 
+//
+// Write a migration with whatever it takes to get from the schema the migrations build
+// in 'env' to the one described in 'schemaPath'. Changes Cassandra can't make in place
+// stop it, unless it's 'partial', when they're listed in the migration to do by hand.
+//
+func generate(dryRun bool, name string, schemaPath string, targetEnv string, partial bool, conf *cql.MigrationConfig, env string) {
+	if !dryRun {
+		mustBeDirectory(conf)
+	}
+	if err := conf.CheckTargetEnvironment(targetEnv); err != nil {
+		fail("Unable to generate a migration: %s", err.Error())
+	}
+	updates, listErr := conf.Scripts.List()
+	if listErr != nil {
+		fail("Failed to list migration files: %s", listErr.Error())
+	}
+	environment := conf.Environments[env]
+	updates.SetVariables(cql.TemplateVariables(environment.Keyspace, env, environment.Variables))
+
+	g, err := cql.PlanGenerate(updates, schemaPath, env)
+	if err != nil {
+		fail("Unable to generate a migration: %s", err.Error())
+	}
+	if len(g.Statements) == 0 && len(g.Unsupported) == 0 {
+		fmt.Printf("Nothing to do: the migrations already build the schema in '%s'\n", schemaPath)
+		return
+	}
+	if len(g.Unsupported) > 0 {
+		fmt.Printf("Cassandra can't make these changes in place:\n")
+		for _, u := range g.Unsupported {
+			fmt.Printf("   %s\n", u)
+		}
+		if !partial {
+			fail("Make them by hand (e.g. with a new table and a backfill), or use --partial to generate the rest")
+		}
+	}
+
+	m := cql.CreateMigration(name, targetEnv)
+	m.Version = cql.NextVersion(updates)
+	if err := checkVersionUnused(updates, m); err != nil {
+		fail("Unable to generate a migration: %s", err.Error())
+	}
+	if dryRun {
+		fmt.Printf("Would write a migration for '%s':\n%s", m.Name, g.CQL)
+		return
+	}
+	if err := m.CreateMigrationFile(conf.Scripts.Path); err != nil {
+		fail("Failed to create migration file: %s", err.Error())
+	}
+	if err := ioutil.WriteFile(m.File, g.CQL, 0644); err != nil {
+		fail("Failed to write migration file: %s", err.Error())
+	}
+	if err := addToManifest(conf, m.File); err != nil {
+		fail("%s", err.Error())
+	}
+	fmt.Printf("Wrote %d statements to '%s' and added it to '%s'\n", len(g.Statements), m.File, manifestPath(conf))
+}
+
 //
 // Migrate up. We don't do down yet. Need to do a better job of parsing the CQL to do that, I think.
 //
-func up(dryRun bool, limit string, conf *cql.MigrationConfig, env string) {
+func up(dryRun bool, limit string, allowDestructive bool, backupDir string, backupFormat string, conf *cql.MigrationConfig, env string) {
 	session := mustConnectToDB(conf, env)
 	defer session.Close()
 
 	if !dryRun {
-		initErr := initSchemaVersion(session)
+		initErr := cql.InitSchemaVersion(session, conf.Environments[env].Keyspace)
 		if initErr != nil {
 			fail("Failed to init schema: %q", initErr)
 		}
 	}
+	pending := mustFindPending(session, dryRun, limit, conf, env)
+
+	// Check the lot for anything that would throw data away before we run any of it. Better
+	// to refuse the whole set than to find out halfway through.
+	var toRun cql.Migrations
+	for _, m := range pending {
+		if !m.Baselined {
+			toRun = append(toRun, m)
+		}
+	}
+	destructive, guardErr := cql.FindDestructiveChanges(toRun)
+	if guardErr != nil {
+		fail("Failed to check migrations for destructive statements:\n   %s", guardErr.Error())
+	}
+	if len(destructive) > 0 {
+		if !allowDestructive && !conf.Environments[env].AllowDestructive {
+			fail("%s\nPass --allow-destructive or set 'allowdestructive' for environment '%s' to run them.", destructive.Error(), env)
+		}
+		fmt.Printf("Allowing destructive statements:\n")
+		for _, d := range destructive {
+			fmt.Printf("   %s: %s\n", d.Migration.File, d.Statement.Summary())
+		}
+	}
+
+	if len(pending) == 0 {
+		return
+	}
+	if dryRun {
+		keyspace := conf.Environments[env].Keyspace
+		if err := cql.WritePlan(os.Stdout, pending, env, keyspace, mustReadHistoryTable(session, keyspace), time.Now()); err != nil {
+			fail("Unable to show the plan: %s", err.Error())
+		}
+		return
+	}
+
+	var plan []string
+	for _, m := range pending {
+		if m.Baselined {
+			plan = append(plan, fmt.Sprintf("record %s (%s, %s) as applied; everything it replaces has been", m.File, m.Version, m.Environment))
+			continue
+		}
+		step := fmt.Sprintf("apply %s (%s, %s)", m.File, displayVersion(m), m.Environment)
+		if m.Description != "" {
+			step += ": " + m.Description
+		}
+		plan = append(plan, step)
+	}
+	mustConfirmChanges(conf, env, plan)
+
+	if backupDir == "" {
+		backupDir = conf.Environments[env].BackupDir
+	}
+
+	// Finally, run them.
+	for _, m := range pending {
+		if m.Baselined {
+			if err := m.Save(session); err != nil {
+				fail("Unable to save migration '%s':\n   %s", m.Name, err.Error())
+			}
+			continue
+		}
+		if backupDir != "" {
+			opts := cql.BackupOptions{Dir: backupDir, Format: backupFormat, Keyspace: conf.Environments[env].Keyspace}
+			if _, err := cql.BackupMigration(session, m, opts); err != nil {
+				fail("Unable to back up data for migration '%s' (it has not been applied):\n   %s", m.Name, err.Error())
+			}
+		}
+		if err := m.Apply(session); err != nil {
+			fail("Unable to apply migration '%s':\n   %s", m.Name, err.Error())
+		}
+		if err := m.Save(session); err != nil {
+			fail("Unable to save migration '%s':\n   %s", m.Name, err.Error())
+		}
+	}
+}
+
+//
+// Write out the CQL 'up' would run, history table writes and all, for a DBA to review or
+// run by hand. Nothing is changed, so the history table isn't created if it's missing.
+//
+func planUp(limit string, output string, conf *cql.MigrationConfig, env string) {
+	session := mustConnectToDB(conf, env)
+	defer session.Close()
+
+	pending := mustFindPending(session, true, limit, conf, env)
+	keyspace := conf.Environments[env].Keyspace
+	history := mustReadHistoryTable(session, keyspace)
+	if output == "" {
+		if err := cql.WritePlan(os.Stdout, pending, env, keyspace, history, time.Now()); err != nil {
+			fail("Unable to write the plan: %s", err.Error())
+		}
+		return
+	}
+	if err := cql.WritePlanFile(output, pending, env, keyspace, history, time.Now()); err != nil {
+		fail("Unable to write the plan: %s", err.Error())
+	}
+	fmt.Printf("Wrote the plan for %d migrations to '%s'\n", len(pending), output)
+}
+
+func mustReadHistoryTable(session *gocql.Session, keyspace string) *cql.Table {
+	history, err := cql.ReadHistoryTable(session, keyspace)
+	if err != nil {
+		fail("Unable to read the schema_version table: %s", err.Error())
+	}
+	return history
+}
+
+//
+// Write the migrations a cluster we can't connect to needs into one script for its DBAs
+// to run with cqlsh. It creates and fills in the history table as 'up' would, so the
+// tool can carry on from there if it is ever pointed at the cluster. We can't see that
+// table, which an older version of the tool may have made, so the script adds every
+// column it might be missing; cqlsh carries on past the ones it already has.
+//
+func bundle(from string, output string, conf *cql.MigrationConfig, env string) {
+	updates, listErr := conf.Scripts.List()
+	if listErr != nil {
+		fail("Failed to list migration files: %s", listErr.Error())
+	}
+	environment := conf.Environments[env]
+	updates.SetVariables(cql.TemplateVariables(environment.Keyspace, env, environment.Variables))
+	mustMatchManifest(conf, updates)
+
+	pending, err := cql.BundleMigrations(updates, env, from)
+	if err != nil {
+		fail("Unable to bundle: %s", err.Error())
+	}
+	if len(pending) == 0 {
+		fail("Nothing to bundle after '%s'", from)
+	}
+	if err := cql.WritePlanFile(output, pending, env, environment.Keyspace, nil, time.Now()); err != nil {
+		fail("Unable to write the bundle: %s", err.Error())
+	}
+	fmt.Printf("Bundled %d migrations into '%s'\n", len(pending), output)
+}
+
+//
+// Print the live schema of a keyspace as the CQL to create it.
+//
+func dump(keyspace string, conf *cql.MigrationConfig, env string) {
+	session := mustConnectToDB(conf, env)
+	defer session.Close()
+
+	if keyspace == "" {
+		keyspace = conf.Environments[env].Keyspace
+	}
+	schema, err := cql.ReadSchema(session, keyspace)
+	if err != nil {
+		fail("Unable to read the schema of keyspace '%s': %s", keyspace, err.Error())
+	}
+	for _, st := range schema.CQL() {
+		fmt.Printf("%s;\n\n", st)
+	}
+}
+
+//
+// Report how the cluster's schema has drifted from what the migrations applied to it
+// should have built, e.g. by someone changing it by hand, and fail if it has.
+//
+func diff(conf *cql.MigrationConfig, env string) {
+	session := mustConnectToDB(conf, env)
+	defer session.Close()
+
+	applied := mustListApplied(session)
+	updates, listErr := conf.Scripts.List()
+	if listErr != nil {
+		fail("Failed to list migration files: %s", listErr.Error())
+	}
+	environment := conf.Environments[env]
+	updates.SetVariables(cql.TemplateVariables(environment.Keyspace, env, environment.Variables))
+
+	expected, err := cql.AppliedSchema(updates, applied, env, environment.Keyspace)
+	if err != nil {
+		fail("Unable to replay the applied migrations: %s", err.Error())
+	}
+	diffs, err := cql.DiffLiveSchema(session, expected)
+	if err != nil {
+		fail("Unable to read the schema: %s", err.Error())
+	}
+	if len(diffs) == 0 {
+		fmt.Println("The schema matches the applied migrations")
+		return
+	}
+	for _, d := range diffs {
+		fmt.Printf("  %s\n", d)
+	}
+	fail("The schema has drifted from the applied migrations in %d ways", len(diffs))
+}
+
+//
+// Work out which migrations 'up' should run, failing if the history, files and manifest
+// don't agree or the environment's out of order policy forbids them. Unless it's a
+// 'dryRun' a keyspace built before we were looking after it is baselined first.
+//
+func mustFindPending(session *gocql.Session, dryRun bool, limit string, conf *cql.MigrationConfig, env string) cql.Migrations {
 	// Retrieve all the previously applied updates from the DB.
-	applied := cql.ListAppliedMigrations(session)
+	applied := mustListApplied(session)
 
-	// Create Migration objects from each candidate file in the specified scripts path.
-	updates, listErr := cql.ListMigrationFiles(conf.Scripts.Path)
+	// Create Migration objects from each candidate file in the specified scripts path, along
+	// with any Go migrations that have been registered.
+	updates, listErr := conf.Scripts.List()
 	if listErr != nil {
 		fail("Failed to list migration files: %q", listErr)
 	}
+	environment := conf.Environments[env]
+	updates.SetVariables(cql.TemplateVariables(environment.Keyspace, env, environment.Variables))
 
 	// Ensure the files are in version order so they're applied in order.
 	sort.Sort(updates)
 
-	// Run each update if:
-	//   1. It is not detected in the 'applied' list from above.
-	//   2. The environment of the migration is not either 'all' or the same as the env flag.
-	//   3. The dry run flag was not set.
-	for _, m := range updates {
-		if applied.Contains(m) {
-			fmt.Printf("Ignoring: '%s' (already applied)\n", m.File)
-		} else {
-			if m.Environment != "all" && m.Environment != env {
-				fmt.Printf("Ignoring: '%s' (because environment is '%s')\n", m.File, m.Environment)
-				continue
-			}
-			if len(limit) > 0 && m.Version > limit {
-				fmt.Printf("Ignoring: '%s' (because is's version is > '%s')\n", m.File, limit)
-				continue
-			}
-			if !dryRun {
-				if err := m.Apply(session); err != nil {
-					fail("Unable to apply migration '%s':\n   %s", m.Name, err.Error())
-				}
-				if err := m.Save(session); err != nil {
-					fail("Unable to save migration '%s':\n   %s", m.Name, err.Error())
-				}
-			}
+	// A keyspace built before we were looking after it gets its history filled in first.
+	if !dryRun && len(applied) == 0 && conf.Environments[env].AutoBaseline {
+		applied = autoBaseline(session, updates, conf, env)
+	}
+
+	// Don't carry on if the history, or the manifest, no longer matches the files.
+	mustMatchManifest(conf, updates)
+	mustBeUnmodified(applied, updates)
+
+	// Pick out what needs running. Sorting has put any snapshot first and the repeatable
+	// migrations after all of the versioned ones.
+	pending, ignored, pendingErr := cql.PendingMigrations(applied, updates, env, limit)
+	if pendingErr != nil {
+		fail("Unable to work out which migrations to run: %s", pendingErr.Error())
+	}
+	for _, reason := range ignored {
+		fmt.Printf("Ignoring: %s\n", reason)
+	}
+
+	// Deal with anything that is older than what has already been applied according to the
+	// environment's policy.
+	outOfOrder, latest := cql.FindOutOfOrder(applied, pending)
+	if len(outOfOrder) > 0 {
+		policy := conf.Environments[env].OutOfOrder
+		msg := fmt.Sprintf("Pending migrations are older than the latest applied version '%s' (%s):", latest.Version, latest.Name)
+		for _, m := range outOfOrder {
+			msg += fmt.Sprintf("\n   %s", m.File)
+		}
+		switch policy {
+		case cql.OutOfOrderFail:
+			fail("%s\nRefusing to apply them; set 'outoforder' for environment '%s' to 'warn' or 'allow' to run them anyway.", msg, env)
+		case cql.OutOfOrderWarn:
+			fmt.Printf("WARNING: %s\n", msg)
+		}
+	}
+	return pending
+}
+
+//
+// Record every migration up to 'version' as applied without running any of them, so that
+// a keyspace built by hand can be looked after from here on.
+//
+func baseline(dryRun bool, version string, conf *cql.MigrationConfig, env string) {
+	updates, listErr := conf.Scripts.List()
+	if listErr != nil {
+		fail("Failed to list migration files: %s", listErr.Error())
+	}
+	sort.Sort(updates)
+
+	toBaseline, err := cql.BaselineMigrations(updates, version, env)
+	if err != nil {
+		fail("Unable to baseline: %s", err.Error())
+	}
+
+	var plan []string
+	for _, m := range toBaseline {
+		plan = append(plan, fmt.Sprintf("record %s (%s, %s) as applied", m.File, m.Version, m.Environment))
+	}
+	if dryRun {
+		for _, p := range plan {
+			fmt.Printf("Would %s\n", p)
 		}
+		return
+	}
+	mustConfirmChanges(conf, env, plan)
+
+	session := mustConnectToDB(conf, env)
+	defer session.Close()
+
+	if err := cql.InitSchemaVersion(session, conf.Environments[env].Keyspace); err != nil {
+		fail("Failed to init schema: %q", err)
+	}
+	if err := cql.Baseline(session, mustListApplied(session), toBaseline); err != nil {
+		fail("Unable to baseline: %s", err.Error())
+	}
+	fmt.Printf("Baselined %d migrations up to '%s'\n", len(toBaseline), version)
+}
+
+//
+// Baseline the environment to its configured version if the keyspace already has tables
+// in it. Returns the history as it now stands.
+//
+func autoBaseline(session *gocql.Session, updates cql.Migrations, conf *cql.MigrationConfig, env string) cql.Migrations {
+	environment := conf.Environments[env]
+
+	hasTables, err := cql.KeyspaceHasTables(session, environment.Keyspace)
+	if err != nil {
+		fail("Unable to check keyspace '%s' for tables: %s", environment.Keyspace, err.Error())
+	}
+	if !hasTables {
+		return nil
+	}
+
+	toBaseline, err := cql.BaselineMigrations(updates, environment.BaselineVersion, env)
+	if err != nil {
+		fail("Unable to auto-baseline: %s", err.Error())
+	}
+	fmt.Printf("Keyspace '%s' has tables but no history; baselining to '%s'\n", environment.Keyspace, environment.BaselineVersion)
+
+	var plan []string
+	for _, m := range toBaseline {
+		plan = append(plan, fmt.Sprintf("record %s (%s, %s) as applied", m.File, m.Version, m.Environment))
+	}
+	mustConfirmChanges(conf, env, plan)
+
+	if err := cql.Baseline(session, nil, toBaseline); err != nil {
+		fail("Unable to auto-baseline: %s", err.Error())
+	}
+	return mustListApplied(session)
+}
+
+func mustListApplied(session *gocql.Session) cql.Migrations {
+	applied, err := cql.ListAppliedMigrations(session)
+	if err != nil {
+		fail("Unable to read the migrations applied so far: %s", err.Error())
+	}
+	return applied
+}
+
+//
+// Replace the migrations up to 'through' with a snapshot of the schema they leave
+// behind. Nothing is run against the database: the snapshot only has to be committed,
+// and 'up' takes care of it from there.
+//
+func squash(dryRun bool, through string, keep bool, conf *cql.MigrationConfig) {
+	if !dryRun {
+		mustBeDirectory(conf)
+	}
+	updates, listErr := conf.Scripts.ListFiles()
+	if listErr != nil {
+		fail("Failed to list migration files: %s", listErr.Error())
+	}
+	mustMatchManifest(conf, updates)
+
+	sq, err := cql.PlanSquash(updates, through)
+	if err != nil {
+		fail("Unable to squash: %s", err.Error())
+	}
+	fmt.Printf("Squashing %d migrations up to '%s':\n", len(sq.Squashed), through)
+	for _, m := range sq.Squashed {
+		fmt.Printf("   %s\n", m.File)
+	}
+	for _, m := range sq.Kept {
+		fmt.Printf("Keeping: '%s' (environment specific and data migrations are not squashed)\n", m.File)
+	}
+	for _, st := range sq.Skipped {
+		fmt.Printf("WARNING: leaving out '%s' (its table is gone by '%s')\n", st.Summary(), through)
+	}
+	if dryRun {
+		fmt.Printf("Would write '%s':\n%s", sq.FileName(), sq.CQL)
+		return
+	}
+
+	snapshot, err := sq.Write(conf.Scripts.Path, keep)
+	if err != nil {
+		fail("Unable to write snapshot: %s", err.Error())
+	}
+	fmt.Printf("Wrote '%s'\n", snapshot.File)
+
+	if _, err := os.Stat(manifestPath(conf)); err == nil || conf.Scripts.RequireManifest {
+		updateManifest(conf)
+	}
+	fmt.Printf("Every environment must have reached '%s' (or be empty) before this is deployed.\n", through)
+}
+
+//
+// Put back data that was saved by 'up --backup-dir' before a destructive migration ran.
+//
+func restore(dryRun bool, manifestPath string, keyspace string, conf *cql.MigrationConfig, env string) {
+	manifest, err := cql.ReadBackupManifest(manifestPath)
+	if err != nil {
+		fail("Unable to read backup: %s", err.Error())
+	}
+	if keyspace == "" {
+		keyspace = manifest.Table.Keyspace
+	}
+	fmt.Printf("Backup of '%s.%s' taken %s before '%s' (%s) ran:\n   %s\n",
+		manifest.Table.Keyspace, manifest.Table.Name, manifest.Created, manifest.Migration, manifest.Version, manifest.Statement)
+	if dryRun {
+		return
+	}
+
+	mustConfirmChanges(conf, env, []string{fmt.Sprintf("restore %d rows into '%s.%s'", manifest.Rows, keyspace, manifest.Table.Name)})
+
+	session := mustConnectToDB(conf, env)
+	defer session.Close()
+
+	rows, err := cql.RestoreBackup(session, manifestPath, keyspace)
+	if err != nil {
+		fail("Unable to restore backup '%s' (%d rows restored):\n   %s", manifestPath, rows, err.Error())
 	}
+	fmt.Printf("Restored %d rows into '%s.%s'\n", rows, keyspace, manifest.Table.Name)
 }
@@ -0,0 +1,227 @@
+package cql
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+//
+// Annotations are '-- @name value' lines in the comments at the top of a migration file,
+// before its first statement. Anything after that is left alone since it could be data.
+//
+const annotationPrefix = "@"
+
+const (
+	descriptionAnnotation       = "description"
+	authorAnnotation            = "author"
+	envAnnotation               = "env"
+	dependsOnAnnotation         = "depends-on"
+	timeoutAnnotation           = "timeout"
+	consistencyAnnotation       = "consistency"
+	transactionalNoneAnnotation = "transactional-none"
+	tagsAnnotation              = "tags"
+	supersedesAnnotationName    = "supersedes"
+)
+
+//
+// Read the header annotations of a migration file into 'm'. An annotation we don't
+// know about is an error: a typo would otherwise quietly change what the migration does.
+//
+func (m *Migration) readAnnotations(content []byte) error {
+	seen := map[string]bool{}
+	return eachAnnotation(content, func(line, name, value string) error {
+		if err := m.annotate(name, value, seen[name]); err != nil {
+			return fmt.Errorf("'%s': %s", line, err.Error())
+		}
+		seen[name] = true
+		return nil
+	})
+}
+
+//
+// Call 'f' with each annotation line in the header of 'content', split into its name
+// and value.
+//
+func eachAnnotation(content []byte, f func(line, name, value string) error) error {
+	s := bufio.NewScanner(bytes.NewReader(content))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		var comment string
+		switch {
+		case strings.HasPrefix(line, "--"):
+			comment = strings.TrimSpace(strings.TrimPrefix(line, "--"))
+		case strings.HasPrefix(line, "//"):
+			comment = strings.TrimSpace(strings.TrimPrefix(line, "//"))
+		default:
+			return s.Err()
+		}
+		if !strings.HasPrefix(comment, annotationPrefix) {
+			continue
+		}
+
+		name, value := comment[len(annotationPrefix):], ""
+		if i := strings.IndexAny(name, " \t"); i >= 0 {
+			name, value = name[:i], strings.TrimSpace(name[i:])
+		}
+		if err := f(line, name, value); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+//
+// The header annotations which change how a migration runs, one '@name value' per line,
+// sorted by name (repeated ones keep their order). Descriptions, authors and tags are
+// left out: they're just for people.
+//
+func normalizedAnnotations(content []byte) ([]string, error) {
+	var names []string
+	values := map[string][]string{}
+	err := eachAnnotation(content, func(line, name, value string) error {
+		switch name {
+		case descriptionAnnotation, authorAnnotation, tagsAnnotation:
+			return nil
+		}
+		if _, ok := values[name]; !ok {
+			names = append(names, name)
+		}
+		values[name] = append(values[name], strings.Join(strings.Fields(value), " "))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	var lines []string
+	for _, name := range names {
+		for _, value := range values[name] {
+			lines = append(lines, strings.TrimSpace(annotationPrefix+name+" "+value))
+		}
+	}
+	return lines, nil
+}
+
+func (m *Migration) annotate(name, value string, repeated bool) error {
+	// Lists can be spread over several lines, and descriptions run on.
+	switch name {
+	case descriptionAnnotation:
+		m.Description = strings.TrimSpace(m.Description + " " + value)
+		return nil
+	case dependsOnAnnotation:
+		m.DependsOn = append(m.DependsOn, splitList(value)...)
+		return nil
+	case tagsAnnotation:
+		m.Tags = append(m.Tags, splitList(value)...)
+		return nil
+	case supersedesAnnotationName:
+		if !m.Snapshot {
+			return fmt.Errorf("Only snapshots can supersede other migrations")
+		}
+		return nil
+	}
+
+	if repeated {
+		return fmt.Errorf("'%s%s' is given more than once", annotationPrefix, name)
+	}
+	switch name {
+	case authorAnnotation:
+		m.Author = value
+
+	case envAnnotation:
+		if _, _, err := parseEnvironments(value); err != nil {
+			return err
+		}
+		// Narrowing the file name's environments is fine; adding to them isn't.
+		if !environmentIncludes(m.Environment, value) {
+			return fmt.Errorf("The file name says the environment is '%s'", m.Environment)
+		}
+		m.envAnnotation = value
+
+	case timeoutAnnotation:
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("Expected a duration like '10m'")
+		}
+		m.Timeout = timeout
+
+	case consistencyAnnotation:
+		consistency, err := parseConsistency(value)
+		if err != nil {
+			return err
+		}
+		m.Consistency = consistency
+
+	case dataAnnotation:
+		m.Data = value
+
+	case tableAnnotation:
+		m.Table = value
+
+	case scanAnnotation:
+		m.Scan = value
+
+	case concurrencyAnnotation, batchSizeAnnotation, rateAnnotation, rangesAnnotation:
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("Expected a whole number greater than zero")
+		}
+		switch name {
+		case concurrencyAnnotation:
+			m.Concurrency = n
+		case batchSizeAnnotation:
+			m.BatchSize = n
+		case rateAnnotation:
+			m.Rate = n
+		default:
+			m.Ranges = n
+		}
+
+	case transactionalNoneAnnotation, templateAnnotation:
+		if value != "" {
+			return fmt.Errorf("'%s%s' doesn't take a value", annotationPrefix, name)
+		}
+		if name == templateAnnotation {
+			m.Template = true
+		} else {
+			m.NonTransactional = true
+		}
+
+	default:
+		return fmt.Errorf("Unknown annotation '%s%s'", annotationPrefix, name)
+	}
+	return nil
+}
+
+//
+// Items separated by commas and/or spaces.
+//
+func splitList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
+//
+// A consistency level by name, in any case, with or without underscores, e.g.
+// 'LOCAL_QUORUM'.
+//
+func parseConsistency(value string) (gocql.Consistency, error) {
+	name := strings.ToLower(strings.Replace(value, "_", "", -1))
+	for c, n := range gocql.ConsistencyNames {
+		if c > 0 && n == name {
+			return gocql.Consistency(c), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown consistency level '%s'", value)
+}
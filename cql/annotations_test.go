@@ -0,0 +1,106 @@
+package cql
+
+import (
+	"time"
+
+	"github.com/gocql/gocql"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Annotations", func() {
+
+	parse := func(filename, content string) (*Migration, error) {
+		return migrationFromContent(filename, filename, []byte(content))
+	}
+
+	It("Reads the annotations in the header", func() {
+		m, err := parse("201501010600_add_team_index.all.cql", `-- Some notes about this migration.
+-- @description Index teams by name
+-- @description so they can be looked up.
+-- @author Jo Bloggs
+-- @env nonprod
+// @depends-on 201408210600_portal_init, 201501020600_create_table_team
+-- @timeout 10m
+-- @consistency LOCAL_QUORUM
+-- @transactional-none
+-- @tags index teams
+
+CREATE INDEX ON team (name);
+-- @bogus this isn't in the header so it's not an annotation
+`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m.Description).To(Equal("Index teams by name so they can be looked up."))
+		Expect(m.Author).To(Equal("Jo Bloggs"))
+		Expect(m.Environment).To(Equal("all"))
+		Expect(m.AppliesTo("nonprod")).To(BeTrue())
+		Expect(m.AppliesTo("prod")).To(BeFalse())
+		Expect(m.DependsOn).To(Equal([]string{"201408210600_portal_init", "201501020600_create_table_team"}))
+		Expect(m.Timeout).To(Equal(10 * time.Minute))
+		Expect(m.Consistency).To(Equal(gocql.LocalQuorum))
+		Expect(m.NonTransactional).To(BeTrue())
+		Expect(m.Tags).To(Equal([]string{"index", "teams"}))
+	})
+
+	It("Leaves files without annotations alone", func() {
+		m, err := parse("201501010600_add_team_index.uat1.cql", "CREATE INDEX ON team (name);\n")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m.Environment).To(Equal("uat1"))
+		Expect(m.Timeout).To(BeZero())
+		Expect(m.Consistency).To(BeZero())
+		Expect(m.NonTransactional).To(BeFalse())
+	})
+
+	It("Rejects annotations it doesn't know", func() {
+		_, err := parse("201501010600_x.all.cql", "-- @descripton typo\nSELECT * FROM t;\n")
+		Expect(err).To(MatchError(ContainSubstring("Unknown annotation '@descripton'")))
+	})
+
+	It("Rejects bad values", func() {
+		for _, header := range []string{
+			"-- @timeout soon",
+			"-- @consistency most",
+			"-- @transactional-none please",
+			"-- @author a\n-- @author b",
+			"-- @supersedes 201501010600_x.all",
+		} {
+			_, err := parse("201501010600_x.all.cql", header+"\nSELECT * FROM t;\n")
+			Expect(err).To(HaveOccurred(), header)
+		}
+	})
+
+	It("Won't contradict the file name's environment", func() {
+		_, err := parse("201501010600_x.uat1.cql", "-- @env uat2\nSELECT * FROM t;\n")
+		Expect(err).To(MatchError(ContainSubstring("'uat1'")))
+
+		m, err := parse("201501010600_x.uat1.cql", "-- @env uat1\nSELECT * FROM t;\n")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m.Environment).To(Equal("uat1"))
+
+		m, err = parse("201501010600_x.uat1+uat2.cql", "-- @env uat1\nSELECT * FROM t;\n")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m.Environment).To(Equal("uat1+uat2"))
+		Expect(m.AppliesTo("uat1")).To(BeTrue())
+		Expect(m.AppliesTo("uat2")).To(BeFalse())
+
+		_, err = parse("201501010600_x.!prod.cql", "-- @env uat1+prod\nSELECT * FROM t;\n")
+		Expect(err).To(MatchError(ContainSubstring("'!prod'")))
+	})
+
+	It("Still matches the history after '@env' is added", func() {
+		m, err := parse("201501010600_x.all.cql", "-- @env uat1\nSELECT * FROM t;\n")
+		Expect(err).NotTo(HaveOccurred())
+		applied := Migrations{{Version: "201501010600", Name: "x", Environment: "all"}}
+		pending, _, err := PendingMigrations(applied, Migrations{m}, "uat1", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pending).To(BeEmpty())
+	})
+
+	It("Reads the annotations kept in the history", func() {
+		m := migrationFromRow(map[string]interface{}{"name": "x", "version": "201501010600", "description": "Index teams", "author": "Jo", "tags": []string{"index"}})
+		Expect(m.Description).To(Equal("Index teams"))
+		Expect(m.Author).To(Equal("Jo"))
+		Expect(m.Tags).To(Equal([]string{"index"}))
+	})
+})
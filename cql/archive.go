@@ -0,0 +1,216 @@
+package cql
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//
+// Is 'path' a bundle of migrations rather than a directory of them?
+//
+func IsArchive(path string) bool {
+	lower := strings.ToLower(path)
+	return strings.HasSuffix(lower, ".zip") || strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz")
+}
+
+//
+// Open a .zip or .tar.gz of migrations as a read only file system. The whole thing is
+// read into memory; migrations are small. If everything is inside a single top level
+// directory (which is how most tools make archives) that directory is the root.
+//
+func OpenArchive(archivePath string) (fs.FS, error) {
+	b, err := ioutil.ReadFile(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var fsys fs.FS
+	if strings.HasSuffix(strings.ToLower(archivePath), ".zip") {
+		fsys, err = zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	} else {
+		fsys, err = readTarGz(bytes.NewReader(b))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read '%s': %s", archivePath, err.Error())
+	}
+	return archiveRoot(fsys)
+}
+
+func archiveRoot(fsys fs.FS) (fs.FS, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		return fs.Sub(fsys, entries[0].Name())
+	}
+	return fsys, nil
+}
+
+//
+// An archive's files, named by the archive's path followed by their path within it,
+// e.g. "build/migrations.zip/201501010600_init.all.cql". That way a file in an archive
+// can't be mistaken for one with the same name somewhere else, and errors say which
+// archive it's in.
+//
+type archiveFS struct {
+	path string
+	fsys fs.FS
+}
+
+func newArchiveFS(archivePath string, fsys fs.FS) archiveFS {
+	return archiveFS{path: path.Clean(filepath.ToSlash(archivePath)), fsys: fsys}
+}
+
+func (a archiveFS) Open(name string) (fs.File, error) {
+	if name == a.path {
+		return a.fsys.Open(".")
+	}
+	if !strings.HasPrefix(name, a.path+"/") {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return a.fsys.Open(strings.TrimPrefix(name, a.path+"/"))
+}
+
+func readTarGz(r io.Reader) (fs.FS, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	files := memFS{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+		if !fs.ValidPath(name) {
+			return nil, fmt.Errorf("Bad file name '%s'", hdr.Name)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = &memFile{name: path.Base(name), data: data, modTime: hdr.ModTime}
+	}
+}
+
+//
+// Just enough of an in memory file system to hold the contents of a tarball. Keys are
+// slash separated paths of regular files; directories are implied by them.
+//
+type memFS map[string]*memFile
+
+func (m memFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if f, ok := m[name]; ok {
+		return &openMemFile{memFile: f, Reader: bytes.NewReader(f.data)}, nil
+	}
+
+	prefix := name + "/"
+	if name == "." {
+		prefix = ""
+	}
+	seen := map[string]fs.DirEntry{}
+	for p, f := range m {
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(p, prefix)
+		if i := strings.Index(rest, "/"); i >= 0 {
+			seen[rest[:i]] = fs.FileInfoToDirEntry(&memFile{name: rest[:i], dir: true})
+		} else {
+			seen[rest] = fs.FileInfoToDirEntry(f)
+		}
+	}
+	if len(seen) == 0 && name != "." {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	dir := &memDir{memFile: &memFile{name: path.Base(name), dir: true}}
+	for _, n := range sortedKeys(seen) {
+		dir.entries = append(dir.entries, seen[n])
+	}
+	return dir, nil
+}
+
+// A file, or directory, in a memFS. It is its own fs.FileInfo.
+type memFile struct {
+	name    string
+	data    []byte
+	modTime time.Time
+	dir     bool
+}
+
+func (f *memFile) Name() string       { return f.name }
+func (f *memFile) Size() int64        { return int64(len(f.data)) }
+func (f *memFile) ModTime() time.Time { return f.modTime }
+func (f *memFile) IsDir() bool        { return f.dir }
+func (f *memFile) Sys() interface{}   { return nil }
+
+func (f *memFile) Mode() fs.FileMode {
+	if f.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+type openMemFile struct {
+	*memFile
+	*bytes.Reader
+}
+
+func (f *openMemFile) Stat() (fs.FileInfo, error) { return f.memFile, nil }
+func (f *openMemFile) Close() error               { return nil }
+
+type memDir struct {
+	*memFile
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *memDir) Stat() (fs.FileInfo, error) { return d.memFile, nil }
+func (d *memDir) Close() error               { return nil }
+
+func (d *memDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: fs.ErrInvalid}
+}
+
+func (d *memDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.offset += n
+	return rest[:n], nil
+}
+
+var _ fs.ReadDirFile = (*memDir)(nil)
@@ -0,0 +1,127 @@
+package cql
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing/fstest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Migration Sources", func() {
+
+	var dir string
+
+	files := map[string]string{
+		"201501010600_init.all.cql":  "CREATE TABLE team (id uuid PRIMARY KEY);\n",
+		"201501020600_seed.uat1.cql": "INSERT INTO team (id) VALUES (uuid());\n",
+		"notes/README.md":            "Not a migration.\n",
+	}
+
+	writeTarGz := func(path, prefix string) {
+		buf := &bytes.Buffer{}
+		gz := gzip.NewWriter(buf)
+		tw := tar.NewWriter(gz)
+		for name, content := range files {
+			Expect(tw.WriteHeader(&tar.Header{Name: prefix + name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})).To(Succeed())
+			tw.Write([]byte(content))
+		}
+		Expect(tw.Close()).To(Succeed())
+		Expect(gz.Close()).To(Succeed())
+		Expect(ioutil.WriteFile(path, buf.Bytes(), 0644)).To(Succeed())
+	}
+
+	writeZip := func(path string) {
+		buf := &bytes.Buffer{}
+		zw := zip.NewWriter(buf)
+		for name, content := range files {
+			w, err := zw.Create(name)
+			Expect(err).NotTo(HaveOccurred())
+			w.Write([]byte(content))
+		}
+		Expect(zw.Close()).To(Succeed())
+		Expect(ioutil.WriteFile(path, buf.Bytes(), 0644)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "cassandra-migrate")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should know an archive when it sees one", func() {
+		Expect(IsArchive("bundle.zip")).To(BeTrue())
+		Expect(IsArchive("bundle.TAR.GZ")).To(BeTrue())
+		Expect(IsArchive("bundle.tgz")).To(BeTrue())
+		Expect(IsArchive("migrations")).To(BeFalse())
+	})
+
+	It("should read migrations from a tarball, inside a top level directory or not", func() {
+		for _, prefix := range []string{"", "migrations/"} {
+			path := filepath.Join(dir, "bundle.tar.gz")
+			writeTarGz(path, prefix)
+
+			updates, errs := ListMigrationFiles(path)
+			Expect(errs).To(BeNil())
+			Expect(len(updates)).To(Equal(2))
+			Expect(updates[0].File).To(HavePrefix(path + "/"))
+
+			statements, err := updates[0].Statements()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(statements)).To(Equal(1))
+
+			ok, err := updates[0].VerifyChecksum(updates[0].Sum)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeTrue())
+		}
+	})
+
+	It("should read migrations and the manifest from a zip", func() {
+		path := filepath.Join(dir, "bundle.zip")
+		writeZip(path)
+
+		updates, errs := ListMigrationFiles(path)
+		Expect(errs).To(BeNil())
+		Expect(len(updates)).To(Equal(2))
+
+		_, err := ReadScriptsManifest(path)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		files[ManifestFileName] = "201501010600 init all sha256:00\n"
+		defer delete(files, ManifestFileName)
+		writeZip(path)
+		manifest, err := ReadScriptsManifest(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(manifest)).To(Equal(1))
+	})
+
+	It("should read migrations from any fs.FS", func() {
+		fsys := fstest.MapFS{}
+		for name, content := range files {
+			fsys["db/"+name] = &fstest.MapFile{Data: []byte(content)}
+		}
+		updates, errs := ListMigrationFilesFS(fsys, "db")
+		Expect(errs).To(BeNil())
+		Expect(len(updates)).To(Equal(2))
+		Expect(updates[0].File).To(HavePrefix("db/"))
+		Expect(updates[0].FS).NotTo(BeNil())
+	})
+
+	It("should have a well behaved in memory file system", func() {
+		fsys := memFS{}
+		for name, content := range files {
+			fsys[name] = &memFile{name: filepath.Base(name), data: []byte(content)}
+		}
+		Expect(fstest.TestFS(fsys, "201501010600_init.all.cql", "notes/README.md")).To(Succeed())
+	})
+})
@@ -0,0 +1,405 @@
+package cql
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gocql/gocql"
+)
+
+//
+// Backfills fill a table from another, e.g. a new denormalised one from the table it is
+// a view of, by scanning every row of the source a token range at a time and running
+// the migration's statements for each row. ':column' in a statement is the value of
+// that column of the row:
+//
+//   -- @scan team
+//   -- @rate 500
+//   -- @ranges 256
+//   -- @concurrency 8
+//   INSERT INTO team_by_name (name, org, id) VALUES (:name, :org, :id);
+//
+// @rate limits the rows read per second and @ranges is how many pieces the ring is cut
+// into. Each range is checkpointed once its writes are done, so a backfill that is
+// interrupted carries on from where it got to the next time it is run. Backfills which
+// need more than CQL can say are written in Go (see RegisterBackfill).
+//
+const (
+	scanAnnotation   = "scan"
+	rateAnnotation   = "rate"
+	rangesAnnotation = "ranges"
+)
+
+// How many token ranges a backfill is split into if it doesn't say.
+const defaultBackfillRanges = 64
+
+//
+// A write to make for a row of the table being backfilled from.
+//
+type Write struct {
+	CQL    string
+	Values []interface{}
+}
+
+//
+// Turns a row of the table being scanned into the writes to make for it, if any.
+//
+type BackfillFunc func(row map[string]interface{}) ([]Write, error)
+
+type Backfill struct {
+	Table     string   // The table to scan, in the keyspace being migrated unless qualified.
+	Columns   []string // The columns to read; all of them if empty.
+	Transform BackfillFunc
+
+	Rate        int // Rows per second; unlimited if zero.
+	Ranges      int
+	Concurrency int
+}
+
+//
+// Register a backfill written in Go. Like Register, it panics if the migration is
+// malformed or has been registered already.
+//
+func RegisterBackfill(version, name, env string, b Backfill) {
+	m, err := NewBackfillMigration(version, name, env, b)
+	if err != nil {
+		panic(err)
+	}
+	register(m)
+}
+
+//
+// Make a migration out of a Go backfill without registering it.
+//
+func NewBackfillMigration(version, name, env string, b Backfill) (*Migration, error) {
+	if b.Table == "" {
+		return nil, fmt.Errorf("Backfill '%s' has no table to scan", name)
+	}
+	if b.Transform == nil {
+		return nil, fmt.Errorf("Backfill '%s' has no transform", name)
+	}
+	var m *Migration
+	m, err := NewFuncMigration(version, name, env, func(ctx context.Context, session *gocql.Session) (err error) {
+		m.Rows, err = m.backfill(ctx, session)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.Scan = b.Table
+	m.Rate = b.Rate
+	m.Ranges = b.Ranges
+	m.Concurrency = b.Concurrency
+	m.scanColumns = b.Columns
+	m.transform = b.Transform
+	return m, nil
+}
+
+//
+// Check a migration file's scan annotations make sense together. The statements of
+// templates can only be checked once they're rendered.
+//
+func (m *Migration) checkBackfill(content []byte) error {
+	if m.Scan == "" {
+		if m.Rate > 0 || m.Ranges > 0 {
+			return fmt.Errorf("'%s' has '@%s' or '@%s' but no '@%s'", m.File, rateAnnotation, rangesAnnotation, scanAnnotation)
+		}
+		return nil
+	}
+	if m.Data != "" {
+		return fmt.Errorf("'%s' can't both load '@%s' and '@%s' a table", m.File, dataAnnotation, scanAnnotation)
+	}
+	if m.BatchSize > 0 {
+		return fmt.Errorf("'%s': '@%s' is only for '@%s' migrations", m.File, batchSizeAnnotation, dataAnnotation)
+	}
+	if m.Template {
+		return nil
+	}
+	statements, err := ReadCQLFile(bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	_, err = rowStatements(m.File, nonEmpty(statements))
+	return err
+}
+
+//
+// A statement to run for each row scanned, with ':column' swapped for '?' and the
+// columns whose values are bound to them, in order.
+//
+type rowStatement struct {
+	cql     string
+	columns []string
+}
+
+func rowStatements(file string, statements []string) (rows []*rowStatement, err error) {
+	if len(statements) == 0 {
+		return nil, fmt.Errorf("'%s' scans a table but has no statements to run for each row", file)
+	}
+	for _, text := range statements {
+		st := ClassifyStatement(text)
+		if st.Kind != DMLStatement {
+			return nil, fmt.Errorf("'%s' scans a table, so can only write rows: '%s'", file, st.Summary())
+		}
+		cql, columns := bindColumns(strings.TrimSpace(text))
+		rows = append(rows, &rowStatement{cql: cql, columns: columns})
+	}
+	return rows, nil
+}
+
+//
+// Swap each ':column' in 'text' for a '?' bind marker, leaving strings and quoted
+// identifiers alone, and return the columns in the order they appeared.
+//
+func bindColumns(text string) (string, []string) {
+	var buf strings.Builder
+	var columns []string
+	for i := 0; i < len(text); {
+		switch c := text[i]; {
+		case c == '\'' || c == '"':
+			_, n := readQuoted(text[i:], c)
+			buf.WriteString(text[i : i+n])
+			i += n
+
+		case c == '$' && strings.HasPrefix(text[i:], "$$"):
+			n := len(text)
+			if end := strings.Index(text[i+2:], "$$"); end >= 0 {
+				n = i + end + 4
+			}
+			buf.WriteString(text[i:n])
+			i = n
+
+		case c == ':' && i+1 < len(text) && text[i+1] == '"':
+			name, n := readQuoted(text[i+1:], '"')
+			buf.WriteString("?")
+			columns = append(columns, name)
+			i += 1 + n
+
+		case c == ':' && i+1 < len(text) && isIdentStart(text[i+1:]):
+			j := i + 1
+			for j < len(text) {
+				r, w := utf8.DecodeRuneInString(text[j:])
+				if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+					break
+				}
+				j += w
+			}
+			buf.WriteString("?")
+			columns = append(columns, strings.ToLower(text[i+1:j]))
+			i = j
+
+		default:
+			buf.WriteByte(c)
+			i++
+		}
+	}
+	return buf.String(), columns
+}
+
+func isIdentStart(text string) bool {
+	r, _ := utf8.DecodeRuneInString(text)
+	return unicode.IsLetter(r) || r == '_'
+}
+
+//
+// The columns to read from 'table', and what to do with each row of them.
+//
+func (m *Migration) backfillTransform(table *Table) ([]*Column, BackfillFunc, error) {
+	var names []string
+	transform := m.transform
+	if transform != nil {
+		names = m.scanColumns
+		if len(names) == 0 {
+			for _, c := range table.Columns {
+				names = append(names, c.Name)
+			}
+		}
+	} else {
+		texts, err := m.readCQL()
+		if err != nil {
+			return nil, nil, err
+		}
+		statements, err := rowStatements(m.File, nonEmpty(texts))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, st := range statements {
+			names = append(names, st.columns...)
+		}
+		transform = func(row map[string]interface{}) ([]Write, error) {
+			writes := make([]Write, len(statements))
+			for i, st := range statements {
+				writes[i] = Write{CQL: st.cql, Values: make([]interface{}, len(st.columns))}
+				for j, c := range st.columns {
+					writes[i].Values[j] = row[c]
+				}
+			}
+			return writes, nil
+		}
+	}
+
+	var columns []*Column
+	seen := map[string]bool{}
+	for _, name := range names {
+		c := table.Column(name)
+		if c == nil {
+			return nil, nil, fmt.Errorf("%s has no column '%s'", table.QualifiedName(), name)
+		}
+		if !seen[name] {
+			seen[name] = true
+			columns = append(columns, c)
+		}
+	}
+	if len(columns) == 0 {
+		// Still have to select something to find out the rows are there.
+		columns = table.PartitionKey()
+	}
+	return columns, transform, nil
+}
+
+//
+// Run a backfill, skipping the ranges an earlier, interrupted, run finished. Returns
+// the number of rows scanned, including those earlier runs'.
+//
+func (m *Migration) backfill(ctx context.Context, session *gocql.Session) (rows int64, err error) {
+	table, err := m.readTable(session, m.Scan)
+	if err != nil {
+		return 0, err
+	}
+	columns, transform, err := m.backfillTransform(table)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkSupportedTypes(table, columns); err != nil {
+		return 0, err
+	}
+
+	n := m.Ranges
+	if n < 1 {
+		n = defaultBackfillRanges
+	}
+	ranges := SplitTokenRing(n)
+	byRange, err := scansByTokenRange(session)
+	if err != nil {
+		return 0, err
+	}
+	// Without token ranges the whole table is read in one go, so there's nothing to
+	// resume from.
+	done := map[TokenRange]int64{}
+	if byRange {
+		if done, err = readCheckpoints(session, m); err != nil {
+			return 0, fmt.Errorf("Failed to read the checkpoints of '%s': %s", m.File, err.Error())
+		}
+	}
+	var todo []TokenRange
+	for _, r := range ranges {
+		if count, ok := done[r]; ok {
+			rows += count
+		} else {
+			todo = append(todo, r)
+		}
+	}
+	if len(todo) < len(ranges) {
+		fmt.Printf("   Resuming: %d of %d ranges (%d rows) were done already\n", len(ranges)-len(todo), len(ranges), rows)
+	}
+
+	limit := newRateLimiter(m.Rate)
+	newWriter := func() *parallelWriter {
+		w := newParallelWriter(ctx, session, m.Concurrency, 1)
+		w.consistency = m.Consistency
+		return w
+	}
+	w := newWriter()
+	started, scanned, rangeRows := time.Now(), int64(0), int64(0)
+	completed := len(ranges) - len(todo)
+
+	scanErr := scanTable(session, table, columns, todo, func(row map[string]interface{}) error {
+		if err := limit.Wait(ctx); err != nil {
+			return err
+		}
+		writes, err := transform(row)
+		if err != nil {
+			return err
+		}
+		for i := range writes {
+			if err := w.Add("", &boundStatement{cql: writes[i].CQL, values: writes[i].Values}); err != nil {
+				return err
+			}
+		}
+		rangeRows++
+		return nil
+	}, func(r TokenRange) error {
+		// Only a range whose writes have all been made counts as done.
+		err := w.Close()
+		w = newWriter()
+		if err != nil {
+			return err
+		}
+		if err := saveCheckpoint(session, m, r, rangeRows); err != nil {
+			return fmt.Errorf("Failed to checkpoint %s: %s", r, err.Error())
+		}
+		rows, scanned, rangeRows = rows+rangeRows, scanned+rangeRows, 0
+		completed++
+		fmt.Printf("   %d of %d ranges, %d rows (%.0f rows/s)\n", completed, len(ranges), rows,
+			float64(scanned)/time.Since(started).Seconds())
+		return nil
+	})
+	closeErr := w.Close()
+	if scanErr != nil {
+		return rows, scanErr
+	}
+	if closeErr != nil {
+		return rows, closeErr
+	}
+	// Without token ranges to checkpoint the whole table was read in one go.
+	rows += rangeRows
+
+	if err := clearCheckpoints(session, m); err != nil {
+		return rows, fmt.Errorf("Failed to clear the checkpoints of '%s': %s", m.File, err.Error())
+	}
+	fmt.Printf("   Backfilled %d rows from %s\n", rows, table.QualifiedName())
+	return rows, nil
+}
+
+//
+// Spaces out calls to Wait so there are no more than a given number a second.
+//
+type rateLimiter struct {
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perSecond int) *rateLimiter {
+	if perSecond < 1 {
+		return &rateLimiter{}
+	}
+	return &rateLimiter{interval: time.Second / time.Duration(perSecond)}
+}
+
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	if l.interval == 0 {
+		return ctx.Err()
+	}
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
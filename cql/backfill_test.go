@@ -0,0 +1,119 @@
+package cql
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Backfills", func() {
+
+	tmp := useTempDir()
+
+	team := &Table{Keyspace: "mystack", Name: "team", Columns: []*Column{
+		{Name: "org", Type: "text", Kind: PartitionKeyColumn},
+		{Name: "id", Type: "int", Kind: ClusteringColumn},
+		{Name: "name", Type: "text", Kind: RegularColumn},
+	}}
+
+	It("Reads the scan annotations", func() {
+		m, err := MigrationFromFile(tmp.write("201501010600_team_by_name.all.cql",
+			"-- @scan team\n-- @rate 500\n-- @ranges 256\n-- @concurrency 8\n"+
+				"INSERT INTO team_by_name (name, org, id) VALUES (:name, :org, :id);\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m.Scan).To(Equal("team"))
+		Expect(m.Rate).To(Equal(500))
+		Expect(m.Ranges).To(Equal(256))
+		Expect(m.Concurrency).To(Equal(8))
+	})
+
+	It("Binds the columns of each row to the statements", func() {
+		m, err := MigrationFromFile(tmp.write("201501010600_team_by_name.all.cql",
+			"-- @scan team\nINSERT INTO team_by_name (name, org, id) VALUES (:name, :org, :id);\n"+
+				"UPDATE team_count SET teams = teams + 1 WHERE org = :org;\n"))
+		Expect(err).NotTo(HaveOccurred())
+
+		columns, transform, err := m.backfillTransform(team)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(columns).To(Equal([]*Column{team.Columns[2], team.Columns[0], team.Columns[1]}))
+
+		writes, err := transform(map[string]interface{}{"org": "pearson", "id": 1, "name": "Avengers"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(writes).To(Equal([]Write{
+			{CQL: "INSERT INTO team_by_name (name, org, id) VALUES (?, ?, ?)", Values: []interface{}{"Avengers", "pearson", 1}},
+			{CQL: "UPDATE team_count SET teams = teams + 1 WHERE org = ?", Values: []interface{}{"pearson"}},
+		}))
+	})
+
+	It("Refuses columns the table doesn't have", func() {
+		m, err := MigrationFromFile(tmp.write("201501010600_team_by_name.all.cql",
+			"-- @scan team\nINSERT INTO team_by_name (name) VALUES (:nickname);\n"))
+		Expect(err).NotTo(HaveOccurred())
+		_, _, err = m.backfillTransform(team)
+		Expect(err).To(MatchError(ContainSubstring("no column 'nickname'")))
+	})
+
+	It("Leaves strings and map literals alone", func() {
+		cql, columns := bindColumns(`UPDATE t SET m = {'a:b': 1}, "x:y" = :"Name" WHERE k = :k AND s = $$:nope$$`)
+		Expect(cql).To(Equal(`UPDATE t SET m = {'a:b': 1}, "x:y" = ? WHERE k = ? AND s = $$:nope$$`))
+		Expect(columns).To(Equal([]string{"Name", "k"}))
+	})
+
+	It("Checks the annotations make sense together", func() {
+		tmp.write("teams.csv", "org,id\n")
+		for name, content := range map[string]string{
+			"rate without a scan":   "-- @rate 10\nINSERT INTO t (k) VALUES (1);\n",
+			"no statements":         "-- @scan team\n",
+			"a schema change":       "-- @scan team\nALTER TABLE team ADD nickname text;\n",
+			"data and a scan":       "-- @scan team\n-- @data teams.csv\n-- @table team\n",
+			"batches for a scan":    "-- @scan team\n-- @batch-size 10\nINSERT INTO t (k) VALUES (:org);\n",
+			"a rate that isn't one": "-- @scan team\n-- @rate fast\nINSERT INTO t (k) VALUES (:org);\n",
+		} {
+			_, err := MigrationFromFile(tmp.write("201501010600_backfill.all.cql", content))
+			Expect(err).To(HaveOccurred(), name)
+		}
+	})
+
+	It("Makes Go backfills", func() {
+		transform := func(row map[string]interface{}) ([]Write, error) { return nil, nil }
+		m, err := NewBackfillMigration("201501010600", "team_by_name", "", Backfill{Table: "team", Columns: []string{"org"}, Transform: transform, Rate: 10})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m.Func).NotTo(BeNil())
+		Expect(m.Scan).To(Equal("team"))
+		Expect(m.Rate).To(Equal(10))
+
+		columns, _, err := m.backfillTransform(team)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(columns).To(Equal([]*Column{team.Columns[0]}))
+
+		_, err = NewBackfillMigration("201501010600", "team_by_name", "", Backfill{Table: "team"})
+		Expect(err).To(MatchError(ContainSubstring("no transform")))
+	})
+
+	It("Keeps backfills out of snapshots", func() {
+		m, err := MigrationFromFile(tmp.write("201501010600_team_by_name.all.cql",
+			"-- @scan team\nINSERT INTO team_by_name (name, org, id) VALUES (:name, :org, :id);\n"))
+		Expect(err).NotTo(HaveOccurred())
+		create := &Migration{Version: "201501010500", Name: "create", Environment: "all", File: tmp.write("201501010500_create.all.cql", "CREATE TABLE team (org text PRIMARY KEY);\n")}
+		index := &Migration{Version: "201501010700", Name: "index", Environment: "all", File: tmp.write("201501010700_index.all.cql", "CREATE TABLE team_by_name (name text PRIMARY KEY);\n")}
+
+		sq, err := PlanSquash(Migrations{create, m, index}, "201501010700")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sq.Kept).To(Equal(Migrations{m}))
+	})
+
+	It("Limits the rate", func() {
+		limit := newRateLimiter(100)
+		started := time.Now()
+		for i := 0; i < 6; i++ {
+			Expect(limit.Wait(context.Background())).To(Succeed())
+		}
+		Expect(time.Since(started)).To(BeNumerically(">=", 50*time.Millisecond))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		Expect(newRateLimiter(0).Wait(ctx)).To(MatchError(context.Canceled))
+	})
+})
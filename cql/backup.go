@@ -0,0 +1,261 @@
+package cql
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+//
+// Describes a single backed up table (or set of columns): where it came from, what it
+// looked like and where the data went. Written alongside the data file as JSON.
+//
+type BackupManifest struct {
+	Migration   string    `json:"migration"`
+	Version     string    `json:"version"`
+	Environment string    `json:"environment"`
+	File        string    `json:"file"`
+	Statement   string    `json:"statement"`
+	Table       *Table    `json:"table"`
+	Format      string    `json:"format"`
+	DataFile    string    `json:"data_file"`
+	Rows        int       `json:"rows"`
+	Created     time.Time `json:"created"`
+}
+
+type BackupOptions struct {
+	Dir      string // Each migration gets a '<version>_<name>' directory under here.
+	Format   string // JSONLinesFormat or CSVFormat.
+	Keyspace string // For statements that don't name one.
+	Ranges   int    // How many token ranges to split each table scan into.
+}
+
+//
+// Save a copy of everything the destructive statements in 'm' are about to throw away.
+// DROP TABLE and TRUNCATE save the whole table, ALTER TABLE ... DROP just the primary
+// key and dropped columns and DROP KEYSPACE every table in the keyspace. Tables which
+// don't exist (yet) are skipped since there's nothing to lose, but any we can't read
+// stop the migration. Returns the paths of the manifests written.
+//
+func BackupMigration(session *gocql.Session, m *Migration, opts BackupOptions) (manifests []string, err error) {
+	changes, errs := FindDestructiveChanges(Migrations{m})
+	if errs != nil {
+		return nil, errs
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	if opts.Format == "" {
+		opts.Format = JSONLinesFormat
+	}
+	if opts.Ranges < 1 {
+		opts.Ranges = 64
+	}
+
+	dir := filepath.Join(opts.Dir, m.Version+"_"+m.Name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	for i, change := range changes {
+		st := change.Statement
+		keyspace := st.Keyspace
+		if keyspace == "" {
+			keyspace = opts.Keyspace
+		}
+
+		var tables []string
+		if st.Operation == "DROP KEYSPACE" {
+			keyspace = st.Object
+			if tables, err = ReadTableNames(session, keyspace); err != nil {
+				return manifests, fmt.Errorf("Failed to list tables in keyspace '%s': %s", keyspace, err.Error())
+			}
+		} else {
+			tables = []string{st.Object}
+		}
+
+		for _, name := range tables {
+			table, readErr := ReadTable(session, keyspace, name)
+			if isMissingTable(readErr) {
+				fmt.Printf("Not backing up '%s.%s' for '%s': %s\n", keyspace, name, st.Summary(), readErr.Error())
+				continue
+			}
+			if readErr != nil {
+				return manifests, fmt.Errorf("Failed to read '%s.%s' to back it up: %s", keyspace, name, readErr.Error())
+			}
+
+			columns := table.Columns
+			if st.Operation == "ALTER TABLE" {
+				columns = table.PrimaryKey()
+				for _, dropped := range st.Columns {
+					if c := table.Column(dropped); c != nil {
+						columns = append(columns, c)
+					}
+				}
+			}
+
+			prefix := fmt.Sprintf("%02d_%s.%s", i+1, keyspace, name)
+			manifest := &BackupManifest{
+				Migration:   m.Name,
+				Version:     m.Version,
+				Environment: m.Environment,
+				File:        m.File,
+				Statement:   st.Text,
+				Table:       &Table{Keyspace: keyspace, Name: name, Columns: columns},
+				Format:      opts.Format,
+				DataFile:    prefix + "." + opts.Format,
+				Created:     time.Now().UTC(),
+			}
+			path, backupErr := backupTable(session, manifest, filepath.Join(dir, prefix), opts.Ranges)
+			if backupErr != nil {
+				return manifests, backupErr
+			}
+			fmt.Printf("Backed up %d rows of '%s.%s' to '%s'\n", manifest.Rows, keyspace, name, path)
+			manifests = append(manifests, path)
+		}
+	}
+	return manifests, nil
+}
+
+func backupTable(session *gocql.Session, manifest *BackupManifest, prefix string, ranges int) (string, error) {
+	table := manifest.Table
+	if err := checkSupportedTypes(table, table.Columns); err != nil {
+		return "", err
+	}
+
+	f, err := os.Create(filepath.Join(filepath.Dir(prefix), manifest.DataFile))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	names := make([]string, len(table.Columns))
+	for i, c := range table.Columns {
+		names[i] = c.Name
+	}
+	w, err := NewRowWriter(manifest.Format, f, names)
+	if err != nil {
+		return "", err
+	}
+
+	// Scan with the full table definition so the partition key is known, but only
+	// select the columns we're saving.
+	full, err := ReadTable(session, table.Keyspace, table.Name)
+	if err != nil {
+		return "", err
+	}
+	scanErr := scanTable(session, full, table.Columns, SplitTokenRing(ranges), func(row map[string]interface{}) error {
+		manifest.Rows++
+		return w.Write(row)
+	}, nil)
+	if scanErr != nil {
+		return "", scanErr
+	}
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	path := prefix + ".manifest.json"
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return path, ioutil.WriteFile(path, b, 0644)
+}
+
+func ReadBackupManifest(path string) (*BackupManifest, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &BackupManifest{}
+	if err := json.Unmarshal(b, manifest); err != nil {
+		return nil, fmt.Errorf("Invalid backup manifest '%s': %s", path, err.Error())
+	}
+	if manifest.Table == nil || len(manifest.Table.Columns) == 0 {
+		return nil, fmt.Errorf("Invalid backup manifest '%s': no table definition", path)
+	}
+	return manifest, nil
+}
+
+//
+// Load a backup back into the table it came from (or the same table in 'keyspace' if
+// one is given). If the table has gone it is recreated from the manifest and any
+// dropped columns are added back before the rows are inserted.
+//
+func RestoreBackup(session *gocql.Session, manifestPath string, keyspace string) (rows int, err error) {
+	manifest, err := ReadBackupManifest(manifestPath)
+	if err != nil {
+		return 0, err
+	}
+	table := manifest.Table
+	if keyspace != "" {
+		table.Keyspace = keyspace
+	}
+
+	existing, readErr := ReadTable(session, table.Keyspace, table.Name)
+	if readErr != nil && !isMissingTable(readErr) {
+		return 0, fmt.Errorf("Failed to read %s: %s", table.QualifiedName(), readErr.Error())
+	}
+	if readErr != nil {
+		fmt.Printf("Recreating table %s\n", table.QualifiedName())
+		if err := session.Query(table.CreateCQL()).Exec(); err != nil {
+			return 0, fmt.Errorf("Failed to recreate %s: %s", table.QualifiedName(), err.Error())
+		}
+	} else {
+		for _, c := range table.Columns {
+			if existing.Column(c.Name) == nil {
+				fmt.Printf("Adding column %s back to %s\n", quoteIdent(c.Name), table.QualifiedName())
+				addCQL := fmt.Sprintf("ALTER TABLE %s ADD %s %s", table.QualifiedName(), quoteIdent(c.Name), c.Type)
+				if err := session.Query(addCQL).Exec(); err != nil {
+					return 0, fmt.Errorf("Failed to add column '%s' back: %s", c.Name, err.Error())
+				}
+			}
+		}
+	}
+
+	f, err := os.Open(filepath.Join(filepath.Dir(manifestPath), manifest.DataFile))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r, err := NewRowReader(manifest.Format, f)
+	if err != nil {
+		return 0, err
+	}
+
+	markers := strings.TrimRight(strings.Repeat("?, ", len(table.Columns)), ", ")
+	insertCQL := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table.QualifiedName(), quoteIdents(table.Columns), markers)
+	for {
+		row, readErr := r.Read()
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return rows, fmt.Errorf("Failed to read row %d of '%s': %s", rows+1, manifest.DataFile, readErr.Error())
+		}
+
+		values := make([]interface{}, len(table.Columns))
+		for i, c := range table.Columns {
+			if values[i], err = ConvertValue(c.Type, row[c.Name]); err != nil {
+				return rows, fmt.Errorf("Row %d, column '%s': %s", rows+1, c.Name, err.Error())
+			}
+		}
+		if err := session.Query(insertCQL, values...).Exec(); err != nil {
+			return rows, fmt.Errorf("Failed to restore row %d: %s", rows+1, err.Error())
+		}
+		rows++
+	}
+	if rows != manifest.Rows {
+		return rows, fmt.Errorf("Restored %d rows but the manifest says there should be %d", rows, manifest.Rows)
+	}
+	return rows, nil
+}
@@ -0,0 +1,62 @@
+package cql
+
+import (
+	"fmt"
+
+	"github.com/gocql/gocql"
+)
+
+//
+// The versioned migrations for environment 'env' up to and including 'version' which
+// are to be recorded as applied when adopting a keyspace that was built by hand. It's
+// an error for 'version' not to be one of them; baselining to a typo would be bad.
+//
+func BaselineMigrations(updates Migrations, version string, env string) (baseline Migrations, err error) {
+	found := false
+	for _, m := range updates {
+		if m.Repeatable || !m.AppliesTo(env) || CompareVersions(m.Version, version) > 0 {
+			continue
+		}
+		if CompareVersions(m.Version, version) == 0 {
+			found = true
+		}
+		baseline = append(baseline, m)
+	}
+	if !found {
+		return nil, fmt.Errorf("There is no migration with version '%s' for environment '%s'", version, env)
+	}
+	return baseline, nil
+}
+
+//
+// Record each of 'baseline' as applied, flagged as baselined rather than executed. The
+// history must not already have any versioned migrations in it.
+//
+func Baseline(session *gocql.Session, applied Migrations, baseline Migrations) error {
+	if latest := applied.Latest(); latest != nil {
+		return fmt.Errorf("Can't baseline; '%s' (%s) has already been applied", latest.Name, latest.Version)
+	}
+	for _, m := range baseline {
+		m.Baselined = true
+		if err := m.Save(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// Does the keyspace have anything in it other than our own schema_version tables?
+//
+func KeyspaceHasTables(session *gocql.Session, keyspace string) (bool, error) {
+	names, err := ReadTableNames(session, keyspace)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range names {
+		if !isHistoryTable(name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,67 @@
+package cql
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Baselining", func() {
+
+	updates := Migrations{
+		{Name: "portal_init", Version: "201408210600", Environment: "all"},
+		{Name: "add_seed_data", Version: "201501010600", Environment: "uat1"},
+		{Name: "create_table_team", Version: "201501020600", Environment: "all"},
+		{Name: "later", Version: "201502010600", Environment: "all"},
+		{Name: "team_view", Environment: "all", Repeatable: true},
+	}
+
+	It("should pick the versioned migrations for the environment up to the version", func() {
+		baseline, err := BaselineMigrations(updates, "201501020600", "local")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(baseline)).To(Equal(2))
+		Expect(baseline[0].Name).To(Equal("portal_init"))
+		Expect(baseline[1].Name).To(Equal("create_table_team"))
+
+		baseline, err = BaselineMigrations(updates, "201501020600", "uat1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(baseline)).To(Equal(3))
+	})
+
+	It("should refuse a version that doesn't exist", func() {
+		_, err := BaselineMigrations(updates, "201501020601", "local")
+		Expect(err).To(HaveOccurred())
+
+		_, err = BaselineMigrations(updates, "201501010600", "local")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should refuse to baseline over existing history", func() {
+		err := Baseline(nil, Migrations{updates[0]}, updates[:2])
+		Expect(err).To(MatchError(ContainSubstring("already been applied")))
+	})
+
+	It("should record baselined migrations as such", func() {
+		Expect((&Migration{Baselined: true}).Kind()).To(Equal(BaselineKind))
+		m := migrationFromRow(map[string]interface{}{"name": "portal_init", "version": "201408210600", "kind": BaselineKind})
+		Expect(m.Baselined).To(BeTrue())
+		Expect(m.Repeatable).To(BeFalse())
+	})
+
+	It("should only take a missing history table as no history", func() {
+		Expect(isMissingHistory(fakeRequestError{invalidRequestCode, "unconfigured table schema_version"})).To(BeTrue())
+		Expect(isMissingHistory(fakeRequestError{invalidRequestCode, "unconfigured columnfamily schema_version"})).To(BeTrue())
+		Expect(isMissingHistory(fakeRequestError{0x1200, "Operation timed out - received only 0 responses."})).To(BeFalse())
+		Expect(isMissingHistory(errors.New("gocql: no hosts available in the pool"))).To(BeFalse())
+	})
+})
+
+type fakeRequestError struct {
+	code    int
+	message string
+}
+
+func (e fakeRequestError) Code() int       { return e.code }
+func (e fakeRequestError) Message() string { return e.message }
+func (e fakeRequestError) Error() string   { return e.message }
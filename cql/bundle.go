@@ -0,0 +1,48 @@
+package cql
+
+import (
+	"fmt"
+)
+
+//
+// The migrations to bundle into a single script for a cluster in environment 'env'
+// which nobody can point this tool at, whose history goes up to and including version
+// 'from' (or is empty, if 'from' is). That's everything after it for the environment,
+// plus every repeatable migration since there's no telling which have changed. The
+// script is all the DBAs run, so Go migrations, data files and backfills can't go in it.
+//
+func BundleMigrations(updates Migrations, env, from string) (Migrations, error) {
+	var applied Migrations
+	if from != "" {
+		found := false
+		for _, m := range updates {
+			if m.Repeatable {
+				continue
+			}
+			if CompareVersions(m.Version, from) == 0 {
+				found = true
+			}
+			if CompareVersions(m.Version, from) <= 0 && m.AppliesTo(env) {
+				applied = append(applied, m)
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("There is no migration with version '%s'", from)
+		}
+	}
+
+	pending, _, err := PendingMigrations(applied, updates, env, "")
+	if err != nil {
+		return nil, err
+	}
+	var errs Errors
+	for _, m := range pending {
+		if !m.Baselined && !m.plainCQL() {
+			errs = append(errs, fmt.Errorf("'%s' can't be bundled since it isn't just CQL", m.File))
+		}
+	}
+	if errs != nil {
+		return nil, errs
+	}
+	return pending, nil
+}
@@ -0,0 +1,93 @@
+package cql
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Bundles", func() {
+
+	create := &Migration{Version: "201501010600", Name: "create", Environment: "all", File: "201501010600_create.all.cql"}
+	seed := &Migration{Version: "201501010700", Name: "seed", Environment: "uat1", File: "201501010700_seed.uat1.cql"}
+	index := &Migration{Version: "201501010800", Name: "index", Environment: "all", File: "201501010800_index.all.cql"}
+	views := &Migration{Name: "views", Environment: "all", File: "R__views.all.cql", Repeatable: true}
+	updates := Migrations{create, seed, index, views}
+
+	It("Bundles everything after the version the cluster is at", func() {
+		pending, err := BundleMigrations(updates, "prod", "201501010600")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pending).To(Equal(Migrations{index, views}))
+
+		pending, err = BundleMigrations(updates, "prod", "20150101060000")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pending).To(Equal(Migrations{index, views}))
+	})
+
+	It("Bundles everything for a new cluster", func() {
+		pending, err := BundleMigrations(updates, "uat1", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pending).To(Equal(Migrations{create, seed, index, views}))
+	})
+
+	It("Needs a version there is a migration for", func() {
+		_, err := BundleMigrations(updates, "prod", "201501010630")
+		Expect(err).To(MatchError("There is no migration with version '201501010630'"))
+	})
+
+	It("Only bundles CQL", func() {
+		fn, err := NewFuncMigration("201501010900", "backfill", "", func(ctx context.Context, session *gocql.Session) error { return nil })
+		Expect(err).NotTo(HaveOccurred())
+		data := &Migration{Version: "201501011000", Name: "load", Environment: "all", File: "201501011000_load.all.cql", Data: "teams.csv", Table: "team"}
+
+		_, err = BundleMigrations(append(Migrations{fn, data}, updates...), "prod", "201501010800")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("'" + fn.File + "' can't be bundled"))
+		Expect(err.Error()).To(ContainSubstring("'201501011000_load.all.cql' can't be bundled"))
+	})
+
+	It("Writes history rows an old schema_version table can take", func() {
+		dir, err := ioutil.TempDir("", "cassandra-migrate")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "201501010900_add_name.all.cql")
+		Expect(ioutil.WriteFile(path, []byte("-- @description Names\nALTER TABLE team ADD name text;\n"), 0644)).To(Succeed())
+		m, err := MigrationFromFile(path)
+		Expect(err).NotTo(HaveOccurred())
+
+		pending, err := BundleMigrations(Migrations{create, m}, "prod", "201501010600")
+		Expect(err).NotTo(HaveOccurred())
+		buf := &bytes.Buffer{}
+		Expect(WritePlan(buf, pending, "prod", "mystack", nil, time.Now())).To(Succeed())
+
+		// The table as the first versions of the tool made it, and as cqlsh leaves it
+		// once it has run the script, carrying on past any statement that fails.
+		r := NewSchemaReplay("mystack")
+		Expect(r.Apply("CREATE TABLE schema_version (applied timestamp, environment text, name text, checksum blob, user text, version text, PRIMARY KEY (name, version))")).To(Succeed())
+		statements, err := ReadCQLFile(buf)
+		Expect(err).NotTo(HaveOccurred())
+		inserts := 0
+		for _, text := range nonEmpty(statements) {
+			p := &tokenParser{toks: tokenize(strings.TrimSpace(text))}
+			switch {
+			case p.accept("ALTER", "TABLE", "schema_version"):
+				r.Apply(text)
+			case p.accept("INSERT", "INTO", "schema_version"):
+				inserts++
+				history := r.Schema.Keyspaces["mystack"].Tables["schema_version"]
+				for _, column := range p.identList() {
+					Expect(history.Column(column)).NotTo(BeNil(), column)
+				}
+			}
+		}
+		Expect(inserts).To(Equal(1))
+	})
+})
@@ -0,0 +1,148 @@
+package cql
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	// SHA-256 of the file's statements with comments stripped, whitespace collapsed and
+	// line endings normalised, so reformatting a file doesn't make it look modified. The
+	// annotations which change how it runs are kept.
+	SHA256Checksum = "sha256"
+
+	// SHA-256 of the file's bytes exactly as they are.
+	RawSHA256Checksum = "sha256-raw"
+
+	// What we used to store: the bare SHA-1 of the file's bytes with no tag on it.
+	LegacySHA1Checksum = "sha1"
+)
+
+//
+// The algorithm used for new checksums. Set from the 'checksum' scripts setting.
+//
+var DefaultChecksumAlgorithm = SHA256Checksum
+
+//
+// Work out the checksum of a migration file's 'content' with 'algorithm'. Checksums are
+// stored as '<algorithm>:<hex digest>' so we always know how to verify them later.
+//
+func Checksum(algorithm string, content []byte) ([]byte, error) {
+	var digest []byte
+	switch algorithm {
+	case SHA256Checksum:
+		normalized, err := NormalizeCQL(content)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256([]byte(normalized))
+		digest = sum[:]
+	case RawSHA256Checksum:
+		sum := sha256.Sum256(content)
+		digest = sum[:]
+	case LegacySHA1Checksum:
+		sum := sha1.Sum(content)
+		return sum[:], nil
+	default:
+		return nil, fmt.Errorf("Unknown checksum algorithm '%s'", algorithm)
+	}
+	return []byte(algorithm + ":" + hex.EncodeToString(digest)), nil
+}
+
+//
+// Which algorithm produced the stored checksum 'sum'. Anything without one of our tags is
+// one of the old SHA-1s; they're raw bytes, so may well have a ':' in them anywhere.
+//
+func ChecksumAlgorithm(sum []byte) string {
+	for _, algorithm := range []string{SHA256Checksum, RawSHA256Checksum, goChecksumAlgorithm} {
+		if bytes.HasPrefix(sum, []byte(algorithm+":")) {
+			return algorithm
+		}
+	}
+	return LegacySHA1Checksum
+}
+
+//
+// Check the stored checksum 'sum' against 'content' using whichever algorithm it was
+// made with.
+//
+func VerifyChecksum(sum []byte, content []byte) (bool, error) {
+	expected, err := Checksum(ChecksumAlgorithm(sum), content)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(sum, expected), nil
+}
+
+//
+// Printable version of a stored checksum. Legacy SHA-1s get a tag for consistency.
+//
+func FormatChecksum(sum []byte) string {
+	if ChecksumAlgorithm(sum) == LegacySHA1Checksum {
+		return LegacySHA1Checksum + ":" + hex.EncodeToString(sum)
+	}
+	return string(sum)
+}
+
+//
+// Reduce a CQL file to just its statements: comments gone, each statement's tokens
+// separated by a single space (string literals are left exactly as they are) and one
+// statement per line. The annotations which change how it runs (see
+// normalizedAnnotations) go first, so editing one of those still counts as a change.
+//
+func NormalizeCQL(content []byte) (string, error) {
+	statements, err := ReadCQLFile(bytes.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+	annotations, err := normalizedAnnotations(content)
+	if err != nil {
+		return "", err
+	}
+
+	var normalized []string
+	for _, st := range statements {
+		toks := tokenize(st)
+		if len(toks) == 0 {
+			continue
+		}
+		words := make([]string, len(toks))
+		for i, t := range toks {
+			words[i] = t.literal()
+		}
+		normalized = append(normalized, strings.Join(words, " "))
+	}
+	if len(annotations) == 0 {
+		return strings.Join(normalized, ";\n"), nil
+	}
+	return strings.Join(annotations, "\n") + "\n" + strings.Join(normalized, ";\n"), nil
+}
+
+//
+// Check every applied migration against the file it was applied from and return the
+// files which no longer match. Applied migrations whose file has gone are not our
+// concern here.
+//
+func FindModifiedMigrations(applied Migrations, updates Migrations) (modified Migrations, errs Errors) {
+	for _, m := range updates {
+		for _, a := range applied {
+			if !a.Compare(m) || len(a.Sum) == 0 {
+				continue
+			}
+			ok, err := m.VerifyChecksum(a.Sum)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("Failed to verify checksum of '%s': %s", m.File, err.Error()))
+			} else if !ok {
+				modified = append(modified, m)
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return modified, nil
+	}
+	return modified, errs
+}
@@ -0,0 +1,140 @@
+package cql
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Migration Checksums", func() {
+
+	original := []byte("CREATE TABLE team (\n  name text,\n  PRIMARY KEY (name)\n);\n")
+
+	It("should tag checksums with their algorithm", func() {
+		sum, err := Checksum(SHA256Checksum, original)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(sum)).To(HavePrefix("sha256:"))
+		Expect(ChecksumAlgorithm(sum)).To(Equal(SHA256Checksum))
+
+		sum, err = Checksum(RawSHA256Checksum, original)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(sum)).To(HavePrefix("sha256-raw:"))
+	})
+
+	It("should ignore line endings, whitespace and comments by default", func() {
+		reformatted := []byte("-- The team table\r\nCREATE TABLE team (name text, PRIMARY KEY (name));   \r\n")
+
+		sum, _ := Checksum(SHA256Checksum, original)
+		ok, err := VerifyChecksum(sum, reformatted)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+
+		raw, _ := Checksum(RawSHA256Checksum, original)
+		ok, err = VerifyChecksum(raw, reformatted)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should notice real changes, including inside string literals", func() {
+		sum, _ := Checksum(SHA256Checksum, []byte("INSERT INTO t (a) VALUES ('x  y');"))
+		ok, _ := VerifyChecksum(sum, []byte("INSERT INTO t (a) VALUES ('x y');"))
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should notice edits to the annotations that change how a migration runs", func() {
+		header := "-- @description Seed teams\n-- @env uat1\n-- @consistency QUORUM\n"
+		sum, _ := Checksum(SHA256Checksum, []byte(header+"INSERT INTO t (a) VALUES (1);"))
+
+		for _, edited := range []string{
+			"-- @description Seed teams\n-- @env uat2\n-- @consistency QUORUM\n",
+			"-- @description Seed teams\n-- @env uat1\n-- @consistency ONE\n",
+			"-- @description Seed teams\n-- @env uat1\n-- @consistency QUORUM\n-- @timeout 5m\n",
+		} {
+			ok, err := VerifyChecksum(sum, []byte(edited+"INSERT INTO t (a) VALUES (1);"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeFalse(), edited)
+		}
+
+		for _, same := range []string{
+			"-- @consistency   QUORUM\n// @env uat1\n-- @description Seed all the teams\n",
+			"-- @env uat1\n-- @author Jo\n-- @consistency QUORUM\n",
+		} {
+			ok, err := VerifyChecksum(sum, []byte(same+"INSERT INTO t (a) VALUES (1);"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeTrue(), same)
+		}
+	})
+
+	It("should still verify legacy untagged SHA-1 checksums", func() {
+		legacy := sha1.Sum(original)
+		Expect(ChecksumAlgorithm(legacy[:])).To(Equal(LegacySHA1Checksum))
+		Expect(FormatChecksum(legacy[:])).To(HavePrefix("sha1:"))
+
+		ok, err := VerifyChecksum(legacy[:], original)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+
+		ok, _ = VerifyChecksum(legacy[:], append(original, '\n'))
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should verify legacy SHA-1 checksums which happen to contain a ':'", func() {
+		found := 0
+		for i := 0; i < 200; i++ {
+			content := append([]byte(fmt.Sprintf("-- %d\n", i)), original...)
+			legacy := sha1.Sum(content)
+			if bytes.IndexByte(legacy[1:], ':') < 0 {
+				continue
+			}
+			found++
+			Expect(ChecksumAlgorithm(legacy[:])).To(Equal(LegacySHA1Checksum))
+			ok, err := VerifyChecksum(legacy[:], content)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeTrue())
+		}
+		Expect(found).To(BeNumerically(">", 0))
+	})
+
+	Context("With applied migrations", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "cassandra-migrate")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should find the files modified since they were applied", func() {
+			path := filepath.Join(dir, "201501020600_create_table_team.all.cql")
+			Expect(ioutil.WriteFile(path, original, 0644)).To(Succeed())
+			updates, errs := ListMigrationFiles(dir)
+			Expect(errs).To(BeNil())
+
+			legacy := sha1.Sum(original)
+			applied := Migrations{{Name: "create_table_team", Version: "201501020600", Environment: "all", Sum: legacy[:]}}
+
+			modified, errs := FindModifiedMigrations(applied, updates)
+			Expect(errs).To(BeNil())
+			Expect(modified).To(BeEmpty())
+
+			edited := strings.Replace(string(original), "name text", "name text, size int", 1)
+			Expect(ioutil.WriteFile(path, []byte(edited), 0644)).To(Succeed())
+
+			modified, errs = FindModifiedMigrations(applied, updates)
+			Expect(errs).To(BeNil())
+			Expect(len(modified)).To(Equal(1))
+			Expect(modified[0].File).To(Equal(path))
+		})
+	})
+})
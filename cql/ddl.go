@@ -0,0 +1,1145 @@
+package cql
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//
+// Works out the schema that a series of CQL statements leaves behind by applying each
+// of them to a Schema the way Cassandra would. It is strict in the same way Cassandra
+// is: creating something which already exists, or altering something which doesn't,
+// is an error unless IF [NOT] EXISTS says otherwise.
+//
+type SchemaReplay struct {
+	Schema *Schema
+
+	// The keyspace unqualified names refer to. Migrations are run in the environment's
+	// keyspace so this is where each of them starts out.
+	DefaultKeyspace string
+	keyspace        string
+}
+
+func NewSchemaReplay(keyspace string) *SchemaReplay {
+	r := &SchemaReplay{Schema: NewSchema(), DefaultKeyspace: keyspace, keyspace: keyspace}
+	r.Schema.Keyspace(keyspace)
+	return r
+}
+
+//
+// Replay every statement in 'updates', in order, starting from an empty keyspace.
+//
+func ReplayMigrations(updates Migrations, keyspace string) (*Schema, error) {
+	r := NewSchemaReplay(keyspace)
+	for _, m := range updates {
+		if err := r.ApplyMigration(m); err != nil {
+			return nil, err
+		}
+	}
+	return r.Schema, nil
+}
+
+func (r *SchemaReplay) ApplyMigration(m *Migration) error {
+	statements, err := m.Statements()
+	if err != nil {
+		return fmt.Errorf("Failed to read '%s': %s", m.File, err.Error())
+	}
+	r.keyspace = r.DefaultKeyspace
+	for _, st := range statements {
+		if err := r.Apply(st.Text); err != nil {
+			return fmt.Errorf("%s: %s: %s", m.File, st.Summary(), err.Error())
+		}
+	}
+	return nil
+}
+
+//
+// Apply a single statement. Anything which doesn't change the schema (DML, TRUNCATE,
+// permissions and so on) is ignored.
+//
+func (r *SchemaReplay) Apply(text string) error {
+	p := &tokenParser{toks: tokenize(text)}
+	switch {
+	case p.accept("CREATE"):
+		orReplace := p.accept("OR", "REPLACE")
+		custom := p.accept("CUSTOM")
+		switch p.objectType() {
+		case "KEYSPACE":
+			return r.createKeyspace(p)
+		case "TABLE":
+			return r.createTable(p)
+		case "INDEX":
+			return r.createIndex(p, custom)
+		case "TYPE":
+			return r.createType(p)
+		case "MATERIALIZED VIEW":
+			return r.createView(p)
+		case "FUNCTION":
+			return r.createFunction(p, orReplace, false)
+		case "AGGREGATE":
+			return r.createFunction(p, orReplace, true)
+		}
+
+	case p.accept("ALTER"):
+		switch p.objectType() {
+		case "KEYSPACE":
+			return r.alterKeyspace(p)
+		case "TABLE":
+			return r.alterTable(p)
+		case "TYPE":
+			return r.alterType(p)
+		case "MATERIALIZED VIEW":
+			return r.alterView(p)
+		}
+
+	case p.accept("DROP"):
+		switch p.objectType() {
+		case "KEYSPACE":
+			return r.dropKeyspace(p)
+		case "TABLE":
+			return r.dropTable(p)
+		case "INDEX":
+			return r.dropIndex(p)
+		case "TYPE":
+			return r.dropType(p)
+		case "MATERIALIZED VIEW":
+			return r.dropView(p)
+		case "FUNCTION":
+			return r.dropFunction(p, false)
+		case "AGGREGATE":
+			return r.dropFunction(p, true)
+		}
+
+	case p.accept("USE"):
+		name, err := p.ident()
+		if err != nil {
+			return err
+		}
+		r.keyspace = name
+	}
+	return nil
+}
+
+//
+// Resolve a possibly unqualified name to its keyspace.
+//
+func (r *SchemaReplay) name(p *tokenParser) (*Keyspace, string, error) {
+	keyspace, name := p.qualifiedName()
+	if name == "" {
+		return nil, "", fmt.Errorf("Expected a name")
+	}
+	if keyspace == "" {
+		keyspace = r.keyspace
+	}
+	return r.Schema.Keyspace(keyspace), name, nil
+}
+
+func (r *SchemaReplay) table(p *tokenParser) (*Keyspace, *Table, error) {
+	ks, name, err := r.name(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	t, ok := ks.Tables[name]
+	if !ok {
+		return nil, nil, fmt.Errorf("Table '%s' does not exist", qualifiedName(ks.Name, name))
+	}
+	return ks, t, nil
+}
+
+func (r *SchemaReplay) createKeyspace(p *tokenParser) error {
+	ifNotExists := p.accept("IF", "NOT", "EXISTS")
+	name, err := p.ident()
+	if err != nil {
+		return err
+	}
+	with, err := p.with()
+	if err != nil {
+		return err
+	}
+	ks := r.Schema.Keyspace(name)
+	if len(ks.Options) > 0 {
+		if ifNotExists {
+			return nil
+		}
+		return fmt.Errorf("Keyspace '%s' already exists", name)
+	}
+	ks.Options = with.options
+	return nil
+}
+
+func (r *SchemaReplay) alterKeyspace(p *tokenParser) error {
+	name, err := p.ident()
+	if err != nil {
+		return err
+	}
+	with, err := p.with()
+	if err != nil {
+		return err
+	}
+	ks := r.Schema.Keyspace(name)
+	for k, v := range with.options {
+		ks.Options[k] = v
+	}
+	return nil
+}
+
+func (r *SchemaReplay) dropKeyspace(p *tokenParser) error {
+	ifExists := p.accept("IF", "EXISTS")
+	name, err := p.ident()
+	if err != nil {
+		return err
+	}
+	if _, ok := r.Schema.Keyspaces[name]; !ok && !ifExists {
+		return fmt.Errorf("Keyspace '%s' does not exist", name)
+	}
+	delete(r.Schema.Keyspaces, name)
+	return nil
+}
+
+func (r *SchemaReplay) createTable(p *tokenParser) error {
+	ifNotExists := p.accept("IF", "NOT", "EXISTS")
+	ks, name, err := r.name(p)
+	if err != nil {
+		return err
+	}
+	table := &Table{Keyspace: ks.Name, Name: name}
+
+	if err := p.expectPunct("("); err != nil {
+		return err
+	}
+	var partition, clustering []string
+	for !p.acceptPunct(")") {
+		if p.done() {
+			return fmt.Errorf("Unterminated column list")
+		}
+		if p.accept("PRIMARY", "KEY") {
+			if err := p.expectPunct("("); err != nil {
+				return err
+			}
+			if partition, clustering, err = p.primaryKey(); err != nil {
+				return err
+			}
+		} else {
+			c, err := p.columnDefinition()
+			if err != nil {
+				return err
+			}
+			if p.accept("PRIMARY", "KEY") {
+				partition = []string{c.Name}
+			}
+			table.Columns = append(table.Columns, c)
+		}
+		if !p.acceptPunct(",") && !p.peekPunct(")") {
+			return fmt.Errorf("Expected ',' or ')' but found '%s'", p.next().text)
+		}
+	}
+	if len(partition) == 0 {
+		return fmt.Errorf("Table '%s' has no primary key", name)
+	}
+	if err := setKey(table.Column, partition, clustering); err != nil {
+		return err
+	}
+
+	with, err := p.with()
+	if err != nil {
+		return err
+	}
+	if err := with.applyClusteringOrder(table.Column); err != nil {
+		return err
+	}
+	table.Options = with.options
+	table.CompactStorage = with.compactStorage
+
+	if _, exists := ks.Tables[name]; exists {
+		if ifNotExists {
+			return nil
+		}
+		return fmt.Errorf("Table '%s' already exists", table.QualifiedName())
+	}
+	ks.Tables[name] = table
+	return nil
+}
+
+//
+// Mark up the partition key and clustering columns of a table or view. Clustering
+// columns are ascending unless the WITH clause says otherwise.
+//
+func setKey(column func(string) *Column, partition, clustering []string) error {
+	for i, name := range partition {
+		c := column(name)
+		if c == nil {
+			return fmt.Errorf("Unknown column '%s' in primary key", name)
+		}
+		c.Kind, c.Position = PartitionKeyColumn, i
+	}
+	for i, name := range clustering {
+		c := column(name)
+		if c == nil {
+			return fmt.Errorf("Unknown column '%s' in primary key", name)
+		}
+		c.Kind, c.Position, c.Order = ClusteringColumn, i, "ASC"
+	}
+	return nil
+}
+
+func (r *SchemaReplay) alterTable(p *tokenParser) error {
+	ifExists := p.accept("IF", "EXISTS")
+	ks, name, err := r.name(p)
+	if err != nil {
+		return err
+	}
+	table, ok := ks.Tables[name]
+	if !ok {
+		if ifExists {
+			return nil
+		}
+		return fmt.Errorf("Table '%s' does not exist", qualifiedName(ks.Name, name))
+	}
+
+	switch {
+	case p.accept("ADD"):
+		ifNotExists := p.accept("IF", "NOT", "EXISTS")
+		parens := p.acceptPunct("(")
+		for {
+			c, err := p.columnDefinition()
+			if err != nil {
+				return err
+			}
+			if table.Column(c.Name) != nil {
+				if !ifNotExists {
+					return fmt.Errorf("Column '%s' already exists in '%s'", c.Name, table.QualifiedName())
+				}
+			} else {
+				table.Columns = append(table.Columns, c)
+			}
+			if !p.acceptPunct(",") {
+				break
+			}
+		}
+		if parens {
+			return p.expectPunct(")")
+		}
+
+	case p.accept("DROP", "COMPACT", "STORAGE"):
+		table.CompactStorage = false
+
+	case p.accept("DROP"):
+		ifExists := p.accept("IF", "EXISTS")
+		for _, col := range p.identList() {
+			c := table.Column(col)
+			if c == nil {
+				if ifExists {
+					continue
+				}
+				return fmt.Errorf("Column '%s' does not exist in '%s'", col, table.QualifiedName())
+			}
+			if c.Kind == PartitionKeyColumn || c.Kind == ClusteringColumn {
+				return fmt.Errorf("Cannot drop primary key column '%s'", col)
+			}
+			table.Columns = removeColumn(table.Columns, col)
+			for ixName, ix := range ks.Indexes {
+				if ix.Table == table.Name && ix.Column() == col {
+					delete(ks.Indexes, ixName)
+				}
+			}
+		}
+
+	case p.accept("ALTER"):
+		col, err := p.ident()
+		if err != nil {
+			return err
+		}
+		c := table.Column(col)
+		if c == nil {
+			return fmt.Errorf("Column '%s' does not exist in '%s'", col, table.QualifiedName())
+		}
+		if err := p.expect("TYPE"); err != nil {
+			return err
+		}
+		if c.Type, err = p.dataType(); err != nil {
+			return err
+		}
+
+	case p.accept("RENAME"):
+		ifExists := p.accept("IF", "EXISTS")
+		return p.renames(func(from, to string) error {
+			c := table.Column(from)
+			if c == nil {
+				if ifExists {
+					return nil
+				}
+				return fmt.Errorf("Column '%s' does not exist in '%s'", from, table.QualifiedName())
+			}
+			if table.Column(to) != nil {
+				return fmt.Errorf("Column '%s' already exists in '%s'", to, table.QualifiedName())
+			}
+			c.Name = to
+			for _, ix := range ks.Indexes {
+				if ix.Table == table.Name && ix.Column() == from {
+					ix.Target = strings.Replace(ix.Target, quoteIdent(from), quoteIdent(to), 1)
+				}
+			}
+			return nil
+		})
+
+	case p.peek("WITH"):
+		with, err := p.with()
+		if err != nil {
+			return err
+		}
+		if table.Options == nil {
+			table.Options = map[string]string{}
+		}
+		for k, v := range with.options {
+			table.Options[k] = v
+		}
+
+	default:
+		return fmt.Errorf("Unsupported ALTER TABLE '%s'", p.next().text)
+	}
+	return nil
+}
+
+func removeColumn(columns []*Column, name string) (kept []*Column) {
+	for _, c := range columns {
+		if c.Name != name {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+func (r *SchemaReplay) dropTable(p *tokenParser) error {
+	ifExists := p.accept("IF", "EXISTS")
+	ks, name, err := r.name(p)
+	if err != nil {
+		return err
+	}
+	if _, ok := ks.Tables[name]; !ok {
+		if ifExists {
+			return nil
+		}
+		return fmt.Errorf("Table '%s' does not exist", qualifiedName(ks.Name, name))
+	}
+	delete(ks.Tables, name)
+	for ixName, ix := range ks.Indexes {
+		if ix.Table == name {
+			delete(ks.Indexes, ixName)
+		}
+	}
+	for viewName, v := range ks.Views {
+		if v.BaseTable == name {
+			delete(ks.Views, viewName)
+		}
+	}
+	return nil
+}
+
+func (r *SchemaReplay) createIndex(p *tokenParser, custom bool) error {
+	ifNotExists := p.accept("IF", "NOT", "EXISTS")
+	name := ""
+	if !p.peek("ON") {
+		var err error
+		if name, err = p.ident(); err != nil {
+			return err
+		}
+	}
+	if err := p.expect("ON"); err != nil {
+		return err
+	}
+	ks, table, err := r.table(p)
+	if err != nil {
+		return err
+	}
+
+	if err := p.expectPunct("("); err != nil {
+		return err
+	}
+	col, err := p.ident()
+	if err != nil {
+		return err
+	}
+	target := quoteIdent(col)
+	if p.acceptPunct("(") {
+		fn := strings.ToLower(col)
+		if col, err = p.ident(); err != nil {
+			return err
+		}
+		if err := p.expectPunct(")"); err != nil {
+			return err
+		}
+		target = fn + "(" + quoteIdent(col) + ")"
+	}
+	if err := p.expectPunct(")"); err != nil {
+		return err
+	}
+	if table.Column(col) == nil {
+		return fmt.Errorf("Column '%s' does not exist in '%s'", col, table.QualifiedName())
+	}
+
+	ix := &Index{Keyspace: ks.Name, Name: name, Table: table.Name, Target: target}
+	if ix.Name == "" {
+		ix.Name = table.Name + "_" + col + "_idx"
+	}
+	if p.accept("USING") {
+		class := p.next()
+		if class.kind != stringToken {
+			return fmt.Errorf("Expected an index class after USING")
+		}
+		ix.Class = class.text
+	}
+	if custom && ix.Class == "" {
+		return fmt.Errorf("CUSTOM index '%s' has no USING class", ix.Name)
+	}
+	if p.accept("WITH", "OPTIONS") {
+		if err := p.expectPunct("="); err != nil {
+			return err
+		}
+		if ix.Options, err = p.stringMap(); err != nil {
+			return err
+		}
+	}
+
+	if _, exists := ks.Indexes[ix.Name]; exists {
+		if ifNotExists {
+			return nil
+		}
+		return fmt.Errorf("Index '%s' already exists", ix.Name)
+	}
+	ks.Indexes[ix.Name] = ix
+	return nil
+}
+
+func (r *SchemaReplay) dropIndex(p *tokenParser) error {
+	ifExists := p.accept("IF", "EXISTS")
+	ks, name, err := r.name(p)
+	if err != nil {
+		return err
+	}
+	if _, ok := ks.Indexes[name]; !ok && !ifExists {
+		return fmt.Errorf("Index '%s' does not exist", qualifiedName(ks.Name, name))
+	}
+	delete(ks.Indexes, name)
+	return nil
+}
+
+func (r *SchemaReplay) createType(p *tokenParser) error {
+	ifNotExists := p.accept("IF", "NOT", "EXISTS")
+	ks, name, err := r.name(p)
+	if err != nil {
+		return err
+	}
+	t := &UserType{Keyspace: ks.Name, Name: name}
+
+	if err := p.expectPunct("("); err != nil {
+		return err
+	}
+	for !p.acceptPunct(")") {
+		if p.done() {
+			return fmt.Errorf("Unterminated field list")
+		}
+		f := &Field{}
+		if f.Name, err = p.ident(); err != nil {
+			return err
+		}
+		if f.Type, err = p.dataType(); err != nil {
+			return err
+		}
+		t.Fields = append(t.Fields, f)
+		p.acceptPunct(",")
+	}
+
+	if _, exists := ks.Types[name]; exists {
+		if ifNotExists {
+			return nil
+		}
+		return fmt.Errorf("Type '%s' already exists", t.QualifiedName())
+	}
+	ks.Types[name] = t
+	return nil
+}
+
+func (r *SchemaReplay) alterType(p *tokenParser) error {
+	ks, name, err := r.name(p)
+	if err != nil {
+		return err
+	}
+	t, ok := ks.Types[name]
+	if !ok {
+		return fmt.Errorf("Type '%s' does not exist", qualifiedName(ks.Name, name))
+	}
+
+	switch {
+	case p.accept("ADD"):
+		f := &Field{}
+		if f.Name, err = p.ident(); err != nil {
+			return err
+		}
+		if t.Field(f.Name) != nil {
+			return fmt.Errorf("Field '%s' already exists in '%s'", f.Name, t.QualifiedName())
+		}
+		if f.Type, err = p.dataType(); err != nil {
+			return err
+		}
+		t.Fields = append(t.Fields, f)
+
+	case p.accept("ALTER"):
+		fieldName, err := p.ident()
+		if err != nil {
+			return err
+		}
+		f := t.Field(fieldName)
+		if f == nil {
+			return fmt.Errorf("Field '%s' does not exist in '%s'", fieldName, t.QualifiedName())
+		}
+		if err := p.expect("TYPE"); err != nil {
+			return err
+		}
+		if f.Type, err = p.dataType(); err != nil {
+			return err
+		}
+
+	case p.accept("RENAME"):
+		return p.renames(func(from, to string) error {
+			f := t.Field(from)
+			if f == nil {
+				return fmt.Errorf("Field '%s' does not exist in '%s'", from, t.QualifiedName())
+			}
+			f.Name = to
+			return nil
+		})
+
+	default:
+		return fmt.Errorf("Unsupported ALTER TYPE '%s'", p.next().text)
+	}
+	return nil
+}
+
+func (r *SchemaReplay) dropType(p *tokenParser) error {
+	ifExists := p.accept("IF", "EXISTS")
+	ks, name, err := r.name(p)
+	if err != nil {
+		return err
+	}
+	if _, ok := ks.Types[name]; !ok && !ifExists {
+		return fmt.Errorf("Type '%s' does not exist", qualifiedName(ks.Name, name))
+	}
+	delete(ks.Types, name)
+	return nil
+}
+
+func (r *SchemaReplay) createView(p *tokenParser) error {
+	ifNotExists := p.accept("IF", "NOT", "EXISTS")
+	ks, name, err := r.name(p)
+	if err != nil {
+		return err
+	}
+	v := &View{Keyspace: ks.Name, Name: name}
+
+	if err := p.expect("AS", "SELECT"); err != nil {
+		return err
+	}
+	var selected []string
+	if p.acceptPunct("*") {
+		v.IncludeAll = true
+	} else {
+		for {
+			col, err := p.ident()
+			if err != nil {
+				return err
+			}
+			selected = append(selected, col)
+			if !p.acceptPunct(",") {
+				break
+			}
+		}
+	}
+	if err := p.expect("FROM"); err != nil {
+		return err
+	}
+	_, base, err := r.table(p)
+	if err != nil {
+		return err
+	}
+	v.BaseTable = base.Name
+	if v.IncludeAll {
+		for _, c := range base.Columns {
+			selected = append(selected, c.Name)
+		}
+	}
+
+	if err := p.expect("WHERE"); err != nil {
+		return err
+	}
+	start := p.pos
+	for !p.done() && !p.peek("PRIMARY", "KEY") {
+		p.next()
+	}
+	v.Where = joinTokens(p.toks[start:p.pos])
+	if err := p.expect("PRIMARY", "KEY"); err != nil {
+		return err
+	}
+	if err := p.expectPunct("("); err != nil {
+		return err
+	}
+	partition, clustering, err := p.primaryKey()
+	if err != nil {
+		return err
+	}
+
+	for _, col := range selected {
+		c := base.Column(col)
+		if c == nil {
+			return fmt.Errorf("Column '%s' does not exist in '%s'", col, base.QualifiedName())
+		}
+		v.Columns = append(v.Columns, &Column{Name: c.Name, Type: c.Type, Kind: RegularColumn})
+	}
+	view := &Table{Columns: v.Columns}
+	if err := setKey(view.Column, partition, clustering); err != nil {
+		return err
+	}
+
+	with, err := p.with()
+	if err != nil {
+		return err
+	}
+	if err := with.applyClusteringOrder(view.Column); err != nil {
+		return err
+	}
+	v.Options = with.options
+
+	if _, exists := ks.Views[name]; exists {
+		if ifNotExists {
+			return nil
+		}
+		return fmt.Errorf("Materialized view '%s' already exists", v.QualifiedName())
+	}
+	ks.Views[name] = v
+	return nil
+}
+
+func (r *SchemaReplay) alterView(p *tokenParser) error {
+	ks, name, err := r.name(p)
+	if err != nil {
+		return err
+	}
+	v, ok := ks.Views[name]
+	if !ok {
+		return fmt.Errorf("Materialized view '%s' does not exist", qualifiedName(ks.Name, name))
+	}
+	with, err := p.with()
+	if err != nil {
+		return err
+	}
+	if v.Options == nil {
+		v.Options = map[string]string{}
+	}
+	for k, val := range with.options {
+		v.Options[k] = val
+	}
+	return nil
+}
+
+func (r *SchemaReplay) dropView(p *tokenParser) error {
+	ifExists := p.accept("IF", "EXISTS")
+	ks, name, err := r.name(p)
+	if err != nil {
+		return err
+	}
+	if _, ok := ks.Views[name]; !ok && !ifExists {
+		return fmt.Errorf("Materialized view '%s' does not exist", qualifiedName(ks.Name, name))
+	}
+	delete(ks.Views, name)
+	return nil
+}
+
+//
+// Functions and aggregates are kept more or less as written: we only need to know
+// what they are called and how to create them again.
+//
+func (r *SchemaReplay) createFunction(p *tokenParser, orReplace, aggregate bool) error {
+	ifNotExists := p.accept("IF", "NOT", "EXISTS")
+	ks, name, err := r.name(p)
+	if err != nil {
+		return err
+	}
+	f := &Function{Keyspace: ks.Name, Name: name, Aggregate: aggregate}
+
+	if err := p.expectPunct("("); err != nil {
+		return err
+	}
+	var args []string
+	for !p.acceptPunct(")") {
+		if p.done() {
+			return fmt.Errorf("Unterminated argument list")
+		}
+		arg := ""
+		if !aggregate {
+			argName, err := p.ident()
+			if err != nil {
+				return err
+			}
+			arg = quoteIdent(argName) + " "
+		}
+		argType, err := p.dataType()
+		if err != nil {
+			return err
+		}
+		f.Arguments = append(f.Arguments, argType)
+		args = append(args, arg+argType)
+		p.acceptPunct(",")
+	}
+	f.Body = "(" + strings.Join(args, ", ") + ") " + joinTokens(p.toks[p.pos:])
+
+	if _, exists := ks.Functions[f.Signature()]; exists && !orReplace {
+		if ifNotExists {
+			return nil
+		}
+		return fmt.Errorf("'%s' already exists", qualifiedName(ks.Name, f.Signature()))
+	}
+	ks.Functions[f.Signature()] = f
+	return nil
+}
+
+func (r *SchemaReplay) dropFunction(p *tokenParser, aggregate bool) error {
+	ifExists := p.accept("IF", "EXISTS")
+	ks, name, err := r.name(p)
+	if err != nil {
+		return err
+	}
+
+	// Without argument types every overload goes.
+	var signature string
+	if p.acceptPunct("(") {
+		var types []string
+		for !p.acceptPunct(")") {
+			if p.done() {
+				return fmt.Errorf("Unterminated argument list")
+			}
+			t, err := p.dataType()
+			if err != nil {
+				return err
+			}
+			types = append(types, t)
+			p.acceptPunct(",")
+		}
+		signature = (&Function{Name: name, Arguments: types}).Signature()
+	}
+
+	dropped := false
+	for sig, f := range ks.Functions {
+		if f.Name == name && f.Aggregate == aggregate && (signature == "" || sig == signature) {
+			delete(ks.Functions, sig)
+			dropped = true
+		}
+	}
+	if !dropped && !ifExists {
+		return fmt.Errorf("'%s' does not exist", qualifiedName(ks.Name, name))
+	}
+	return nil
+}
+
+//
+// The contents of a WITH clause.
+//
+type withClause struct {
+	options        map[string]string
+	orders         map[string]string
+	compactStorage bool
+}
+
+func (w *withClause) applyClusteringOrder(column func(string) *Column) error {
+	for name, order := range w.orders {
+		c := column(name)
+		if c == nil || c.Kind != ClusteringColumn {
+			return fmt.Errorf("'%s' in CLUSTERING ORDER is not a clustering column", name)
+		}
+		c.Order = order
+	}
+	return nil
+}
+
+//
+// Read an (optional) WITH clause: 'name = value' options, CLUSTERING ORDER BY and
+// COMPACT STORAGE, separated by AND.
+//
+func (p *tokenParser) with() (*withClause, error) {
+	w := &withClause{options: map[string]string{}, orders: map[string]string{}}
+	if !p.accept("WITH") {
+		return w, nil
+	}
+	for {
+		switch {
+		case p.accept("CLUSTERING", "ORDER", "BY"):
+			if err := p.expectPunct("("); err != nil {
+				return nil, err
+			}
+			for !p.acceptPunct(")") {
+				name, err := p.ident()
+				if err != nil {
+					return nil, err
+				}
+				w.orders[name] = "ASC"
+				if p.accept("DESC") {
+					w.orders[name] = "DESC"
+				} else {
+					p.accept("ASC")
+				}
+				p.acceptPunct(",")
+			}
+		case p.accept("COMPACT", "STORAGE"):
+			w.compactStorage = true
+		default:
+			name, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectPunct("="); err != nil {
+				return nil, err
+			}
+			value, err := p.literal()
+			if err != nil {
+				return nil, err
+			}
+			w.options[strings.ToLower(name)] = value
+		}
+		if !p.accept("AND") {
+			break
+		}
+	}
+	if !p.done() {
+		return nil, fmt.Errorf("Unexpected '%s' in WITH clause", p.next().text)
+	}
+	return w, nil
+}
+
+//
+// Read the inside of a PRIMARY KEY ( ... ), the opening bracket already gone.
+//
+func (p *tokenParser) primaryKey() (partition, clustering []string, err error) {
+	if p.acceptPunct("(") {
+		for !p.acceptPunct(")") {
+			name, err := p.ident()
+			if err != nil {
+				return nil, nil, err
+			}
+			partition = append(partition, name)
+			p.acceptPunct(",")
+		}
+	} else {
+		name, err := p.ident()
+		if err != nil {
+			return nil, nil, err
+		}
+		partition = append(partition, name)
+	}
+	for p.acceptPunct(",") {
+		name, err := p.ident()
+		if err != nil {
+			return nil, nil, err
+		}
+		clustering = append(clustering, name)
+	}
+	return partition, clustering, p.expectPunct(")")
+}
+
+//
+// Read 'name type [STATIC]'.
+//
+func (p *tokenParser) columnDefinition() (*Column, error) {
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	colType, err := p.dataType()
+	if err != nil {
+		return nil, err
+	}
+	c := &Column{Name: name, Type: colType, Kind: RegularColumn}
+	if p.accept("STATIC") {
+		c.Kind = StaticColumn
+	}
+	return c, nil
+}
+
+//
+// Read 'a TO b [AND c TO d ...]' calling 'rename' for each pair.
+//
+func (p *tokenParser) renames(rename func(from, to string) error) error {
+	for {
+		from, err := p.ident()
+		if err != nil {
+			return err
+		}
+		if err := p.expect("TO"); err != nil {
+			return err
+		}
+		to, err := p.ident()
+		if err != nil {
+			return err
+		}
+		if err := rename(from, to); err != nil {
+			return err
+		}
+		if !p.accept("AND") {
+			return nil
+		}
+	}
+}
+
+func (p *tokenParser) expect(words ...string) error {
+	if !p.accept(words...) {
+		return fmt.Errorf("Expected '%s' but found '%s'", strings.Join(words, " "), p.next().text)
+	}
+	return nil
+}
+
+func (p *tokenParser) peekPunct(punct string) bool {
+	return !p.done() && p.toks[p.pos].kind == punctToken && p.toks[p.pos].text == punct
+}
+
+func (p *tokenParser) expectPunct(punct string) error {
+	if !p.acceptPunct(punct) {
+		return fmt.Errorf("Expected '%s' but found '%s'", punct, p.next().text)
+	}
+	return nil
+}
+
+func (p *tokenParser) ident() (string, error) {
+	t := p.next()
+	if t.kind != identToken && t.kind != quotedIdentToken {
+		return "", fmt.Errorf("Expected a name but found '%s'", t.text)
+	}
+	return t.name(), nil
+}
+
+//
+// Read a data type, e.g. 'int', 'frozen<map<text, address>>' or 'ks.address',
+// returning it in canonical form.
+//
+func (p *tokenParser) dataType() (string, error) {
+	var words []string
+	depth := 0
+	for !p.done() {
+		t := p.next()
+		switch {
+		case t.kind == punctToken && t.text == "<":
+			depth++
+		case t.kind == punctToken && t.text == ">":
+			depth--
+		case t.kind == punctToken && t.text == ".":
+			// Drop the keyspace from a qualified type; types can't cross keyspaces.
+			words = words[:len(words)-1]
+			continue
+		case t.kind == quotedIdentToken:
+			words = append(words, t.literal())
+			continue
+		}
+		words = append(words, t.text)
+		if depth == 0 && !p.peekPunct("<") && !p.peekPunct(".") {
+			break
+		}
+	}
+	if depth != 0 || len(words) == 0 {
+		return "", fmt.Errorf("Malformed type '%s'", strings.Join(words, " "))
+	}
+	t, err := ParseType(strings.Join(words, " "))
+	if err != nil {
+		return "", err
+	}
+	return t.String(), nil
+}
+
+//
+// Read a constant: a string, number, boolean or a map, set, list or tuple of them. It
+// comes back as CQL in a canonical form (map entries and set elements sorted) so that
+// equivalent values compare equal whichever way they were written.
+//
+func (p *tokenParser) literal() (string, error) {
+	t := p.next()
+	switch t.kind {
+	case stringToken:
+		return t.literal(), nil
+	case numberToken:
+		return t.text, nil
+	case identToken:
+		return strings.ToLower(t.text), nil
+	case punctToken:
+		closing := map[string]string{"{": "}", "[": "]", "(": ")"}[t.text]
+		if closing == "" {
+			break
+		}
+		var items []string
+		isMap := false
+		for !p.acceptPunct(closing) {
+			if p.done() {
+				return "", fmt.Errorf("Unterminated '%s'", t.text)
+			}
+			item, err := p.literal()
+			if err != nil {
+				return "", err
+			}
+			if p.acceptPunct(":") {
+				isMap = true
+				value, err := p.literal()
+				if err != nil {
+					return "", err
+				}
+				item += ": " + value
+			}
+			items = append(items, item)
+			p.acceptPunct(",")
+		}
+		if t.text == "{" {
+			sort.Strings(items)
+		}
+		if isMap && len(items) == 0 {
+			return "{}", nil
+		}
+		return t.text + strings.Join(items, ", ") + closing, nil
+	}
+	return "", fmt.Errorf("Expected a value but found '%s'", t.text)
+}
+
+//
+// Read a map literal of strings into a map.
+//
+func (p *tokenParser) stringMap() (map[string]string, error) {
+	if err := p.expectPunct("{"); err != nil {
+		return nil, err
+	}
+	m := map[string]string{}
+	for !p.acceptPunct("}") {
+		k, v := p.next(), token{}
+		if p.acceptPunct(":") {
+			v = p.next()
+		}
+		if k.kind != stringToken || v.kind != stringToken {
+			return nil, fmt.Errorf("Expected a map of strings")
+		}
+		m[k.text] = v.text
+		p.acceptPunct(",")
+	}
+	return m, nil
+}
+
+//
+// Put tokens back together as CQL with a little care over where the spaces go.
+//
+func joinTokens(toks []token) string {
+	var b strings.Builder
+	for i, t := range toks {
+		if i > 0 {
+			prev := toks[i-1]
+			tight := t.kind == punctToken && strings.Contains(".,)", t.text) ||
+				prev.kind == punctToken && strings.Contains("(.", prev.text) ||
+				prev.kind == punctToken && strings.Contains("<>!", prev.text) && t.text == "="
+			if !tight {
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteString(t.literal())
+	}
+	return b.String()
+}
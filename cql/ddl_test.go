@@ -0,0 +1,136 @@
+package cql
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DDL Replay", func() {
+
+	var r *SchemaReplay
+
+	apply := func(statements ...string) {
+		for _, st := range statements {
+			Expect(r.Apply(st)).To(Succeed(), st)
+		}
+	}
+
+	BeforeEach(func() {
+		r = NewSchemaReplay("mystack")
+	})
+
+	It("should build tables with their keys and options", func() {
+		apply(`CREATE TABLE events (
+		           user uuid, bucket int, at timestamp, "Owner" text static, payload frozen < map<text,int> >,
+		           PRIMARY KEY ((user, bucket), at)
+		       ) WITH CLUSTERING ORDER BY (at DESC) AND comment = 'Events' AND compaction = {'min_threshold': '4', 'class': 'LeveledCompactionStrategy'}`)
+
+		t := r.Schema.Keyspaces["mystack"].Tables["events"]
+		Expect(t).NotTo(BeNil())
+		Expect(quoteIdents(t.PrimaryKey())).To(Equal("user, bucket, at"))
+		Expect(t.Column("at").Order).To(Equal("DESC"))
+		Expect(t.Column("Owner").Kind).To(Equal(StaticColumn))
+		Expect(t.Column("payload").Type).To(Equal("frozen<map<text, int>>"))
+		Expect(t.Options).To(Equal(map[string]string{
+			"comment":    "'Events'",
+			"compaction": "{'class': 'LeveledCompactionStrategy', 'min_threshold': '4'}",
+		}))
+	})
+
+	It("should follow alterations", func() {
+		apply(
+			"CREATE TABLE user (id uuid PRIMARY KEY, name text, email text, age int)",
+			"CREATE INDEX ON user (email)",
+			"ALTER TABLE user ADD teams map<uuid, text>",
+			"ALTER TABLE user DROP email",
+			"ALTER TABLE user RENAME id TO user_id",
+			"ALTER TABLE user ALTER age TYPE varint",
+			"ALTER TABLE user WITH gc_grace_seconds = 3600",
+		)
+		ks := r.Schema.Keyspaces["mystack"]
+		t := ks.Tables["user"]
+		Expect(t.Column("email")).To(BeNil())
+		Expect(t.Column("teams").Type).To(Equal("map<uuid, text>"))
+		Expect(t.Column("user_id").Kind).To(Equal(PartitionKeyColumn))
+		Expect(t.Column("age").Type).To(Equal("varint"))
+		Expect(t.Options["gc_grace_seconds"]).To(Equal("3600"))
+		Expect(ks.Indexes).To(BeEmpty())
+
+		apply("CREATE TABLE legacy (id int PRIMARY KEY, v text) WITH COMPACT STORAGE", "ALTER TABLE legacy DROP COMPACT STORAGE")
+		Expect(ks.Tables["legacy"].CompactStorage).To(BeFalse())
+		Expect(ks.Tables["legacy"].Column("v")).NotTo(BeNil())
+	})
+
+	It("should keep track of types, indexes, views and functions", func() {
+		apply(
+			"CREATE TYPE address (street text, city text)",
+			"ALTER TYPE address ADD postcode text",
+			"CREATE TABLE user (id uuid PRIMARY KEY, email text, home frozen<address>, tags map<text, text>)",
+			"CREATE INDEX user_tags ON mystack.user (KEYS(tags))",
+			"CREATE MATERIALIZED VIEW user_by_email AS SELECT id, email FROM user WHERE email IS NOT NULL AND id IS NOT NULL PRIMARY KEY (email, id)",
+			"CREATE FUNCTION twice (x int) RETURNS NULL ON NULL INPUT RETURNS int LANGUAGE java AS $$ return x * 2; $$",
+		)
+		ks := r.Schema.Keyspaces["mystack"]
+		Expect(len(ks.Types["address"].Fields)).To(Equal(3))
+		Expect(ks.Indexes["user_tags"].Target).To(Equal("keys(tags)"))
+		Expect(ks.Indexes["user_tags"].Column()).To(Equal("tags"))
+
+		v := ks.Views["user_by_email"]
+		Expect(v.Where).To(Equal("email IS NOT NULL AND id IS NOT NULL"))
+		Expect(v.CreateCQL()).To(Equal(`CREATE MATERIALIZED VIEW mystack.user_by_email AS
+    SELECT email, id FROM mystack.user
+    WHERE email IS NOT NULL AND id IS NOT NULL
+    PRIMARY KEY (email, id)
+    WITH CLUSTERING ORDER BY (id ASC)`))
+
+		Expect(ks.Functions).To(HaveKey("twice(int)"))
+
+		apply("DROP TABLE user", "DROP FUNCTION twice")
+		Expect(ks.Views).To(BeEmpty())
+		Expect(ks.Indexes).To(BeEmpty())
+		Expect(ks.Functions).To(BeEmpty())
+	})
+
+	It("should honour IF [NOT] EXISTS and complain without it", func() {
+		apply("CREATE TABLE IF NOT EXISTS t (id int PRIMARY KEY)", "CREATE TABLE IF NOT EXISTS t (other int PRIMARY KEY)")
+		Expect(r.Schema.Keyspaces["mystack"].Tables["t"].Column("id")).NotTo(BeNil())
+
+		Expect(r.Apply("CREATE TABLE t (id int PRIMARY KEY)")).To(MatchError(ContainSubstring("already exists")))
+		Expect(r.Apply("ALTER TABLE missing ADD x int")).To(MatchError(ContainSubstring("does not exist")))
+		Expect(r.Apply("ALTER TABLE t DROP id")).To(MatchError(ContainSubstring("primary key")))
+		Expect(r.Apply("DROP TABLE IF EXISTS missing")).To(Succeed())
+	})
+
+	It("should ignore statements that don't change the schema", func() {
+		apply("INSERT INTO t (id) VALUES (1)", "TRUNCATE t", "GRANT SELECT ON t TO someone")
+		Expect(r.Schema.Keyspaces["mystack"].Tables).To(BeEmpty())
+	})
+
+	It("should put things into other keyspaces when asked", func() {
+		apply(
+			"CREATE KEYSPACE IF NOT EXISTS reporting WITH replication = {'class': 'SimpleStrategy', 'replication_factor': 1} AND durable_writes = true",
+			"CREATE TABLE reporting.daily (day text PRIMARY KEY, total counter)",
+			"USE reporting",
+			"CREATE TABLE monthly (month text PRIMARY KEY, total counter)",
+		)
+		ks := r.Schema.Keyspaces["reporting"]
+		Expect(ks.Tables).To(HaveKey("daily"))
+		Expect(ks.Tables).To(HaveKey("monthly"))
+		Expect(ks.CreateCQL()).To(Equal(`CREATE KEYSPACE reporting WITH durable_writes = true
+    AND replication = {'class': 'SimpleStrategy', 'replication_factor': 1}`))
+	})
+
+	It("should write types out before the types that use them", func() {
+		apply(
+			"CREATE TYPE c_zip (code text)",
+			"CREATE TYPE a_inner (zip frozen<c_zip>)",
+			"CREATE TYPE b_outer (inner frozen<a_inner>)",
+		)
+
+		var names []string
+		for _, t := range r.Schema.Keyspaces["mystack"].sortedTypes() {
+			names = append(names, t.Name)
+		}
+		Expect(names).To(Equal([]string{"c_zip", "a_inner", "b_outer"}))
+	})
+})
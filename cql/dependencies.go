@@ -0,0 +1,201 @@
+package cql
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//
+// Does 'ref', from an '@depends-on' annotation, refer to the migration with this
+// version, name and environment? It can be the full key ('201501020600_create_team.all'),
+// the key less the environment, or just the version or the name if that's enough to
+// pick it out.
+//
+func refersTo(ref, version, name, env string) bool {
+	key := version + "_" + name
+	return ref == key+"."+env || ref == key || ref == name || (version != "" && ref == version)
+}
+
+//
+// Split a key into its version, name and environment. Versions never have an '_' in
+// them and environments never have a '.'.
+//
+func splitKey(key string) (version, name, env string) {
+	if i := strings.LastIndex(key, "."); i >= 0 {
+		key, env = key[:i], key[i+1:]
+	}
+	if i := strings.Index(key, "_"); i >= 0 {
+		return key[:i], key[i+1:], env
+	}
+	return "", key, env
+}
+
+//
+// Find the migration which 'ref' refers to. If a snapshot has replaced it, depending on
+// it means depending on the snapshot.
+//
+func (s Migrations) resolve(ref string) (*Migration, error) {
+	var found Migrations
+	add := func(m *Migration) {
+		if !found.Contains(m) {
+			found = append(found, m)
+		}
+	}
+	for _, m := range s {
+		if !refersTo(ref, m.Version, m.Name, m.Environment) {
+			continue
+		}
+		if snapshot := s.SupersededBy(m); snapshot != nil {
+			add(snapshot)
+		} else {
+			add(m)
+		}
+	}
+	for _, snapshot := range s {
+		for _, sup := range snapshot.Supersedes {
+			if version, name, env := splitKey(sup.Key); refersTo(ref, version, name, env) {
+				add(snapshot)
+			}
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("There is no migration '%s'", ref)
+	case 1:
+		return found[0], nil
+	}
+	var files []string
+	for _, m := range found {
+		files = append(files, m.File)
+	}
+	return nil, fmt.Errorf("'%s' could be any of %s; use the full name", ref, strings.Join(files, ", "))
+}
+
+//
+// The migrations 'm' depends on.
+//
+func (s Migrations) Dependencies(m *Migration) (deps Migrations, err error) {
+	for _, ref := range m.DependsOn {
+		dep, err := s.resolve(ref)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' depends on '%s': %s", m.File, ref, err.Error())
+		}
+		if !deps.Contains(dep) {
+			deps = append(deps, dep)
+		}
+	}
+	return deps, nil
+}
+
+//
+// Put 'updates' in the order they should be applied: each after the migrations it
+// depends on, and otherwise in the order Less gives them. Migrations which depend on
+// something that isn't there, or on each other, are errors.
+//
+func OrderMigrations(updates Migrations) (Migrations, error) {
+	sorted := make(Migrations, len(updates))
+	copy(sorted, updates)
+	sort.Sort(sorted)
+
+	deps := map[*Migration]Migrations{}
+	var errs Errors
+	for _, m := range sorted {
+		d, err := sorted.Dependencies(m)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		deps[m] = d
+	}
+	if errs != nil {
+		return nil, errs
+	}
+
+	// Take the first migration whose dependencies have all been taken, until there's
+	// none left.
+	ordered := make(Migrations, 0, len(sorted))
+	placed := map[*Migration]bool{}
+	for len(ordered) < len(sorted) {
+		var next *Migration
+		for _, m := range sorted {
+			if placed[m] {
+				continue
+			}
+			ready := true
+			for _, d := range deps[m] {
+				ready = ready && placed[d]
+			}
+			if ready {
+				next = m
+				break
+			}
+		}
+		if next == nil {
+			return nil, fmt.Errorf("Migrations depend on each other: %s", findCycle(sorted, deps, placed))
+		}
+		placed[next] = true
+		ordered = append(ordered, next)
+	}
+	return ordered, nil
+}
+
+//
+// Describe a cycle among the migrations which couldn't be placed, e.g. 'a -> b -> a'.
+//
+func findCycle(sorted Migrations, deps map[*Migration]Migrations, placed map[*Migration]bool) string {
+	var m *Migration
+	for _, m = range sorted {
+		if !placed[m] {
+			break
+		}
+	}
+
+	// Every unplaced migration has an unplaced dependency, so following them has to
+	// come back round.
+	var path Migrations
+	onPath := map[*Migration]int{}
+	for {
+		if at, ok := onPath[m]; ok {
+			var names []string
+			for _, c := range append(path[at:], m) {
+				names = append(names, c.Key())
+			}
+			return strings.Join(names, " -> ")
+		}
+		onPath[m] = len(path)
+		path = append(path, m)
+		for _, d := range deps[m] {
+			if !placed[d] {
+				m = d
+				break
+			}
+		}
+	}
+}
+
+//
+// Check each of the 'pending' migrations only depends on ones that have been 'applied'
+// or come before it in 'pending'. 'ignored' says why those which aren't going to be
+// run were left out.
+//
+func checkDependencies(updates, applied, pending Migrations, ignored map[*Migration]string) error {
+	done := map[*Migration]bool{}
+	for _, m := range pending {
+		deps, err := updates.Dependencies(m)
+		if err != nil {
+			return err
+		}
+		for _, d := range deps {
+			if done[d] || applied.Contains(d) || (d.Repeatable && applied.LastRun(d) != nil) {
+				continue
+			}
+			if why, ok := ignored[d]; ok {
+				return fmt.Errorf("'%s' depends on '%s', which hasn't been applied and won't be (%s)", m.File, d.File, why)
+			}
+			return fmt.Errorf("'%s' depends on '%s', which hasn't been applied", m.File, d.File)
+		}
+		done[m] = true
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package cql
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Migration Dependencies", func() {
+
+	migration := func(version, name, env string, dependsOn ...string) *Migration {
+		return &Migration{Version: version, Name: name, Environment: env, File: version + "_" + name + "." + env + ".cql", DependsOn: dependsOn}
+	}
+
+	keys := func(updates Migrations) (ks []string) {
+		for _, m := range updates {
+			ks = append(ks, m.Key())
+		}
+		return ks
+	}
+
+	It("Keeps version order when nothing depends on anything", func() {
+		ordered, err := OrderMigrations(Migrations{
+			migration("201501020600", "b", "all"),
+			migration("201501010600", "a", "all"),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keys(ordered)).To(Equal([]string{"201501010600_a.all", "201501020600_b.all"}))
+	})
+
+	It("Puts migrations after the ones they depend on", func() {
+		ordered, err := OrderMigrations(Migrations{
+			migration("201501010600", "seed_team", "uat1", "create_team"),
+			migration("201501010700", "other", "all"),
+			migration("201501020600", "create_team", "all"),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keys(ordered)).To(Equal([]string{"201501010700_other.all", "201501020600_create_team.all", "201501010600_seed_team.uat1"}))
+	})
+
+	It("Resolves references by key, version or name", func() {
+		updates := Migrations{migration("201501010600", "create_team", "all"), migration("201501020600", "create_team", "uat1")}
+		for _, ref := range []string{"201501010600_create_team.all", "201501010600_create_team", "201501010600"} {
+			m, err := updates.resolve(ref)
+			Expect(err).NotTo(HaveOccurred(), ref)
+			Expect(m).To(Equal(updates[0]))
+		}
+		_, err := updates.resolve("create_team")
+		Expect(err).To(MatchError(ContainSubstring("could be any of")))
+	})
+
+	It("Depends on the snapshot which replaced a migration", func() {
+		snapshot := &Migration{Version: "201501020600", Name: "squashed", Environment: "all", Snapshot: true,
+			Supersedes: []Superseded{{Key: "201501010600_create_team.all"}, {Key: "201501020600_add_name.all"}}}
+		seed := migration("201501030600", "seed", "uat1", "201501010600_create_team")
+		deps, err := Migrations{snapshot, seed}.Dependencies(seed)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(deps).To(Equal(Migrations{snapshot}))
+	})
+
+	It("Reports missing dependencies and cycles", func() {
+		_, err := OrderMigrations(Migrations{migration("201501010600", "a", "all", "nope")})
+		Expect(err).To(MatchError(ContainSubstring("There is no migration 'nope'")))
+
+		_, err = OrderMigrations(Migrations{
+			migration("201501010600", "a", "all", "c"),
+			migration("201501020600", "b", "all", "a"),
+			migration("201501030600", "c", "all", "b"),
+			migration("201501040600", "d", "all"),
+		})
+		Expect(err).To(MatchError("Migrations depend on each other: 201501010600_a.all -> 201501030600_c.all -> 201501020600_b.all -> 201501010600_a.all"))
+	})
+
+	It("Refuses to run a migration whose dependency is excluded", func() {
+		updates := Migrations{
+			migration("201501010600", "create_team", "uat2"),
+			migration("201501020600", "seed_team", "all", "create_team"),
+		}
+		_, _, err := PendingMigrations(nil, updates, "uat1", "")
+		Expect(err).To(MatchError(ContainSubstring("won't be (because environment is 'uat2')")))
+
+		pending, _, err := PendingMigrations(Migrations{updates[0]}, updates, "uat1", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keys(pending)).To(Equal([]string{"201501020600_seed_team.all"}))
+
+		pending, _, err = PendingMigrations(nil, updates, "uat2", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pending).To(HaveLen(2))
+	})
+})
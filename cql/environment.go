@@ -0,0 +1,137 @@
+package cql
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// The environment part of a file name is one or more environments or groups joined
+	// with '+', any of which can be negated with '!'. So 'uat1+uat2' runs in both,
+	// '!prod' everywhere but prod and 'nonprod+!uat2' in the nonprod group less uat2.
+	environmentSeparator = "+"
+	environmentNegation  = "!"
+
+	environmentPattern = "[A-Za-z0-9_+!-]+"
+)
+
+var environmentNameRe = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+//
+// Named sets of environments which migrations can target. Set from the config's
+// [groups] section.
+//
+var EnvironmentGroups = map[string][]string{}
+
+//
+// Split an environment expression into the names it includes and the ones it excludes.
+//
+func parseEnvironments(expr string) (include, exclude []string, err error) {
+	for _, term := range strings.Split(expr, environmentSeparator) {
+		negated := strings.HasPrefix(term, environmentNegation)
+		name := strings.TrimPrefix(term, environmentNegation)
+		if !environmentNameRe.MatchString(name) {
+			return nil, nil, fmt.Errorf("Bad environment '%s' in '%s'", term, expr)
+		}
+		if negated && name == "all" {
+			return nil, nil, fmt.Errorf("'%s' would never run ('!all')", expr)
+		}
+		if negated {
+			exclude = append(exclude, name)
+		} else {
+			include = append(include, name)
+		}
+	}
+	return include, exclude, nil
+}
+
+//
+// Does the environment expression 'expr' cover 'env'? A name matches the environment
+// itself, or any environment in the group of that name. With only exclusions, every
+// other environment is covered.
+//
+func EnvironmentMatches(expr, env string) bool {
+	include, exclude, err := parseEnvironments(expr)
+	if err != nil {
+		return false
+	}
+	matches := func(names []string) bool {
+		for _, name := range names {
+			if name == "all" || name == env {
+				return true
+			}
+			for _, member := range EnvironmentGroups[name] {
+				if member == env {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return (len(include) == 0 || matches(include)) && !matches(exclude)
+}
+
+//
+// Could migrations for environment expressions 'a' and 'b' both run in the same
+// environment? Tries every environment either mentions, directly or through a group,
+// and one neither does.
+//
+func environmentsOverlap(a, b string) bool {
+	candidates := []string{""}
+	for _, expr := range []string{a, b} {
+		include, exclude, _ := parseEnvironments(expr)
+		for _, name := range append(include, exclude...) {
+			candidates = append(candidates, name)
+			candidates = append(candidates, EnvironmentGroups[name]...)
+		}
+	}
+	for _, env := range candidates {
+		if EnvironmentMatches(a, env) && EnvironmentMatches(b, env) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Does environment expression 'outer' cover every environment 'inner' does? Tries the
+// same environments as environmentsOverlap.
+//
+func environmentIncludes(outer, inner string) bool {
+	candidates := []string{""}
+	for _, expr := range []string{outer, inner} {
+		include, exclude, _ := parseEnvironments(expr)
+		for _, name := range append(include, exclude...) {
+			candidates = append(candidates, name)
+			candidates = append(candidates, EnvironmentGroups[name]...)
+		}
+	}
+	for _, env := range candidates {
+		if EnvironmentMatches(inner, env) && !EnvironmentMatches(outer, env) {
+			return false
+		}
+	}
+	return true
+}
+
+//
+// Check a new migration's target environment expression only refers to environments
+// and groups which are in the config.
+//
+func (conf *MigrationConfig) CheckTargetEnvironment(expr string) error {
+	include, exclude, err := parseEnvironments(expr)
+	if err != nil {
+		return err
+	}
+	for _, name := range append(include, exclude...) {
+		if _, ok := conf.Environments[name]; ok || name == "all" {
+			continue
+		}
+		if _, ok := conf.Groups[name]; ok {
+			continue
+		}
+		return fmt.Errorf("'%s' is not an environment or group in the config", name)
+	}
+	return nil
+}
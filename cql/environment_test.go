@@ -0,0 +1,78 @@
+package cql
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Environment Expressions", func() {
+
+	var oldGroups map[string][]string
+
+	BeforeEach(func() {
+		oldGroups = EnvironmentGroups
+		EnvironmentGroups = map[string][]string{"nonprod": {"local", "uat1", "uat2"}}
+	})
+
+	AfterEach(func() {
+		EnvironmentGroups = oldGroups
+	})
+
+	It("Matches single environments and 'all'", func() {
+		Expect(EnvironmentMatches("all", "prod")).To(BeTrue())
+		Expect(EnvironmentMatches("uat1", "uat1")).To(BeTrue())
+		Expect(EnvironmentMatches("uat1", "uat2")).To(BeFalse())
+	})
+
+	It("Matches any of several environments", func() {
+		Expect(EnvironmentMatches("uat1+uat2", "uat2")).To(BeTrue())
+		Expect(EnvironmentMatches("uat1+uat2", "prod")).To(BeFalse())
+	})
+
+	It("Matches everything but negated environments", func() {
+		Expect(EnvironmentMatches("!prod", "uat1")).To(BeTrue())
+		Expect(EnvironmentMatches("!prod", "prod")).To(BeFalse())
+		Expect(EnvironmentMatches("!prod+!uat1", "uat1")).To(BeFalse())
+	})
+
+	It("Matches the members of groups", func() {
+		Expect(EnvironmentMatches("nonprod", "uat2")).To(BeTrue())
+		Expect(EnvironmentMatches("nonprod", "prod")).To(BeFalse())
+		Expect(EnvironmentMatches("nonprod+!uat2", "uat2")).To(BeFalse())
+		Expect(EnvironmentMatches("nonprod+!uat2", "local")).To(BeTrue())
+		Expect(EnvironmentMatches("!nonprod", "prod")).To(BeTrue())
+	})
+
+	It("Rejects malformed expressions", func() {
+		for _, expr := range []string{"", "uat1+", "!!prod", "!all", "uat 1"} {
+			_, _, err := parseEnvironments(expr)
+			Expect(err).To(HaveOccurred(), expr)
+			Expect(EnvironmentMatches(expr, "uat1")).To(BeFalse(), expr)
+		}
+	})
+
+	It("Knows when two expressions can both run somewhere", func() {
+		Expect(environmentsOverlap("uat1", "uat2")).To(BeFalse())
+		Expect(environmentsOverlap("uat1+uat2", "uat2")).To(BeTrue())
+		Expect(environmentsOverlap("!prod", "prod")).To(BeFalse())
+		Expect(environmentsOverlap("!prod", "staging")).To(BeTrue())
+		Expect(environmentsOverlap("!prod", "!uat1")).To(BeTrue())
+		Expect(environmentsOverlap("nonprod", "uat1")).To(BeTrue())
+		Expect(environmentsOverlap("nonprod", "prod")).To(BeFalse())
+	})
+
+	It("Knows when one expression covers another", func() {
+		Expect(environmentIncludes("all", "uat1+!prod")).To(BeTrue())
+		Expect(environmentIncludes("uat1+uat2", "uat1")).To(BeTrue())
+		Expect(environmentIncludes("uat1", "uat1+uat2")).To(BeFalse())
+		Expect(environmentIncludes("!prod", "uat1")).To(BeTrue())
+		Expect(environmentIncludes("uat1", "!prod")).To(BeFalse())
+	})
+
+	It("Reads the environments from file names", func() {
+		m, err := migrationFromContent("x", "201501010600_seed.uat1+!uat2.cql", []byte("SELECT * FROM t;"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m.Environment).To(Equal("uat1+!uat2"))
+		Expect(m.AppliesTo("uat1")).To(BeTrue())
+	})
+})
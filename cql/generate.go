@@ -0,0 +1,291 @@
+package cql
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//
+// A migration worked out from a declarative schema file: the statements that take the
+// schema the existing migrations build to the one the file describes.
+//
+type Generated struct {
+	Statements []string
+
+	// Changes Cassandra can't make to what's already there, like a table's primary key,
+	// which need doing by hand (usually a new table and a backfill).
+	Unsupported []string
+
+	CQL []byte
+}
+
+//
+// Work out the migration that brings the schema built by 'updates' (as applied in 'env')
+// up to date with the schema file at 'path'. Both are replayed without a keyspace, so
+// anything which doesn't name one stays that way in the statements, just as it would be
+// written by hand. Anything the migrations have which the file doesn't is dropped, except
+// keyspaces, which are left alone.
+//
+func PlanGenerate(updates Migrations, path, env string) (*Generated, error) {
+	ordered, err := OrderMigrations(updates)
+	if err != nil {
+		return nil, err
+	}
+
+	r := NewSchemaReplay("")
+	for _, m := range ordered {
+		if !m.AppliesTo(env) || updates.SupersededBy(m) != nil {
+			continue
+		}
+		if err := r.ApplyMigration(m); err != nil {
+			return nil, err
+		}
+	}
+	desired, err := ReadSchemaFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Generated{}
+	g.plan(r.Schema, desired)
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "-- @description Generated from '%s'\n", filepath.Base(path))
+	for _, st := range g.Statements {
+		fmt.Fprintf(buf, "\n%s;\n", st)
+	}
+	if len(g.Unsupported) > 0 {
+		fmt.Fprintf(buf, "\n-- Cassandra can't make these changes in place, so they're left to do by hand:\n")
+		for _, u := range g.Unsupported {
+			fmt.Fprintf(buf, "--   %s\n", u)
+		}
+	}
+	g.CQL = buf.Bytes()
+	return g, nil
+}
+
+//
+// Replay a schema file, without a default keyspace.
+//
+func ReadSchemaFile(path string) (*Schema, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	statements, err := ReadCQLFile(f)
+	if err != nil {
+		return nil, err
+	}
+	r := NewSchemaReplay("")
+	for _, text := range nonEmpty(statements) {
+		if st := ClassifyStatement(text); st.Kind != DDLStatement {
+			return nil, fmt.Errorf("'%s' should only describe the schema: '%s'", path, st.Summary())
+		}
+		if err := r.Apply(text); err != nil {
+			return nil, fmt.Errorf("%s: %s: %s", path, ClassifyStatement(text).Summary(), err.Error())
+		}
+	}
+	return r.Schema, nil
+}
+
+func (g *Generated) add(format string, args ...interface{}) {
+	g.Statements = append(g.Statements, fmt.Sprintf(format, args...))
+}
+
+func (g *Generated) unsupported(format string, args ...interface{}) {
+	g.Unsupported = append(g.Unsupported, fmt.Sprintf(format, args...))
+}
+
+//
+// The statements to turn 'current' into 'desired', in an order they can be run in:
+// keyspaces and types before the tables which use them, and indexes and views dropped
+// before the columns and tables they're on and created after.
+//
+func (g *Generated) plan(current, desired *Schema) {
+	for _, name := range unionKeys(current.Keyspaces, desired.Keyspaces) {
+		ks, cur := desired.Keyspaces[name], current.Keyspaces[name]
+		switch {
+		case ks == nil && name != "":
+			g.unsupported("keyspace %s isn't in the schema, but keyspaces are never dropped for you", quoteIdent(name))
+			continue
+		case ks == nil:
+			ks = NewKeyspace(name)
+		case cur == nil:
+			cur = NewKeyspace(name)
+		}
+		g.keyspace(cur, ks)
+	}
+}
+
+func (g *Generated) keyspace(current, desired *Keyspace) {
+	if desired.Name != "" && len(desired.Options) > 0 {
+		if len(current.Options) == 0 {
+			g.add("%s", desired.CreateCQL())
+		} else if changed := changedOptions(current.Options, desired.Options); len(changed) > 0 {
+			g.add("ALTER KEYSPACE %s WITH %s", quoteIdent(desired.Name), strings.Join(optionsCQL(changed), "\n    AND "))
+		}
+	}
+
+	for _, t := range desired.sortedTypes() {
+		if cur := current.Types[t.Name]; cur == nil {
+			g.add("%s", t.CreateCQL())
+		} else {
+			g.alterType(cur, t)
+		}
+	}
+
+	// Aggregates are made from functions, so are dropped before them and created after.
+	for _, aggregates := range []bool{true, false} {
+		for _, sig := range sortedKeys(current.Functions) {
+			if f := current.Functions[sig]; f.Aggregate == aggregates && desired.Functions[sig] == nil {
+				g.add("DROP %s %s", functionKind(f), qualifiedName(f.Keyspace, f.Name)+"("+strings.Join(f.Arguments, ", ")+")")
+			}
+		}
+	}
+	for _, aggregates := range []bool{false, true} {
+		for _, sig := range sortedKeys(desired.Functions) {
+			f := desired.Functions[sig]
+			if cur := current.Functions[sig]; f.Aggregate == aggregates && (cur == nil || cur.Body != f.Body) {
+				g.add("CREATE OR REPLACE %s %s%s", functionKind(f), qualifiedName(f.Keyspace, f.Name), f.Body)
+			}
+		}
+	}
+
+	// Views and indexes can't be altered, so any that change are dropped and created
+	// again once their tables are right.
+	var views, indexes []string
+	for _, name := range sortedKeys(current.Views) {
+		v, cur := desired.Views[name], current.Views[name]
+		if v == nil || v.CreateCQL() != cur.CreateCQL() {
+			g.add("DROP MATERIALIZED VIEW %s", cur.QualifiedName())
+		}
+	}
+	for _, name := range sortedKeys(desired.Views) {
+		if v, cur := desired.Views[name], current.Views[name]; cur == nil || v.CreateCQL() != cur.CreateCQL() {
+			views = append(views, name)
+		}
+	}
+	for _, name := range sortedKeys(current.Indexes) {
+		ix, cur := desired.Indexes[name], current.Indexes[name]
+		if ix == nil || ix.CreateCQL() != cur.CreateCQL() {
+			g.add("DROP INDEX %s", qualifiedName(cur.Keyspace, cur.Name))
+		}
+	}
+	for _, name := range sortedKeys(desired.Indexes) {
+		if ix, cur := desired.Indexes[name], current.Indexes[name]; cur == nil || ix.CreateCQL() != cur.CreateCQL() {
+			indexes = append(indexes, name)
+		}
+	}
+
+	for _, name := range sortedKeys(desired.Tables) {
+		if isHistoryTable(name) {
+			continue
+		}
+		if cur := current.Tables[name]; cur == nil {
+			g.add("%s", desired.Tables[name].CreateCQL())
+		} else {
+			g.alterTable(cur, desired.Tables[name])
+		}
+	}
+	for _, name := range sortedKeys(current.Tables) {
+		if _, ok := desired.Tables[name]; !ok && !isHistoryTable(name) {
+			g.add("DROP TABLE %s", current.Tables[name].QualifiedName())
+		}
+	}
+	for _, name := range indexes {
+		g.add("%s", desired.Indexes[name].CreateCQL())
+	}
+	for _, name := range views {
+		g.add("%s", desired.Views[name].CreateCQL())
+	}
+
+	// Types go last, once nothing uses them.
+	types := current.sortedTypes()
+	for i := len(types) - 1; i >= 0; i-- {
+		if _, ok := desired.Types[types[i].Name]; !ok {
+			g.add("DROP TYPE %s", types[i].QualifiedName())
+		}
+	}
+}
+
+func (g *Generated) alterType(current, desired *UserType) {
+	name := desired.QualifiedName()
+	for _, f := range desired.Fields {
+		cur := current.Field(f.Name)
+		switch {
+		case cur == nil:
+			g.add("ALTER TYPE %s ADD %s %s", name, quoteIdent(f.Name), f.Type)
+		case normalizeType(cur.Type) != normalizeType(f.Type):
+			g.unsupported("type %s: field %s would change from %s to %s", name, quoteIdent(f.Name), cur.Type, f.Type)
+		}
+	}
+	for _, f := range current.Fields {
+		if desired.Field(f.Name) == nil {
+			g.unsupported("type %s: field %s would be removed, but fields can't be dropped", name, quoteIdent(f.Name))
+		}
+	}
+}
+
+func (g *Generated) alterTable(current, desired *Table) {
+	name := desired.QualifiedName()
+	if cur, want := primaryKeyText(current.Columns), primaryKeyText(desired.Columns); cur != want {
+		g.unsupported("table %s: primary key would change from %s to %s", name, cur, want)
+		return
+	}
+	if current.CompactStorage != desired.CompactStorage {
+		g.unsupported("table %s: compact storage would change", name)
+		return
+	}
+
+	for _, kind := range []ColumnKind{StaticColumn, RegularColumn} {
+		for _, c := range desired.sortedColumnsOfKind(kind) {
+			cur := current.Column(c.Name)
+			switch {
+			case cur == nil:
+				static := ""
+				if kind == StaticColumn {
+					static = " static"
+				}
+				g.add("ALTER TABLE %s ADD %s %s%s", name, quoteIdent(c.Name), c.Type, static)
+			case normalizeType(cur.Type) != normalizeType(c.Type):
+				g.unsupported("table %s: column %s would change from %s to %s", name, quoteIdent(c.Name), cur.Type, c.Type)
+			case cur.Kind != c.Kind:
+				g.unsupported("table %s: column %s would change from %s to %s", name, quoteIdent(c.Name), cur.Kind, c.Kind)
+			}
+		}
+	}
+	for _, c := range current.Columns {
+		if desired.Column(c.Name) == nil {
+			g.add("ALTER TABLE %s DROP %s", name, quoteIdent(c.Name))
+		}
+	}
+
+	if changed := changedOptions(current.Options, desired.Options); len(changed) > 0 {
+		g.add("ALTER TABLE %s WITH %s", name, strings.Join(optionsCQL(changed), "\n    AND "))
+	}
+}
+
+//
+// The options of 'desired' which 'current' doesn't already have. Options only
+// 'current' has are left as they are, since we can't know what to put them back to.
+//
+func changedOptions(current, desired map[string]string) map[string]string {
+	changed := map[string]string{}
+	for name, value := range desired {
+		if !optionsMatch(value, current[name]) {
+			changed[name] = value
+		}
+	}
+	return changed
+}
+
+func functionKind(f *Function) string {
+	if f.Aggregate {
+		return "AGGREGATE"
+	}
+	return "FUNCTION"
+}
@@ -0,0 +1,110 @@
+package cql
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Generated Migrations", func() {
+
+	tmp := useTempDir()
+
+	It("Creates, alters and drops what's needed to match the schema file", func() {
+		updates := Migrations{
+			tmp.migration("201501010600_create.all.cql", "CREATE TABLE team (id int PRIMARY KEY, name text, old text);\nCREATE TABLE league (id int PRIMARY KEY);\n"),
+			tmp.migration("201501010700_index.all.cql", "CREATE INDEX team_name ON team (name);\n"),
+		}
+		schema := tmp.write("schema.cql", "CREATE TYPE address (street text);\n"+
+			"CREATE TABLE team (id int PRIMARY KEY, name text, home frozen<address>) WITH gc_grace_seconds = 3600;\n"+
+			"CREATE INDEX team_name ON team (home);\n")
+
+		g, err := PlanGenerate(updates, schema, "uat1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(g.Unsupported).To(BeEmpty())
+		Expect(g.Statements).To(Equal([]string{
+			"CREATE TYPE address (\n    street text\n)",
+			"DROP INDEX team_name",
+			"ALTER TABLE team ADD home frozen<address>",
+			"ALTER TABLE team DROP old",
+			"ALTER TABLE team WITH gc_grace_seconds = 3600",
+			"DROP TABLE league",
+			"CREATE INDEX team_name ON team (home)",
+		}))
+		Expect(string(g.CQL)).To(HavePrefix("-- @description Generated from 'schema.cql'\n\nCREATE TYPE address"))
+	})
+
+	It("Has nothing to do when the migrations already build the schema", func() {
+		updates := Migrations{tmp.migration("201501010600_create.all.cql", "CREATE TABLE team (org text, id int, PRIMARY KEY (org, id)) WITH CLUSTERING ORDER BY (id DESC);\n")}
+		g, err := PlanGenerate(updates, tmp.write("schema.cql", "CREATE TABLE team (org text, id int, PRIMARY KEY ((org), id)) WITH CLUSTERING ORDER BY (id DESC);\n"), "uat1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(g.Statements).To(BeEmpty())
+		Expect(g.Unsupported).To(BeEmpty())
+	})
+
+	It("Flags changes Cassandra can't make in place", func() {
+		updates := Migrations{
+			tmp.migration("201501010600_create.all.cql", "CREATE TABLE team (org text, id int, name text, PRIMARY KEY (org, id));\nCREATE TABLE player (id int PRIMARY KEY, age int);\n"+
+				"CREATE TYPE address (street text, city text);\n"),
+			tmp.migration("201501010700_reporting.all.cql", "CREATE KEYSPACE reporting WITH replication = {'class': 'SimpleStrategy', 'replication_factor': 1};\n"),
+		}
+		schema := tmp.write("schema.cql", "CREATE TABLE team (org text, id int, name text, PRIMARY KEY (id, org));\n"+
+			"CREATE TABLE player (id int PRIMARY KEY, age text, nickname text);\nCREATE TYPE address (street text);\n")
+
+		g, err := PlanGenerate(updates, schema, "uat1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(g.Unsupported).To(Equal([]string{
+			"type address: field city would be removed, but fields can't be dropped",
+			"table player: column age would change from int to text",
+			"table team: primary key would change from ((org), id ASC) to ((id), org ASC)",
+			"keyspace reporting isn't in the schema, but keyspaces are never dropped for you",
+		}))
+		Expect(g.Statements).To(Equal([]string{"ALTER TABLE player ADD nickname text"}))
+		Expect(string(g.CQL)).To(ContainSubstring("\n-- Cassandra can't make these changes in place, so they're left to do by hand:\n--   type address:"))
+	})
+
+	It("Only follows the migrations for the environment", func() {
+		updates := Migrations{
+			tmp.migration("201501010600_create.all.cql", "CREATE TABLE team (id int PRIMARY KEY);\n"),
+			tmp.migration("201501010700_prod.prod.cql", "ALTER TABLE team ADD audit text;\n"),
+		}
+		schema := tmp.write("schema.cql", "CREATE TABLE team (id int PRIMARY KEY);\n")
+
+		g, err := PlanGenerate(updates, schema, "uat1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(g.Statements).To(BeEmpty())
+
+		g, err = PlanGenerate(updates, schema, "prod")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(g.Statements).To(Equal([]string{"ALTER TABLE team DROP audit"}))
+	})
+
+	It("Replays the migrations in the order 'up' runs them", func() {
+		updates := Migrations{
+			tmp.migration("201501010600_name.all.cql", "-- @depends-on 201501010700\nALTER TABLE team ADD name text;\n"),
+			tmp.migration("201501010700_create.all.cql", "CREATE TABLE team (id int PRIMARY KEY);\n"),
+		}
+		g, err := PlanGenerate(updates, tmp.write("schema.cql", "CREATE TABLE team (id int PRIMARY KEY, name text);\n"), "uat1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(g.Statements).To(BeEmpty())
+	})
+
+	It("Creates keyspaces and functions, and alters keyspaces", func() {
+		updates := Migrations{tmp.migration("201501010600_create.all.cql",
+			"CREATE KEYSPACE reporting WITH replication = {'class': 'SimpleStrategy', 'replication_factor': 1};\n")}
+		schema := tmp.write("schema.cql", "CREATE KEYSPACE reporting WITH replication = {'class': 'SimpleStrategy', 'replication_factor': 3};\n"+
+			"CREATE KEYSPACE archive WITH replication = {'class': 'SimpleStrategy', 'replication_factor': 1};\n"+
+			"CREATE FUNCTION twice (x int) RETURNS NULL ON NULL INPUT RETURNS int LANGUAGE javascript AS 'x * 2';\n")
+
+		g, err := PlanGenerate(updates, schema, "uat1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(g.Statements).To(HaveLen(3))
+		Expect(g.Statements[0]).To(HavePrefix("CREATE OR REPLACE FUNCTION twice(x int)"))
+		Expect(g.Statements[1]).To(Equal("CREATE KEYSPACE archive WITH replication = {'class': 'SimpleStrategy', 'replication_factor': 1}"))
+		Expect(g.Statements[2]).To(Equal("ALTER KEYSPACE reporting WITH replication = {'class': 'SimpleStrategy', 'replication_factor': 3}"))
+	})
+
+	It("Only takes schema from the schema file", func() {
+		_, err := PlanGenerate(nil, tmp.write("schema.cql", "INSERT INTO team (id) VALUES (1);\n"), "uat1")
+		Expect(err).To(MatchError(ContainSubstring("should only describe the schema")))
+	})
+})
@@ -0,0 +1,47 @@
+package cql
+
+import (
+	"fmt"
+)
+
+//
+// A statement, in a particular Migration, that would throw data away if we ran it.
+//
+type DestructiveChange struct {
+	Migration *Migration
+	Statement *Statement
+}
+
+type DestructiveChanges []*DestructiveChange
+
+//
+// Classify every statement in each of 'updates' and return those which are destructive
+// (DROP TABLE, DROP KEYSPACE, TRUNCATE and ALTER TABLE ... DROP). This is done before
+// anything is run so that a migration is either refused outright or not at all.
+//
+func FindDestructiveChanges(updates Migrations) (changes DestructiveChanges, errs Errors) {
+	for _, m := range updates {
+		statements, err := m.Statements()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Failed to read statements from '%s': %s", m.File, err.Error()))
+			continue
+		}
+		for _, st := range statements {
+			if st.Destructive {
+				changes = append(changes, &DestructiveChange{Migration: m, Statement: st})
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return changes, nil
+	}
+	return changes, errs
+}
+
+func (c DestructiveChanges) Error() string {
+	msg := "Refusing to run migrations containing destructive statements:"
+	for _, change := range c {
+		msg += fmt.Sprintf("\n  %s: %s", change.Migration.File, change.Statement.Summary())
+	}
+	return msg
+}
@@ -3,7 +3,7 @@ package cql
 import (
 	"bufio"
 	"bytes"
-	"os"
+	"io"
 	"unicode/utf8"
 )
 
@@ -11,10 +11,10 @@ import (
 // Yeah, ok. This is not a real lexer. Maybe calling it a lexer will annoy me enough to
 // come back and write a proper CQL lexer/parser one day?
 //
-// IT IS ALSO IMPORTANT TO NOTE: that, at the moment, this will lock up if there is a comment
-// at the end of the file i.e: one with no new line character after it.
+// Comments are stripped out, including one at the very end of the file with no new
+// line after it (which used to lock this up).
 //
-func ReadCQLFile(file *os.File) (statements []string, err error) {
+func ReadCQLFile(file io.Reader) (statements []string, err error) {
 
 	s := bufio.NewScanner(file)
 	s.Split(scanCQLExpressions)
@@ -22,7 +22,7 @@ func ReadCQLFile(file *os.File) (statements []string, err error) {
 	for s.Scan() {
 		statements = append(statements, s.Text())
 	}
-	return statements, nil
+	return statements, s.Err()
 }
 
 func scanCQLExpressions(data []byte, atEOF bool) (advance int, token []byte, err error) {
@@ -43,23 +43,29 @@ func scanCQLExpressions(data []byte, atEOF bool) (advance int, token []byte, err
 	var r rune
 	for width, i := 0, start; i < len(data); i += width {
 		r, width = utf8.DecodeRune(data[i:])
+		if (r == '/' || r == '-') && i+width >= len(data) && !atEOF {
+			return 0, nil, nil // Might be the start of a comment; need to see the next rune.
+		}
 		switch r {
 		case '/':
-			r2, width2 := utf8.DecodeRune(data[i+width:])
+			r2, _ := utf8.DecodeRune(data[i+width:])
 			if r2 == '/' { // Remove single line C style comment
-				for i += width2; r2 != '\n'; i += width2 {
-					r2, width2 = utf8.DecodeRune(data[i+width:])
+				if width = skipComment(data[i:], "\n", atEOF); width < 0 {
+					return 0, nil, nil
 				}
 				continue
 			}
-			if r2 == '*' { // TODO: Multi line comments are legal too, let's not forget. But, frankly, I really can't be arsed to deal with them.
-				panic("Ahh shit. This is a multiline comment and we don't handle that right now")
+			if r2 == '*' { // Multi line comments are legal too, let's not forget.
+				if width = skipComment(data[i:], "*/", atEOF); width < 0 {
+					return 0, nil, nil
+				}
+				continue
 			}
 		case '-':
-			r2, width2 := utf8.DecodeRune(data[i+width:])
+			r2, _ := utf8.DecodeRune(data[i+width:])
 			if r2 == '-' { // Remove single line SQL style comment
-				for i += width2; r2 != '\n'; i += width2 {
-					r2, width2 = utf8.DecodeRune(data[i+width:])
+				if width = skipComment(data[i:], "\n", atEOF); width < 0 {
+					return 0, nil, nil
 				}
 				continue
 			}
@@ -70,11 +76,29 @@ func scanCQLExpressions(data []byte, atEOF bool) (advance int, token []byte, err
 	}
 
 	if atEOF && len(data) > start {
+		if buf.Len() == 0 { // Nothing but comments left.
+			return len(data), nil, nil
+		}
 		return len(data), buf.Bytes(), nil
 	}
 	return 0, nil, nil
 }
 
+//
+// Work out how much of 'data', which starts with a comment, to skip to get past the
+// comment and the 'end' marker that closes it. A comment that runs off the end of the
+// file is skipped entirely. Returns -1 if we need more data to find the end.
+//
+func skipComment(data []byte, end string, atEOF bool) int {
+	if n := bytes.Index(data[2:], []byte(end)); n >= 0 {
+		return n + 2 + len(end)
+	}
+	if atEOF {
+		return len(data)
+	}
+	return -1
+}
+
 func isSpace(r rune) bool {
 	if r <= '\u00FF' {
 		switch r {
@@ -41,8 +41,7 @@ my_table;`
 			Expect(s.Scan()).To(Equal(false))                  // ability to handle a comment that ends with no newline after it.
 		})
 
-		// TODO: It's important to note that this test will hang if un-excluded (see above)
-		XIt("should cope with comments that DON'T have a newline at the end", func() {
+		It("should cope with comments that DON'T have a newline at the end", func() {
 			exp := `select * from schema_version;
                     -- select * from yet_another-table`
 
@@ -54,8 +53,17 @@ my_table;`
 			Expect(s.Scan()).To(Equal(false))
 		})
 
-		XIt("should crap itself on multiline comments", func() {
-			Expect(scanCQLExpressions([]byte("/*"), false)).Should(Panic()) // Can you actually 'catch' a panic. I guess no...so what's this for and how do I use it?
+		It("should ignore multiline comments", func() {
+			exp := `/* A comment
+   over several lines; with a semi-colon in it */select * from /* in the middle */ schema_version;
+/* and one that never ends`
+
+			s := bufio.NewScanner(strings.NewReader(exp))
+			s.Split(scanCQLExpressions)
+
+			Expect(s.Scan()).To(Equal(true))
+			Expect(s.Text()).To(Equal("select * from  schema_version"))
+			Expect(s.Scan()).To(Equal(false))
 		})
 
 		It("should ignore C style comments", func() {
@@ -0,0 +1,124 @@
+package cql
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+//
+// The times during which mutating commands are allowed to run against an environment.
+// Days are three letter day names ("mon", "tue"...) and Hours is a range such as
+// "01:00-05:00". A range may go past midnight ("22:00-02:00") in which case the early
+// hours belong to the day on which the window opened. An empty Days allows every day,
+// an empty Hours allows the whole day and the Timezone defaults to UTC.
+//
+type MaintenanceWindow struct {
+	Days     []string
+	Hours    string
+	Timezone string
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+//
+// Is the window configured at all? An environment without one is always open.
+//
+func (w MaintenanceWindow) IsSet() bool {
+	return len(w.Days) > 0 || w.Hours != ""
+}
+
+//
+// Report whether 't' falls inside the window. Errors are returned for any nonsense
+// in the configuration rather than guessing at what was meant.
+//
+func (w MaintenanceWindow) Contains(t time.Time) (bool, error) {
+	if !w.IsSet() {
+		return true, nil
+	}
+
+	loc := time.UTC
+	if w.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(w.Timezone); err != nil {
+			return false, fmt.Errorf("Invalid maintenance window timezone '%s': %s", w.Timezone, err.Error())
+		}
+	}
+	t = t.In(loc)
+
+	days := map[time.Weekday]bool{}
+	for _, d := range w.Days {
+		wd, ok := weekdays[strings.ToLower(d)]
+		if !ok {
+			return false, fmt.Errorf("Invalid maintenance window day '%s'", d)
+		}
+		days[wd] = true
+	}
+	dayAllowed := func(wd time.Weekday) bool {
+		return len(days) == 0 || days[wd]
+	}
+
+	if w.Hours == "" {
+		return dayAllowed(t.Weekday()), nil
+	}
+	start, end, err := parseHours(w.Hours)
+	if err != nil {
+		return false, err
+	}
+
+	now := t.Hour()*60 + t.Minute()
+	if start <= end {
+		return dayAllowed(t.Weekday()) && now >= start && now < end, nil
+	}
+	// The window wraps past midnight.
+	if now >= start {
+		return dayAllowed(t.Weekday()), nil
+	}
+	if now < end {
+		return dayAllowed(t.AddDate(0, 0, -1).Weekday()), nil
+	}
+	return false, nil
+}
+
+func (w MaintenanceWindow) String() string {
+	days := "every day"
+	if len(w.Days) > 0 {
+		days = strings.Join(w.Days, ",")
+	}
+	hours := "all day"
+	if w.Hours != "" {
+		hours = w.Hours
+	}
+	tz := "UTC"
+	if w.Timezone != "" {
+		tz = w.Timezone
+	}
+	return fmt.Sprintf("%s, %s (%s)", days, hours, tz)
+}
+
+//
+// Parse "hh:mm-hh:mm" into minutes past midnight.
+//
+func parseHours(hours string) (start, end int, err error) {
+	parts := strings.Split(hours, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("Invalid maintenance window hours '%s': expected 'hh:mm-hh:mm'", hours)
+	}
+	var times [2]int
+	for i, p := range parts {
+		t, perr := time.Parse("15:04", strings.TrimSpace(p))
+		if perr != nil {
+			return 0, 0, fmt.Errorf("Invalid maintenance window hours '%s': %s", hours, perr.Error())
+		}
+		times[i] = t.Hour()*60 + t.Minute()
+	}
+	return times[0], times[1], nil
+}
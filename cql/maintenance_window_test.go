@@ -0,0 +1,73 @@
+package cql
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Maintenance Windows", func() {
+
+	// 2015-01-06 was a Tuesday.
+	tuesday := func(hour, min int) time.Time {
+		return time.Date(2015, 1, 6, hour, min, 0, 0, time.UTC)
+	}
+
+	It("should always be open when not configured", func() {
+		open, err := MaintenanceWindow{}.Contains(tuesday(12, 0))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(open).To(BeTrue())
+	})
+
+	It("should only be open on the listed days and hours", func() {
+		w := MaintenanceWindow{Days: []string{"tue"}, Hours: "01:00-05:00"}
+
+		open, err := w.Contains(tuesday(2, 30))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(open).To(BeTrue())
+
+		open, _ = w.Contains(tuesday(5, 0))
+		Expect(open).To(BeFalse())
+
+		open, _ = w.Contains(tuesday(2, 30).AddDate(0, 0, 1))
+		Expect(open).To(BeFalse())
+	})
+
+	It("should cope with windows that go past midnight", func() {
+		w := MaintenanceWindow{Days: []string{"tue"}, Hours: "22:00-02:00"}
+
+		open, _ := w.Contains(tuesday(23, 0))
+		Expect(open).To(BeTrue())
+
+		// 01:00 on the Wednesday is still Tuesday night's window...
+		open, _ = w.Contains(tuesday(1, 0).AddDate(0, 0, 1))
+		Expect(open).To(BeTrue())
+
+		// ...but 01:00 on the Tuesday belongs to Monday night's, which isn't allowed.
+		open, _ = w.Contains(tuesday(1, 0))
+		Expect(open).To(BeFalse())
+	})
+
+	It("should check the time in the window's timezone", func() {
+		w := MaintenanceWindow{Hours: "09:00-17:00", Timezone: "America/New_York"}
+
+		open, err := w.Contains(tuesday(15, 0)) // 10:00 in New York
+		Expect(err).NotTo(HaveOccurred())
+		Expect(open).To(BeTrue())
+
+		open, _ = w.Contains(tuesday(10, 0)) // 05:00 in New York
+		Expect(open).To(BeFalse())
+	})
+
+	It("should complain about nonsense configuration", func() {
+		_, err := MaintenanceWindow{Days: []string{"someday"}}.Contains(tuesday(1, 0))
+		Expect(err).To(HaveOccurred())
+
+		_, err = MaintenanceWindow{Hours: "1am till 5"}.Contains(tuesday(1, 0))
+		Expect(err).To(HaveOccurred())
+
+		_, err = MaintenanceWindow{Hours: "01:00-05:00", Timezone: "Mars/Olympus_Mons"}.Contains(tuesday(1, 0))
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,219 @@
+package cql
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const ManifestFileName = "migrations.sum"
+
+// Repeatable migrations have no version so they're written with this in its place.
+const manifestRepeatableVersion = "R"
+
+// Snapshots have this in front of their version.
+const manifestSnapshotPrefix = "B"
+
+const manifestHeader = "# Migration manifest. Generated by 'create' and 'manifest update'; don't edit by hand.\n"
+
+type ManifestEntry struct {
+	Version     string
+	Name        string
+	Environment string
+	Sum         []byte
+	Snapshot    bool
+}
+
+//
+// The list of every migration in the scripts directory, in the order they should be
+// applied, with the checksum of each. It's committed along with the migrations so that
+// edited, deleted and (after a merge) misordered migrations get noticed before they go
+// anywhere near a cluster.
+//
+type Manifest []*ManifestEntry
+
+//
+// Make a manifest for 'updates' as they are now.
+//
+func BuildManifest(updates Migrations) Manifest {
+	sorted := make(Migrations, len(updates))
+	copy(sorted, updates)
+	sort.Sort(sorted)
+
+	manifest := make(Manifest, 0, len(sorted))
+	for _, m := range sorted {
+		if m.Func != nil {
+			continue
+		}
+		manifest = append(manifest, manifestEntry(m))
+	}
+	return manifest
+}
+
+func manifestEntry(m *Migration) *ManifestEntry {
+	return &ManifestEntry{Version: m.Version, Name: m.Name, Environment: m.Environment, Sum: m.Sum, Snapshot: m.Snapshot}
+}
+
+//
+// Just enough of a Migration to sort the entry against others.
+//
+func (e *ManifestEntry) migration() *Migration {
+	return &Migration{Version: e.Version, Name: e.Name, Environment: e.Environment, Repeatable: e.Version == "", Snapshot: e.Snapshot}
+}
+
+func ReadManifest(path string) (Manifest, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(path, b)
+}
+
+//
+// Read the manifest that goes with the migrations at 'scriptsPath', which may be a
+// directory or an archive.
+//
+func ReadScriptsManifest(scriptsPath string) (Manifest, error) {
+	if !IsArchive(scriptsPath) {
+		return ReadManifest(filepath.Join(scriptsPath, ManifestFileName))
+	}
+	fsys, err := OpenArchive(scriptsPath)
+	if err != nil {
+		return nil, err
+	}
+	return ReadManifestFS(fsys, ManifestFileName)
+}
+
+func ReadManifestFS(fsys fs.FS, name string) (Manifest, error) {
+	b, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(name, b)
+}
+
+func parseManifest(path string, b []byte) (Manifest, error) {
+	var manifest Manifest
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("%s:%d: expected 'version name environment checksum'", path, n)
+		}
+		entry := &ManifestEntry{
+			Version:     fields[0],
+			Name:        fields[1],
+			Environment: fields[2],
+			Sum:         []byte(fields[3]),
+		}
+		if entry.Version == manifestRepeatableVersion {
+			entry.Version = ""
+		} else if strings.HasPrefix(entry.Version, manifestSnapshotPrefix) {
+			entry.Version = strings.TrimPrefix(entry.Version, manifestSnapshotPrefix)
+			entry.Snapshot = true
+		}
+		manifest = append(manifest, entry)
+	}
+	return manifest, s.Err()
+}
+
+func (mf Manifest) Write(path string) error {
+	buf := bytes.NewBufferString(manifestHeader)
+	for _, e := range mf {
+		version := e.Version
+		if version == "" {
+			version = manifestRepeatableVersion
+		} else if e.Snapshot {
+			version = manifestSnapshotPrefix + version
+		}
+		fmt.Fprintf(buf, "%s %s %s %s\n", version, e.Name, e.Environment, FormatChecksum(e.Sum))
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+//
+// Add a newly created migration to the end of the manifest at 'path', creating the
+// manifest from 'updates' (which should include the new migration) if there isn't one
+// yet. Only the new migration is added so that any other differences between the
+// manifest and the directory still get caught.
+//
+func AddToManifest(path string, m *Migration, updates Migrations) error {
+	manifest, err := ReadManifest(path)
+	if os.IsNotExist(err) {
+		return BuildManifest(updates).Write(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Versioned migrations go before any repeatable ones.
+	at := len(manifest)
+	for !m.Repeatable && at > 0 && manifest[at-1].Version == "" {
+		at--
+	}
+	manifest = append(manifest[:at], append(Manifest{manifestEntry(m)}, manifest[at:]...)...)
+	return manifest.Write(path)
+}
+
+//
+// Check the manifest against the migrations actually in the directory (Go migrations
+// aren't in it). Reports
+// migrations missing from either side, checksums which don't match and entries which
+// are not in the order they'd be applied in, all in one go.
+//
+func (mf Manifest) Verify(updates Migrations) (errs Errors) {
+	files := map[string]*Migration{}
+	for _, m := range updates {
+		if m.Func == nil {
+			files[m.Key()] = m
+		}
+	}
+
+	listed := map[string]bool{}
+	for i, e := range mf {
+		key := e.migration().Key()
+		listed[key] = true
+
+		if i > 0 && (Migrations{mf[i-1].migration(), e.migration()}).Less(1, 0) {
+			errs = append(errs, fmt.Errorf("Manifest has '%s' (%s) after '%s' (%s); they are out of order",
+				e.Name, e.Version, mf[i-1].Name, mf[i-1].Version))
+		}
+
+		m, ok := files[key]
+		if !ok {
+			errs = append(errs, fmt.Errorf("Manifest lists '%s' (%s, %s) but there is no such migration file", e.Name, e.Version, e.Environment))
+			continue
+		}
+		if match, err := m.VerifyChecksum(e.Sum); err != nil {
+			errs = append(errs, fmt.Errorf("Failed to verify '%s' against the manifest: %s", m.File, err.Error()))
+		} else if !match {
+			errs = append(errs, fmt.Errorf("'%s' does not match its checksum in the manifest", m.File))
+		}
+	}
+
+	var unlisted []string
+	for key, m := range files {
+		if !listed[key] {
+			unlisted = append(unlisted, m.File)
+		}
+	}
+	sort.Strings(unlisted)
+	for _, f := range unlisted {
+		errs = append(errs, fmt.Errorf("'%s' is not in the manifest", f))
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
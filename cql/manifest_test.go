@@ -0,0 +1,111 @@
+package cql
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Migration Manifest", func() {
+
+	tmp := useTempDir()
+	var updates Migrations
+
+	list := func() Migrations {
+		updates, errs := ListMigrationFiles(tmp.dir)
+		Expect(errs).To(BeNil())
+		return updates
+	}
+
+	BeforeEach(func() {
+		tmp.write("201501020600_create_team.all.cql", "CREATE TABLE team (name text PRIMARY KEY);\n")
+		tmp.write("201501010600_add_seed_data.uat1.cql", "INSERT INTO team (name) VALUES ('a');\n")
+		updates = list()
+		Expect(BuildManifest(updates).Write(filepath.Join(tmp.dir, ManifestFileName))).To(Succeed())
+	})
+
+	It("should write and read back a manifest in version order", func() {
+		manifest, err := ReadManifest(filepath.Join(tmp.dir, ManifestFileName))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(manifest)).To(Equal(2))
+		Expect(manifest[0].Name).To(Equal("add_seed_data"))
+		Expect(manifest[0].Environment).To(Equal("uat1"))
+		Expect(string(manifest[1].Sum)).To(HavePrefix("sha256:"))
+		Expect(manifest.Verify(updates)).To(BeNil())
+	})
+
+	It("should catch edits, deletions and additions", func() {
+		manifest, _ := ReadManifest(filepath.Join(tmp.dir, ManifestFileName))
+
+		tmp.write("201501020600_create_team.all.cql", "CREATE TABLE team (name text PRIMARY KEY, size int);\n")
+		Expect(os.Remove(filepath.Join(tmp.dir, "201501010600_add_seed_data.uat1.cql"))).To(Succeed())
+		tmp.write("201501030600_another.all.cql", "")
+
+		errs := manifest.Verify(list())
+		Expect(len(errs)).To(Equal(3))
+		Expect(errs.Error()).To(ContainSubstring("201501020600_create_team.all.cql' does not match"))
+		Expect(errs.Error()).To(ContainSubstring("lists 'add_seed_data' (201501010600, uat1) but there is no such migration file"))
+		Expect(errs.Error()).To(ContainSubstring("201501030600_another.all.cql' is not in the manifest"))
+	})
+
+	It("should catch entries that have been merged out of order", func() {
+		manifest, _ := ReadManifest(filepath.Join(tmp.dir, ManifestFileName))
+		manifest[0], manifest[1] = manifest[1], manifest[0]
+
+		errs := manifest.Verify(updates)
+		Expect(len(errs)).To(Equal(1))
+		Expect(errs.Error()).To(ContainSubstring("out of order"))
+	})
+
+	It("should allow entries with the same version or name for different environments", func() {
+		tmp.write("201501030600_seed.uat1.cql", "INSERT INTO team (name) VALUES ('b');\n")
+		tmp.write("201501030600_seed.uat2.cql", "INSERT INTO team (name) VALUES ('c');\n")
+		tmp.write("R__v.uat1.cql", "CREATE TABLE IF NOT EXISTS v (id int PRIMARY KEY);\n")
+		tmp.write("R__v.uat2.cql", "CREATE TABLE IF NOT EXISTS v (id int PRIMARY KEY);\n")
+		Expect(BuildManifest(list()).Write(filepath.Join(tmp.dir, ManifestFileName))).To(Succeed())
+
+		manifest, err := ReadManifest(filepath.Join(tmp.dir, ManifestFileName))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(manifest).To(HaveLen(6))
+		Expect(manifest.Verify(list())).To(BeNil())
+	})
+
+	It("should add a newly created migration to the end", func() {
+		tmp.write("201501030600_another.all.cql", "")
+		m, err := MigrationFromFile(filepath.Join(tmp.dir, "201501030600_another.all.cql"))
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(AddToManifest(filepath.Join(tmp.dir, ManifestFileName), m, list())).To(Succeed())
+		manifest, _ := ReadManifest(filepath.Join(tmp.dir, ManifestFileName))
+		Expect(len(manifest)).To(Equal(3))
+		Expect(manifest[2].Name).To(Equal("another"))
+		Expect(manifest.Verify(list())).To(BeNil())
+	})
+
+	It("should keep repeatable migrations at the end", func() {
+		tmp.write("R__team_view.all.cql", "CREATE MATERIALIZED VIEW v AS SELECT * FROM team;\n")
+		Expect(BuildManifest(list()).Write(filepath.Join(tmp.dir, ManifestFileName))).To(Succeed())
+
+		tmp.write("201501030600_another.all.cql", "")
+		m, _ := MigrationFromFile(filepath.Join(tmp.dir, "201501030600_another.all.cql"))
+		Expect(AddToManifest(filepath.Join(tmp.dir, ManifestFileName), m, list())).To(Succeed())
+
+		manifest, err := ReadManifest(filepath.Join(tmp.dir, ManifestFileName))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(manifest[2].Name).To(Equal("another"))
+		Expect(manifest[3].Name).To(Equal("team_view"))
+		Expect(manifest[3].Version).To(Equal(""))
+		Expect(manifest.Verify(list())).To(BeNil())
+	})
+
+	It("should match the test migrations", func() {
+		manifest, err := ReadManifest("../migrations/test/" + ManifestFileName)
+		Expect(err).NotTo(HaveOccurred())
+
+		updates, errs := ListMigrationFiles("../migrations/test")
+		Expect(errs).To(BeNil())
+		Expect(manifest.Verify(updates)).To(BeNil())
+	})
+})
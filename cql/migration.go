@@ -1,13 +1,16 @@
 package cql
 
 import (
-	"crypto/sha1"
+	"bytes"
+	"context"
 	"fmt"
 	"github.com/gocql/gocql"
 	"golang.org/x/text/unicode/norm"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"os/user"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -16,6 +19,9 @@ import (
 
 const (
 	migrationTimeFormat = "200601021504"
+
+	// Repeatable migrations have no version; their file names start with this instead.
+	repeatablePrefix = "R__"
 )
 
 type Migration struct {
@@ -26,6 +32,72 @@ type Migration struct {
 	User        string
 	Version     string
 	File        string
+
+	// Repeatable migrations are re-run, after all the versioned ones, whenever their
+	// content changes. Think UDFs, views and reference data.
+	Repeatable bool
+
+	// Baselined migrations are recorded as applied without having been run, because the
+	// keyspace already had them when we started looking after it.
+	Baselined bool
+
+	// Snapshots stand in for all the migrations up to their version, which are listed in
+	// Supersedes. They're made by 'squash'.
+	Snapshot   bool
+	Supersedes []Superseded
+
+	// Set for migrations written in Go (see Register). They have no file; File is just
+	// a name for them.
+	Func MigrationFunc
+
+	// Where File is to be read from if it isn't on disk, e.g. an embedded or archived
+	// set of migrations. File is then the path within it, after the archive's path for
+	// an archive (see archiveFS).
+	FS fs.FS
+
+	// From the annotations at the top of the file (see readAnnotations). Description,
+	// Author and Tags are kept in the history too.
+	Description string
+	Author      string
+	Tags        []string
+	DependsOn   []string
+
+	// The '@env' the file was narrowed to, if any, which is checked against the config
+	// when the scripts are listed. It only filters where the migration applies:
+	// Environment stays as the file name has it, since that's what the history records.
+	envAnnotation string
+
+	// How long the whole migration may take, and the consistency its statements are
+	// run at, if not the session's.
+	Timeout     time.Duration
+	Consistency gocql.Consistency
+
+	// The statements don't depend on each other, so a failing one doesn't spoil the
+	// rest. Every statement of a file is tried either way; it's parallel migrations,
+	// which stop at the first failure, that can't be marked so.
+	NonTransactional bool
+
+	// Templates are rendered with Variables before they're run (see render). Their
+	// checksum is of the template, so changing a variable doesn't make them look edited.
+	Template  bool
+	Variables map[string]string
+
+	// Data migrations load the Data file into Table instead of running statements (see
+	// loadData), recording the number of Rows in the history.
+	Data        string
+	Table       string
+	Concurrency int
+	BatchSize   int
+	Rows        int64
+
+	// Backfills run their statements for each row of the Scan table (see backfill), no
+	// more than Rate rows a second, checkpointing each of Ranges as it's done. Go ones
+	// have a transform instead.
+	Scan        string
+	Rate        int
+	Ranges      int
+	scanColumns []string
+	transform   BackfillFunc
 }
 
 func CreateMigration(name string, env string) (migration *Migration) {
@@ -39,41 +111,123 @@ func CreateMigration(name string, env string) (migration *Migration) {
 	migration = &Migration{
 		Environment: environment,
 		Name:        name,
-		Version:     time.Now().Format(migrationTimeFormat),
+		Version:     NextVersion(nil),
 	}
 	return migration
 }
 
+//
+// Create a repeatable migration. It has no version, just a name.
+//
+func CreateRepeatableMigration(name string, env string) (migration *Migration) {
+	migration = CreateMigration(name, env)
+	migration.Version = ""
+	migration.Repeatable = true
+	return migration
+}
+
 //
 // Create a Migration object based upon a file's name. The date stamp (or 'version')
-// of the file is expected in the format 'YYYYMMDDhhmm'.
+// of the file is expected in the format 'YYYYMMDDhhmm', or whatever the version scheme
+// and FileNamePattern say. Repeatable migrations are named 'R__name.env.cql' instead,
+// and snapshots 'B__version_name.env.cql'.
 //
 func MigrationFromFile(path string) (migration *Migration, err error) {
 	fbytes, readErr := ioutil.ReadFile(path)
 	if readErr != nil {
 		return nil, readErr
 	}
+	migration, err = migrationFromContent(path, filepath.Base(path), fbytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := migration.load(fbytes); err != nil {
+		return nil, err
+	}
+	return migration, nil
+}
 
-	filename := filepath.Base(path)
-	re := regexp.MustCompile("(\\d{12})[_.]([A-Za-z0-9_-]+)\\.([A-Za-z0-9_-]+)\\.cql")
+//
+// MigrationFromFile for a file in 'fsys'.
+//
+func MigrationFromFS(fsys fs.FS, name string) (*Migration, error) {
+	fbytes, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	migration, err := migrationFromContent(name, path.Base(name), fbytes)
+	if err != nil {
+		return nil, err
+	}
+	migration.FS = fsys
+	if err := migration.load(fbytes); err != nil {
+		return nil, err
+	}
+	return migration, nil
+}
 
-	cksum := sha1.New()
-	cksum.Write(fbytes)
-	filesha1 := cksum.Sum(nil)
+//
+// Finish off a migration whose annotations say it does more than run its statements
+// in order, checking they make sense.
+//
+func (m *Migration) load(content []byte) error {
+	if err := m.loadDataFile(content); err != nil {
+		return err
+	}
+	if err := m.checkBackfill(content); err != nil {
+		return err
+	}
+	return m.checkParallel(content)
+}
 
-	if ok := re.MatchString(filename); ok {
-		matcher := re.FindAllStringSubmatch(filename, -1)
+func migrationFromContent(path string, filename string, fbytes []byte) (migration *Migration, err error) {
+	repeatableRe := regexp.MustCompile("^" + repeatablePrefix + "([A-Za-z0-9_-]+)\\.(" + environmentPattern + ")\\.cql$")
+	snapshotRe := regexp.MustCompile("^" + snapshotPrefix + "(" + versionPatterns[DefaultVersionScheme] + ")_([A-Za-z0-9_-]+)\\.(" + environmentPattern + ")\\.cql$")
+
+	cksum, sumErr := Checksum(DefaultChecksumAlgorithm, fbytes)
+	if sumErr != nil {
+		return nil, sumErr
+	}
+
+	if matcher := repeatableRe.FindStringSubmatch(filename); matcher != nil {
+		migration = &Migration{
+			Environment: matcher[2],
+			Name:        matcher[1],
+			Sum:         cksum,
+			User:        currentUser(),
+			File:        path,
+			Repeatable:  true,
+		}
+	} else if matcher := snapshotRe.FindStringSubmatch(filename); matcher != nil {
+		supersedes, supErr := readSupersedes(fbytes)
+		if supErr != nil {
+			return nil, supErr
+		}
 		migration = &Migration{
-			Environment: matcher[0][3],
-			Name:        matcher[0][2],
-			Sum:         filesha1,
-			Version:     matcher[0][1],
+			Environment: matcher[3],
+			Name:        matcher[2],
+			Sum:         cksum,
+			Version:     matcher[1],
+			User:        currentUser(),
+			File:        path,
+			Snapshot:    true,
+			Supersedes:  supersedes,
+		}
+	} else if version, name, env, ok := parseFileName(FileNamePattern, filename); ok {
+		migration = &Migration{
+			Environment: env,
+			Name:        name,
+			Sum:         cksum,
+			Version:     version,
 			User:        currentUser(),
 			File:        path,
 		}
 	} else {
 		return nil, fmt.Errorf("File did not match the expected naming convention")
 	}
+	if err := migration.readAnnotations(fbytes); err != nil {
+		return nil, err
+	}
 	return migration, nil
 }
 
@@ -85,24 +239,58 @@ func MigrationFromFile(path string) (migration *Migration, err error) {
 // hope that this will enable us to catch all the problematic files in one go, not
 // one at a time.
 //
-func ListMigrationFiles(path string) (updates Migrations, errs Errors) {
+// 'path' can also be a .zip or .tar.gz of a migrations directory.
+//
+func ListMigrationFiles(path string) (Migrations, Errors) {
+	return ListMigrationTree(path, false)
+}
+
+//
+// ListMigrationFiles, but if 'recursive' is set the files in subdirectories (one per
+// year or per release, say) are included too.
+//
+func ListMigrationTree(path string, recursive bool) (updates Migrations, errs Errors) {
+	if IsArchive(path) {
+		fsys, err := OpenArchive(path)
+		if err != nil {
+			errs = append(errs, err)
+			return updates, errs
+		}
+		archive := newArchiveFS(path, fsys)
+		return listMigrationFilesFS(archive, archive.path, recursive)
+	}
 
-	files, err := ioutil.ReadDir(path)
+	// WalkDir doesn't follow a symlink it's given, so walk whatever it points to, but
+	// still name the files by the path we were given.
+	root, err := filepath.EvalSymlinks(path)
 	if err != nil {
 		errs = append(errs, err)
 		return updates, errs
 	}
-
-	for _, f := range files {
-		if f.Mode().IsRegular() && strings.HasSuffix(f.Name(), ".cql") {
-			fpath := path + "/" + f.Name()
-
+	err = filepath.WalkDir(root, func(fpath string, f fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if rel, relErr := filepath.Rel(root, fpath); relErr == nil {
+			fpath = filepath.Join(path, rel)
+		}
+		if f.IsDir() {
+			if fpath != filepath.Clean(path) && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if f.Type().IsRegular() && strings.HasSuffix(f.Name(), ".cql") {
 			if m, err := MigrationFromFile(fpath); err == nil {
 				updates = append(updates, m)
 			} else {
 				errs = append(errs, fmt.Errorf("Failed to create migration from file: '%s': %s", fpath, err.Error()))
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, err)
 	}
 	if len(errs) == 0 {
 		return updates, nil
@@ -111,15 +299,52 @@ func ListMigrationFiles(path string) (updates Migrations, errs Errors) {
 }
 
 //
-// Pull out all of the Migrations that the schema_version table knows about.
+// ListMigrationFiles for the directory 'dir' of 'fsys', e.g. an embed.FS.
 //
-func ListAppliedMigrations(session *gocql.Session) (applied Migrations) {
-	iter := session.Query(`SELECT applied, environment, checksum, name, user, version FROM schema_version`).Iter()
+func ListMigrationFilesFS(fsys fs.FS, dir string) (Migrations, Errors) {
+	return listMigrationFilesFS(fsys, dir, false)
+}
+
+func listMigrationFilesFS(fsys fs.FS, dir string, recursive bool) (updates Migrations, errs Errors) {
+	if dir == "" {
+		dir = "."
+	}
+	err := fs.WalkDir(fsys, dir, func(fpath string, f fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() {
+			if fpath != dir && !recursive {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if f.Type().IsRegular() && strings.HasSuffix(f.Name(), ".cql") {
+			if m, err := MigrationFromFS(fsys, fpath); err == nil {
+				updates = append(updates, m)
+			} else {
+				errs = append(errs, fmt.Errorf("Failed to create migration from file: '%s': %s", fpath, err.Error()))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return updates, nil
+	}
+	return updates, errs
+}
 
-	for update := new(Migration); iter.Scan(&update.Applied, &update.Environment, &update.Sum, &update.Name, &update.User, &update.Version); update = new(Migration) {
-		applied = append(applied, update)
+//
+// Read the Migration's file, wherever it lives.
+//
+func (m *Migration) readFile() ([]byte, error) {
+	if m.FS != nil {
+		return fs.ReadFile(m.FS, m.File)
 	}
-	return applied
+	return ioutil.ReadFile(m.File)
 }
 
 func sanitizeStr(v string) string {
@@ -143,10 +368,13 @@ func currentUser() string {
 // and whitespace characters. It also contains an 'environment' name.
 //
 func (m *Migration) CreateMigrationFile(dirPath string) error {
-	m.File = dirPath + "/" + m.Version + "_" + m.Name + "." + m.Environment + ".cql"
+	m.File = dirPath + "/" + versionedFileName(m.Version, m.Name, m.Environment)
+	if m.Repeatable {
+		m.File = dirPath + "/" + repeatablePrefix + m.Name + "." + m.Environment + ".cql"
+	}
 	fmt.Printf("Migrate Creating migration: '%s' in '%s'\n", m.Name, m.File)
 
-	f, err := os.Create(m.File)
+	f, err := os.OpenFile(m.File, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
 	if err != nil {
 		return err
 	}
@@ -158,37 +386,84 @@ func (m *Migration) CreateMigrationFile(dirPath string) error {
 
 //
 // Apply the CQL statements in the Migration file to the db specified by 'session'.
-// Will attempt to apply all the statements and return a list of errors at the end.
-// TODO: Is that actually a good idea!?
 //
 func (m *Migration) Apply(session *gocql.Session) (errs Errors) {
-	f, fopenErr := os.Open(m.File)
-	if fopenErr != nil {
-		errs = append(errs, fopenErr)
-		return errs
+	return m.ApplyContext(context.Background(), session)
+}
+
+//
+// Apply, stopping between statements if 'ctx' is cancelled. Go migrations are simply
+// called.
+//
+func (m *Migration) ApplyContext(ctx context.Context, session *gocql.Session) (errs Errors) {
+	if m.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.Timeout)
+		defer cancel()
 	}
-	defer f.Close()
 
-	fmt.Printf("Applying migration: %s\n   |%-40s|%-15s|%-12s|%-40x|\n",
+	if m.Func != nil {
+		fmt.Printf("Applying migration: %s\n", m.File)
+		if err := m.Func(ctx, session); err != nil {
+			errs = append(errs, err)
+			return errs
+		}
+		return nil
+	}
+
+	fmt.Printf("Applying migration: %s\n   |%-40s|%-15s|%-12s|%-40s|\n",
 		m.File,
 		m.Name,
 		m.Environment,
 		m.Version,
-		m.Sum)
+		FormatChecksum(m.Sum))
 
-	statements, readErr := ReadCQLFile(f)
+	if m.Data != "" {
+		rows, err := m.loadData(ctx, session)
+		m.Rows = rows
+		if err != nil {
+			errs = append(errs, err)
+			return errs
+		}
+		return nil
+	}
+	if m.Scan != "" {
+		rows, err := m.backfill(ctx, session)
+		m.Rows = rows
+		if err != nil {
+			errs = append(errs, err)
+			return errs
+		}
+		return nil
+	}
+
+	statements, readErr := m.readCQL()
 	if readErr != nil {
 		errs = append(errs, readErr)
 		return errs
 	}
+	if m.Parallel() {
+		if err := m.applyParallel(ctx, session, statements); err != nil {
+			errs = append(errs, err)
+			return errs
+		}
+		return nil
+	}
 
 	for _, st := range statements {
 		st = strings.TrimSpace(st)
 		if "" == st {
 			continue
 		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			errs = append(errs, ctxErr)
+			return errs
+		}
 		query := session.Query(st)
-		if execErr := query.Exec(); nil != execErr {
+		if m.Consistency > 0 {
+			query.Consistency(m.Consistency)
+		}
+		if execErr := execContext(ctx, query); nil != execErr {
 			errs = append(errs, execErr)
 		}
 	}
@@ -198,27 +473,116 @@ func (m *Migration) Apply(session *gocql.Session) (errs Errors) {
 	return errs
 }
 
+//
+// Run 'query', giving up on it if 'ctx' is done first. The driver can't cancel a query
+// that has been sent, so it may still finish on the cluster.
+//
+func execContext(ctx context.Context, query *gocql.Query) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- query.Exec()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//
+// Read the Migration's file and classify each of the statements in it. Go migrations
+// don't have any we can see.
+//
+func (m *Migration) Statements() (statements []*Statement, err error) {
+	if m.Func != nil {
+		return nil, nil
+	}
+	texts, err := m.readCQL()
+	if err != nil {
+		return nil, err
+	}
+	for _, text := range texts {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		statements = append(statements, ClassifyStatement(text))
+	}
+	return statements, nil
+}
+
 //
 // Insert a record into the schema_version table for this Migration object.
 //
 func (m *Migration) Save(session *gocql.Session) error {
-	saveCql := fmt.Sprintf(`
-			INSERT INTO schema_version (
-			            applied,
-	                    environment,
-	                    checksum,
-	                    name,
-	                    user,
-	                    version)
-			    VALUES( ?, ?, ?, ?, ?, ? )`)
-
-	saveQuery := session.Query(saveCql, time.Now(), m.Environment, m.Sum, m.Name, m.User, m.Version)
+	markers := strings.TrimRight(strings.Repeat("?, ", len(historyColumns)), ", ")
+	saveCql := fmt.Sprintf("INSERT INTO schema_version (%s) VALUES (%s)", strings.Join(historyColumns, ", "), markers)
+
+	saveQuery := session.Query(saveCql, m.historyRow(time.Now())...)
 	if queryErr := saveQuery.Exec(); nil != queryErr {
 		return fmt.Errorf("Unable to save migration '%s': %s", m.Name, queryErr.Error())
 	}
 	return nil
 }
 
+// The columns of a schema_version row, in the order historyRow gives their values.
+var historyColumns = []string{"applied", "environment", "checksum", "name", "user", "version", "kind",
+	"description", "author", "tags", "rows"}
+
+//
+// The values recorded in schema_version for this Migration being applied at 'now'.
+//
+func (m *Migration) historyRow(now time.Time) []interface{} {
+	version := m.Version
+	if m.Repeatable {
+		version = repeatableRunVersion(now)
+	}
+	return []interface{}{now, m.Environment, m.Sum, m.Name, m.User, version, m.Kind(),
+		m.Description, m.Author, m.Tags, m.Rows}
+}
+
+//
+// Check that the file behind this Migration still matches the checksum 'sum' that was
+// recorded when it was applied. Old style SHA-1 checksums are verified as they always
+// were, against the raw bytes of the file. There is nothing to check a Go migration
+// against beyond its name.
+//
+func (m *Migration) VerifyChecksum(sum []byte) (bool, error) {
+	if m.Func != nil {
+		return bytes.Equal(sum, m.Sum), nil
+	}
+	fbytes, err := m.readFile()
+	if err != nil {
+		return false, err
+	}
+	if m.Data != "" {
+		data, err := m.readData()
+		if err != nil {
+			return false, err
+		}
+		fbytes = append(fbytes, data...)
+	}
+	return VerifyChecksum(sum, fbytes)
+}
+
+//
+// Should this migration be run in environment 'env'?
+//
+func (m *Migration) AppliesTo(env string) bool {
+	return EnvironmentMatches(m.environments(), env)
+}
+
+//
+// The environments the migration applies to: its '@env' if it has one, otherwise the
+// file name's.
+//
+func (m *Migration) environments() string {
+	if m.envAnnotation != "" {
+		return m.envAnnotation
+	}
+	return m.Environment
+}
+
 func (m *Migration) Compare(other *Migration) bool {
 	if m.Name == other.Name &&
 		m.Version == other.Version &&
@@ -1,21 +1,89 @@
 package cql
 
 import (
+	"fmt"
+
 	"github.com/BurntSushi/toml"
 )
 
+// What 'up' does with pending migrations older than the newest one already applied.
+const (
+	OutOfOrderFail  = "fail"
+	OutOfOrderWarn  = "warn"
+	OutOfOrderAllow = "allow"
+
+	// The policy for environments (and Migrators) which don't say.
+	DefaultOutOfOrder = OutOfOrderWarn
+)
+
 type MigrationConfig struct {
 	Scripts      Scripts
 	Environments map[string]Environment
+
+	// Named sets of environments, e.g. nonprod = ["local", "uat1"], which migrations
+	// can target like an environment.
+	Groups map[string][]string
 }
 
 type Scripts struct {
+	// The directory new migrations are created in, and where migrations.sum lives.
 	Path string
+
+	// Directories (or archives) to read migrations from, if there's more than one. Glob
+	// patterns like "./services/*/migrations" are allowed. Path defaults to the first.
+	Paths []string
+
+	// Read migrations from subdirectories of each path as well.
+	Recursive bool
+
+	// Checksum algorithm for newly applied migrations: "sha256" (the default) checksums
+	// the statements, ignoring comments and formatting, "sha256-raw" the file's bytes.
+	Checksum string
+
+	// Fail, rather than just skip the check, when there's no migrations.sum manifest.
+	RequireManifest bool
+
+	// One of "timestamp" (the default), "utc", "sequence" or "semver"; see
+	// TimestampVersions etc.
+	VersionScheme string
+
+	// How versioned migrations are named, e.g. "V{version}__{name}.{env}.cql". Defaults
+	// to DefaultFileNamePattern.
+	FileNamePattern string
+
+	// The config these came from, for checking '@env' annotations against.
+	config *MigrationConfig
 }
 
 type Environment struct {
 	Keyspace       string
 	CassandraHosts string
+
+	// Allow migrations containing DROP, TRUNCATE etc to be applied without having
+	// to pass --allow-destructive every time. Probably not what you want for prod.
+	AllowDestructive bool
+
+	// Where to save a copy of the data that destructive statements are about to throw
+	// away. Leave empty to not bother (or to only do it when --backup-dir is given).
+	BackupDir string
+
+	// Protected environments (prod, say) make mutating commands show what they are
+	// about to do and wait for the environment's name to be typed back in before going
+	// ahead. They can also be limited to only run within a maintenance window.
+	Protected         bool
+	MaintenanceWindow MaintenanceWindow
+
+	// One of "fail", "warn" or "allow"; see OutOfOrderFail etc. and DefaultOutOfOrder.
+	OutOfOrder string
+
+	// Adopt a keyspace that was built by hand: the first time 'up' finds tables in it but
+	// no history, everything up to BaselineVersion is recorded as applied (not run).
+	AutoBaseline    bool
+	BaselineVersion string
+
+	// Values for the {{ .name }}s in migrations annotated '@template'. 'keyspace' and
+	// 'environment' are always defined.
+	Variables map[string]string
 }
 
 func NewMigrationConfig(confPath string) (*MigrationConfig, error) {
@@ -24,5 +92,65 @@ func NewMigrationConfig(confPath string) (*MigrationConfig, error) {
 		return conf, err
 	}
 
+	switch conf.Scripts.Checksum {
+	case "":
+		conf.Scripts.Checksum = SHA256Checksum
+	case SHA256Checksum, RawSHA256Checksum:
+	default:
+		return conf, fmt.Errorf("Unknown checksum algorithm '%s' (expected '%s' or '%s')", conf.Scripts.Checksum, SHA256Checksum, RawSHA256Checksum)
+	}
+
+	if conf.Scripts.VersionScheme == "" {
+		conf.Scripts.VersionScheme = TimestampVersions
+	}
+	if err := checkVersionScheme(conf.Scripts.VersionScheme); err != nil {
+		return conf, err
+	}
+	if conf.Scripts.FileNamePattern == "" {
+		conf.Scripts.FileNamePattern = DefaultFileNamePattern
+	}
+	if err := checkFileNamePattern(conf.Scripts.FileNamePattern); err != nil {
+		return conf, err
+	}
+
+	if conf.Scripts.Path == "" && len(conf.Scripts.Paths) > 0 {
+		if isGlob(conf.Scripts.Paths[0]) {
+			return conf, fmt.Errorf("'path' must be set when the first of 'paths' is a pattern")
+		}
+		conf.Scripts.Path = conf.Scripts.Paths[0]
+	}
+	conf.Scripts.config = conf
+
+	for name, members := range conf.Groups {
+		if _, ok := conf.Environments[name]; ok || name == "all" || !environmentNameRe.MatchString(name) {
+			return conf, fmt.Errorf("Group '%s' can't have that name", name)
+		}
+		for _, member := range members {
+			if _, ok := conf.Environments[member]; !ok {
+				return conf, fmt.Errorf("Group '%s' has '%s' in it, which is not an environment", name, member)
+			}
+		}
+	}
+
+	for name, env := range conf.Environments {
+		for _, reserved := range []string{keyspaceVariable, environmentVariable} {
+			if _, ok := env.Variables[reserved]; ok {
+				return conf, fmt.Errorf("Environment '%s' can't set variable '%s'; it's set for you", name, reserved)
+			}
+		}
+		if env.AutoBaseline && env.BaselineVersion == "" {
+			return conf, fmt.Errorf("Environment '%s' has 'autobaseline' set but no 'baselineversion'", name)
+		}
+		switch env.OutOfOrder {
+		case "":
+			env.OutOfOrder = DefaultOutOfOrder
+			conf.Environments[name] = env
+		case OutOfOrderFail, OutOfOrderWarn, OutOfOrderAllow:
+		default:
+			return conf, fmt.Errorf("Unknown out of order policy '%s' for environment '%s' (expected '%s', '%s' or '%s')",
+				env.OutOfOrder, name, OutOfOrderFail, OutOfOrderWarn, OutOfOrderAllow)
+		}
+	}
+
 	return conf, nil
 }
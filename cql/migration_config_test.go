@@ -0,0 +1,54 @@
+package cql
+
+import (
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Migration Config", func() {
+
+	It("should load the example config with defaults filled in", func() {
+		conf, err := NewMigrationConfig("../conf/example.toml")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.Scripts.Checksum).To(Equal(SHA256Checksum))
+		Expect(conf.Scripts.VersionScheme).To(Equal(TimestampVersions))
+		Expect(conf.Scripts.FileNamePattern).To(Equal(DefaultFileNamePattern))
+		Expect(conf.Environments["local"].OutOfOrder).To(Equal(OutOfOrderWarn))
+		Expect(NewMigrator(nil, "mystack", "local", "").OutOfOrder).To(Equal(conf.Environments["local"].OutOfOrder))
+		Expect(conf.Environments["prod"].OutOfOrder).To(Equal(OutOfOrderFail))
+		Expect(conf.Environments["prod"].Protected).To(BeTrue())
+		Expect(conf.Groups["nonprod"]).To(Equal([]string{"local", "uat1"}))
+		Expect(conf.Environments["prod"].Variables["ttl"]).To(Equal("2592000"))
+		Expect(conf.CheckTargetEnvironment("nonprod+!uat1")).To(Succeed())
+		Expect(conf.CheckTargetEnvironment("uat2")).NotTo(Succeed())
+	})
+
+	It("should reject settings it doesn't understand", func() {
+		f, err := ioutil.TempFile("", "cassandra-migrate")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.Remove(f.Name())
+
+		f.WriteString("[environments.local]\noutoforder = \"sometimes\"\n")
+		f.Close()
+
+		_, err = NewMigrationConfig(f.Name())
+		Expect(err).To(MatchError(ContainSubstring("sometimes")))
+	})
+
+	It("should default the scripts path to the first of several", func() {
+		f, err := ioutil.TempFile("", "cassandra-migrate")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.Remove(f.Name())
+
+		f.WriteString("[scripts]\npaths = [\"./core\", \"./services/*\"]\nrecursive = true\n")
+		f.Close()
+
+		conf, err := NewMigrationConfig(f.Name())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.Scripts.Path).To(Equal("./core"))
+		Expect(conf.Scripts.Recursive).To(BeTrue())
+	})
+})
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -114,3 +117,40 @@ var _ = Describe("Cassandra Migrations", func() {
 		})
 	})
 })
+
+var _ = Describe("Repeatable migration files", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "cassandra-migrate")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should create and read back repeatable migration files", func() {
+		m := CreateRepeatableMigration("User Functions", "all")
+		Expect(m.CreateMigrationFile(dir)).To(Succeed())
+		Expect(filepath.Base(m.File)).To(Equal("R__user_functions.all.cql"))
+
+		read, err := MigrationFromFile(m.File)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(read.Repeatable).To(BeTrue())
+		Expect(read.Name).To(Equal("user_functions"))
+		Expect(read.Environment).To(Equal("all"))
+		Expect(read.Version).To(Equal(""))
+	})
+
+	It("should read repeatable runs back from schema_version rows", func() {
+		m := migrationFromRow(map[string]interface{}{"name": "user_functions", "version": "R20150102060000.000000", "kind": RepeatableKind})
+		Expect(m.Repeatable).To(BeTrue())
+
+		// Rows written before the kind column existed.
+		m = migrationFromRow(map[string]interface{}{"name": "portal_init", "version": "201408210600"})
+		Expect(m.Repeatable).To(BeFalse())
+		Expect(m.Version).To(Equal("201408210600"))
+	})
+})
@@ -6,8 +6,22 @@ func (s Migrations) Len() int {
 	return len(s)
 }
 
+//
+// Versioned migrations go in version order, followed by repeatable ones in name order.
+// Snapshots go before everything: whatever is left that's older than one of them is
+// environment specific and expects the schema that it sets up.
+//
 func (s Migrations) Less(i, j int) bool {
-	return s[i].Version < s[j].Version
+	if s[i].Snapshot != s[j].Snapshot {
+		return s[i].Snapshot
+	}
+	if s[i].Repeatable != s[j].Repeatable {
+		return !s[i].Repeatable
+	}
+	if s[i].Repeatable {
+		return s[i].Name < s[j].Name
+	}
+	return CompareVersions(s[i].Version, s[j].Version) < 0
 }
 
 func (s Migrations) Swap(i, j int) {
@@ -26,3 +40,54 @@ func (s Migrations) Contains(m *Migration) bool {
 	}
 	return false
 }
+
+//
+// The versioned migration with the highest version in the list, or nil if there isn't
+// one.
+//
+func (s Migrations) Latest() (latest *Migration) {
+	for _, m := range s {
+		if m.Repeatable {
+			continue
+		}
+		if latest == nil || CompareVersions(m.Version, latest.Version) > 0 {
+			latest = m
+		}
+	}
+	return latest
+}
+
+//
+// Find the 'pending' migrations that are older than the newest migration already
+// 'applied'. These are usually from a branch that was merged late, and running them
+// now means running them in a different order to everywhere they were tested.
+// Snapshots only ever stand in for what's already been run so they don't count.
+//
+func FindOutOfOrder(applied Migrations, pending Migrations) (outOfOrder Migrations, latest *Migration) {
+	latest = applied.Latest()
+	if latest == nil {
+		return nil, nil
+	}
+	for _, m := range pending {
+		if !m.Repeatable && !m.Snapshot && CompareVersions(m.Version, latest.Version) < 0 {
+			outOfOrder = append(outOfOrder, m)
+		}
+	}
+	return outOfOrder, latest
+}
+
+//
+// The most recent recorded run of the repeatable migration 'm', or nil if it has never
+// been run.
+//
+func (s Migrations) LastRun(m *Migration) (last *Migration) {
+	for _, a := range s {
+		if !a.Repeatable || a.Name != m.Name || a.Environment != m.Environment {
+			continue
+		}
+		if last == nil || a.Applied.After(last.Applied) {
+			last = a
+		}
+	}
+	return last
+}
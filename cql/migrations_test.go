@@ -4,6 +4,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"sort"
+	"time"
 )
 
 var _ = Describe("Cassandra Migrations", func() {
@@ -66,3 +67,60 @@ var _ = Describe("Cassandra Migrations", func() {
 		})
 	})
 })
+
+var _ = Describe("Out of order migrations", func() {
+
+	applied := Migrations{
+		{Name: "first", Version: "201408210600", Environment: "all"},
+		{Name: "third", Version: "201501020600", Environment: "all"},
+	}
+
+	It("should find pending migrations older than the latest applied", func() {
+		pending := Migrations{
+			{Name: "second", Version: "201412010600", Environment: "all"},
+			{Name: "fourth", Version: "201502010600", Environment: "all"},
+		}
+		outOfOrder, latest := FindOutOfOrder(applied, pending)
+		Expect(latest.Name).To(Equal("third"))
+		Expect(len(outOfOrder)).To(Equal(1))
+		Expect(outOfOrder[0].Name).To(Equal("second"))
+	})
+
+	It("should find nothing when nothing has been applied", func() {
+		outOfOrder, latest := FindOutOfOrder(nil, applied)
+		Expect(latest).To(BeNil())
+		Expect(outOfOrder).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Repeatable migrations", func() {
+
+	It("should sort repeatable migrations after all the versioned ones", func() {
+		mlist := Migrations{
+			{Name: "z_view", Repeatable: true},
+			{Name: "second", Version: "201501020600"},
+			{Name: "a_function", Repeatable: true},
+			{Name: "first", Version: "201408210600"},
+		}
+		sort.Sort(mlist)
+
+		names := []string{}
+		for _, m := range mlist {
+			names = append(names, m.Name)
+		}
+		Expect(names).To(Equal([]string{"first", "second", "a_function", "z_view"}))
+		Expect(mlist.Latest().Name).To(Equal("second"))
+	})
+
+	It("should find the last run of a repeatable migration", func() {
+		when := time.Date(2015, 1, 2, 6, 0, 0, 0, time.UTC)
+		applied := Migrations{
+			{Name: "my_view", Environment: "all", Version: "R1", Repeatable: true, Applied: when},
+			{Name: "my_view", Environment: "all", Version: "R2", Repeatable: true, Applied: when.Add(time.Hour)},
+			{Name: "my_view", Environment: "uat1", Version: "R3", Repeatable: true, Applied: when.Add(2 * time.Hour)},
+			{Name: "my_view", Environment: "all", Version: "201501020600", Applied: when.Add(3 * time.Hour)},
+		}
+		Expect(applied.LastRun(&Migration{Name: "my_view", Environment: "all"}).Version).To(Equal("R2"))
+		Expect(applied.LastRun(&Migration{Name: "other_view", Environment: "all"})).To(BeNil())
+	})
+})
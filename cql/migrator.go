@@ -0,0 +1,300 @@
+package cql
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+
+	"github.com/gocql/gocql"
+)
+
+//
+// A migration written in Go, for changes CQL can't express such as backfilling a
+// denormalised table. It should stop early and return ctx.Err() if ctx is cancelled.
+//
+type MigrationFunc func(ctx context.Context, session *gocql.Session) error
+
+// Go migrations have no file to checksum, so they get a fixed 'go:<key>' one instead.
+const goChecksumAlgorithm = "go"
+
+var registered Migrations
+
+var nameRe = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+//
+// Register a Go migration to be run alongside the CQL ones. It's meant to be called from
+// an init() function, like database/sql drivers, and panics if the version or name are
+// malformed or the migration has been registered already. An empty 'env' means "all".
+//
+func Register(version, name, env string, fn MigrationFunc) {
+	m, err := NewFuncMigration(version, name, env, fn)
+	if err != nil {
+		panic(err)
+	}
+	register(m)
+}
+
+func register(m *Migration) {
+	if registered.Contains(m) {
+		panic(fmt.Sprintf("cql: Register called twice for migration '%s'", m.Key()))
+	}
+	registered = append(registered, m)
+}
+
+//
+// Make a migration out of a Go function without registering it.
+//
+func NewFuncMigration(version, name, env string, fn MigrationFunc) (*Migration, error) {
+	if env == "" {
+		env = "all"
+	}
+	if err := ValidVersion(version); err != nil {
+		return nil, err
+	}
+	if !nameRe.MatchString(name) {
+		return nil, fmt.Errorf("Migration name '%s' has characters that aren't allowed in file names", name)
+	}
+	if _, _, err := parseEnvironments(env); err != nil {
+		return nil, err
+	}
+	if fn == nil {
+		return nil, fmt.Errorf("Migration '%s' has no function", name)
+	}
+	m := &Migration{Version: version, Name: name, Environment: env, User: currentUser(), Func: fn}
+	m.File = goChecksumAlgorithm + ":" + m.Key()
+	m.Sum = []byte(m.File)
+	return m, nil
+}
+
+//
+// The Go migrations registered so far.
+//
+func RegisteredMigrations() Migrations {
+	return append(Migrations{}, registered...)
+}
+
+//
+// Every migration there is: the CQL files in 'path' (if it isn't empty) and the Go
+// migrations that have been registered, in the order they should be applied.
+//
+func ListMigrations(path string) (updates Migrations, errs Errors) {
+	if path != "" {
+		updates, errs = ListMigrationFiles(path)
+	}
+	return withRegistered(updates, errs)
+}
+
+//
+// ListMigrations for the directory 'dir' of 'fsys'.
+//
+func ListMigrationsFS(fsys fs.FS, dir string) (Migrations, Errors) {
+	return withRegistered(ListMigrationFilesFS(fsys, dir))
+}
+
+func withRegistered(updates Migrations, errs Errors) (Migrations, Errors) {
+	for _, m := range registered {
+		if updates.Contains(m) {
+			errs = append(errs, fmt.Errorf("Go migration '%s' has the same version and name as a file", m.Key()))
+			continue
+		}
+		updates = append(updates, m)
+	}
+	sort.Sort(updates)
+	if len(errs) == 0 {
+		return updates, nil
+	}
+	return updates, errs
+}
+
+//
+// Pick out each of the sorted 'updates' that needs running in environment 'env' given
+// the 'applied' history. A migration is run if:
+//   1. It is not in the 'applied' list (or, for repeatable ones, has changed since it was
+//      last run).
+//   2. Its environment is either 'all' or 'env'.
+//   3. It is not beyond 'limit', if one was given. Repeatable ones are never run with a
+//      limit.
+// Migrations replaced by a snapshot are never run; a snapshot whose migrations have all
+// been applied comes back flagged as Baselined since it only needs recording. The rest
+// come back in 'ignored' along with why. Migrations are put after any they depend on
+// (see OrderMigrations), and it's an error for one to depend on a migration which
+// hasn't been applied and isn't going to be.
+//
+func PendingMigrations(applied, updates Migrations, env, limit string) (pending Migrations, ignored []string, err error) {
+	reasons := map[*Migration]string{}
+	ignore := func(m *Migration, reason string, args ...interface{}) {
+		reasons[m] = fmt.Sprintf(reason, args...)
+		ignored = append(ignored, fmt.Sprintf("'%s' (%s)", m.File, reasons[m]))
+	}
+
+	ordered, err := OrderMigrations(updates)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, m := range ordered {
+		if snapshot := updates.SupersededBy(m); snapshot != nil {
+			ignore(m, "superseded by '%s'", snapshot.File)
+			continue
+		}
+		if !m.AppliesTo(env) {
+			ignore(m, "because environment is '%s'", m.environments())
+			continue
+		}
+
+		switch {
+		case m.Snapshot:
+			state, err := m.SnapshotState(applied)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch state {
+			case SnapshotApplied:
+				ignore(m, "already applied")
+				continue
+			case SnapshotSatisfied:
+				m.Baselined = true
+			}
+
+		case m.Repeatable:
+			if len(limit) > 0 {
+				ignore(m, "repeatable migrations aren't run with a limit")
+				continue
+			}
+			if last := applied.LastRun(m); last != nil {
+				unchanged, err := m.VerifyChecksum(last.Sum)
+				if err != nil {
+					return nil, nil, fmt.Errorf("Failed to verify checksum of '%s': %s", m.File, err.Error())
+				}
+				if unchanged {
+					ignore(m, "unchanged since it was last run")
+					continue
+				}
+			}
+
+		default:
+			if applied.Contains(m) {
+				ignore(m, "already applied")
+				continue
+			}
+			if len(limit) > 0 && CompareVersions(m.Version, limit) > 0 {
+				ignore(m, "because is's version is > '%s'", limit)
+				continue
+			}
+		}
+		pending = append(pending, m)
+	}
+	if err := checkDependencies(updates, applied, pending, reasons); err != nil {
+		return nil, nil, err
+	}
+	return pending, ignored, nil
+}
+
+//
+// Runs migrations from inside another program, for services which look after their own
+// schema and have Go migrations of their own. It does what 'up' does, less the prompts:
+// anything which would need confirming on the command line is an error instead.
+//
+type Migrator struct {
+	Session     *gocql.Session
+	Keyspace    string
+	Environment string
+
+	// Directory of CQL migrations. Leave it empty to run registered Go migrations only.
+	Path string
+
+	// If set, Path is a directory within this (an embed.FS for instance) rather than on
+	// disk.
+	FS fs.FS
+
+	// One of the OutOfOrder* policies, DefaultOutOfOrder if empty. Anything but
+	// OutOfOrderFail lets them run.
+	OutOfOrder string
+
+	AllowDestructive bool
+
+	// For rendering migrations which are templates, along with the keyspace and
+	// environment.
+	Variables map[string]string
+}
+
+func NewMigrator(session *gocql.Session, keyspace string, env string, path string) *Migrator {
+	return &Migrator{Session: session, Keyspace: keyspace, Environment: env, Path: path, OutOfOrder: DefaultOutOfOrder}
+}
+
+//
+// Bring the keyspace up to date, returning the migrations which were run (or recorded).
+// Stops between migrations if ctx is cancelled.
+//
+func (mg *Migrator) Up(ctx context.Context) (done Migrations, err error) {
+	if err := InitSchemaVersion(mg.Session, mg.Keyspace); err != nil {
+		return nil, fmt.Errorf("Failed to init schema: %s", err.Error())
+	}
+	applied, err := ListAppliedMigrations(mg.Session)
+	if err != nil {
+		return nil, err
+	}
+
+	var updates Migrations
+	var errs Errors
+	if mg.FS != nil {
+		updates, errs = ListMigrationsFS(mg.FS, mg.Path)
+	} else {
+		updates, errs = ListMigrations(mg.Path)
+	}
+	if errs != nil {
+		return nil, errs
+	}
+	updates.SetVariables(TemplateVariables(mg.Keyspace, mg.Environment, mg.Variables))
+
+	modified, errs := FindModifiedMigrations(applied, updates)
+	if errs != nil {
+		return nil, errs
+	}
+	if len(modified) > 0 {
+		return nil, fmt.Errorf("'%s' has been modified since it was applied", modified[0].File)
+	}
+
+	pending, _, err := PendingMigrations(applied, updates, mg.Environment, "")
+	if err != nil {
+		return nil, err
+	}
+	if outOfOrder, latest := FindOutOfOrder(applied, pending); len(outOfOrder) > 0 {
+		policy := mg.OutOfOrder
+		if policy == "" {
+			policy = DefaultOutOfOrder
+		}
+		switch policy {
+		case OutOfOrderFail:
+			return nil, fmt.Errorf("'%s' is older than the latest applied version '%s'", outOfOrder[0].File, latest.Version)
+		case OutOfOrderWarn:
+			fmt.Printf("WARNING: '%s' is older than the latest applied version '%s'\n", outOfOrder[0].File, latest.Version)
+		}
+	}
+	if !mg.AllowDestructive {
+		destructive, errs := FindDestructiveChanges(pending)
+		if errs != nil {
+			return nil, errs
+		}
+		if len(destructive) > 0 {
+			return nil, destructive
+		}
+	}
+
+	for _, m := range pending {
+		if err := ctx.Err(); err != nil {
+			return done, err
+		}
+		if !m.Baselined {
+			if errs := m.ApplyContext(ctx, mg.Session); errs != nil {
+				return done, fmt.Errorf("Unable to apply migration '%s': %s", m.Name, errs.Error())
+			}
+		}
+		if err := m.Save(mg.Session); err != nil {
+			return done, err
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
@@ -0,0 +1,121 @@
+package cql
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/gocql/gocql"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Go Migrations", func() {
+
+	var (
+		dir   string
+		saved Migrations
+	)
+
+	noop := func(ctx context.Context, session *gocql.Session) error { return nil }
+
+	BeforeEach(func() {
+		saved = registered
+		registered = nil
+
+		var err error
+		dir, err = ioutil.TempDir("", "cassandra-migrate")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "201501010600_init.all.cql"), []byte("CREATE TABLE team (id uuid PRIMARY KEY);\n"), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "201501030600_more.all.cql"), []byte("ALTER TABLE team ADD name text;\n"), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		registered = saved
+		os.RemoveAll(dir)
+	})
+
+	It("should list registered migrations in order with the files", func() {
+		Register("201501020600", "backfill_names", "", noop)
+
+		updates, errs := ListMigrations(dir)
+		Expect(errs).To(BeNil())
+		Expect(len(updates)).To(Equal(3))
+		Expect(updates[1].Name).To(Equal("backfill_names"))
+		Expect(updates[1].Environment).To(Equal("all"))
+		Expect(updates[1].File).To(Equal("go:201501020600_backfill_names.all"))
+
+		updates, errs = ListMigrations("")
+		Expect(errs).To(BeNil())
+		Expect(len(updates)).To(Equal(1))
+	})
+
+	It("should refuse bad or duplicate registrations", func() {
+		Expect(func() { Register("2015", "x", "", noop) }).To(Panic())
+		Expect(func() { Register("201501020600", "has space", "", noop) }).To(Panic())
+		Expect(func() { Register("201501020600", "x", "", nil) }).To(Panic())
+
+		Register("201501020600", "x", "", noop)
+		Expect(func() { Register("201501020600", "x", "all", noop) }).To(Panic())
+
+		Register("201501010600", "init", "all", noop)
+		_, errs := ListMigrations(dir)
+		Expect(errs).To(HaveLen(1))
+	})
+
+	It("should treat a Go migration like any other", func() {
+		m, err := NewFuncMigration("201501020600", "backfill_names", "uat1", noop)
+		Expect(err).NotTo(HaveOccurred())
+
+		statements, err := m.Statements()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(statements).To(BeEmpty())
+
+		ok, err := m.VerifyChecksum(m.Sum)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+
+		Expect(BuildManifest(Migrations{m})).To(BeEmpty())
+		Expect(m.AppliesTo("uat1")).To(BeTrue())
+		Expect(m.AppliesTo("prod")).To(BeFalse())
+	})
+
+	It("should stop before running anything if cancelled", func() {
+		ran := false
+		m, _ := NewFuncMigration("201501020600", "backfill_names", "", func(ctx context.Context, session *gocql.Session) error {
+			ran = true
+			return ctx.Err()
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		Expect(m.ApplyContext(ctx, nil)).To(HaveLen(1))
+		Expect(ran).To(BeTrue())
+
+		files, _ := ListMigrationFiles(dir)
+		Expect(files[0].ApplyContext(ctx, nil)).To(ConsistOf(context.Canceled))
+	})
+})
+
+var _ = Describe("Pending Migrations", func() {
+
+	updates := Migrations{
+		{Name: "init", Version: "201501010600", Environment: "all", File: "201501010600_init.all.cql"},
+		{Name: "seed", Version: "201501020600", Environment: "uat1", File: "201501020600_seed.uat1.cql"},
+		{Name: "more", Version: "201501030600", Environment: "all", File: "201501030600_more.all.cql"},
+	}
+	applied := Migrations{{Name: "init", Version: "201501010600", Environment: "all"}}
+
+	It("should skip what's applied, for other environments or beyond the limit", func() {
+		pending, ignored, err := PendingMigrations(applied, updates, "local", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pending).To(Equal(Migrations{updates[2]}))
+		Expect(ignored).To(Equal([]string{
+			"'201501010600_init.all.cql' (already applied)",
+			"'201501020600_seed.uat1.cql' (because environment is 'uat1')",
+		}))
+
+		pending, _, _ = PendingMigrations(applied, updates, "uat1", "201501020600")
+		Expect(pending).To(Equal(Migrations{updates[1]}))
+	})
+})
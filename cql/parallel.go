@@ -0,0 +1,158 @@
+package cql
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gocql/gocql"
+)
+
+//
+// Migrations which only change data, like a seed file of thousands of INSERTs, can
+// have their statements run in parallel by giving them a @concurrency (and, to batch
+// writes to the same partition together, a @batch-size):
+//
+//   -- @concurrency 8
+//   -- @batch-size 20
+//   INSERT INTO team (org, id, name) VALUES ('pearson', 1, 'Avengers');
+//   ...
+//
+// Plain INSERTs of literal values are turned into a prepared statement per table and
+// set of columns, with the values bound to it; anything else is run as written. The
+// statements can run in any order, so none may depend on another. Schema changes are
+// always run one at a time, in order, so a migration with any isn't allowed to.
+//
+func (m *Migration) Parallel() bool {
+	return (m.Concurrency > 0 || m.BatchSize > 0) && m.Data == "" && m.Scan == ""
+}
+
+//
+// Check a migration file that runs its statements in parallel only changes data. The
+// statements of templates can only be checked once they're rendered.
+//
+func (m *Migration) checkParallel(content []byte) error {
+	if !m.Parallel() {
+		return nil
+	}
+	if m.NonTransactional {
+		return fmt.Errorf("'%s' runs its statements in parallel, which stop at the first failure, so can't be '@%s'",
+			m.File, transactionalNoneAnnotation)
+	}
+	if m.Template {
+		return nil
+	}
+	statements, err := ReadCQLFile(bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	return m.checkDML(nonEmpty(statements))
+}
+
+func (m *Migration) checkDML(statements []string) error {
+	for _, text := range statements {
+		if st := ClassifyStatement(text); st.Kind != DMLStatement {
+			return fmt.Errorf("'%s' runs its statements in parallel, so can only change data: '%s'", m.File, st.Summary())
+		}
+	}
+	return nil
+}
+
+//
+// Run 'statements' on @concurrency workers, stopping at the first that fails.
+//
+func (m *Migration) applyParallel(ctx context.Context, session *gocql.Session, statements []string) error {
+	statements = nonEmpty(statements)
+	if err := m.checkDML(statements); err != nil {
+		return err
+	}
+
+	w := newParallelWriter(ctx, session, m.Concurrency, m.BatchSize)
+	w.consistency = m.Consistency
+	tables := map[string]*Table{}
+	inserts := map[string]string{}
+	prepared := 0
+	for i, text := range statements {
+		st, partition, ok := m.prepareInsert(session, text, tables, inserts)
+		if ok {
+			prepared++
+		} else {
+			// Never batched with anything else, since we don't know where it's going.
+			st, partition = &boundStatement{cql: strings.TrimSpace(text)}, fmt.Sprintf("\x01%d", i)
+		}
+		if err := w.Add(partition, st); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("   Ran %d statements (%d prepared) on %d workers\n", len(statements), prepared, cap(w.work))
+	return nil
+}
+
+//
+// Turn 'INSERT INTO table (columns) VALUES (literals)' into a bound statement, reading
+// the table's definition (into 'tables') to convert the values. Reports false for
+// anything else, including INSERTs with options or values that aren't simple literals,
+// which are better run as they were written.
+//
+func (m *Migration) prepareInsert(session *gocql.Session, text string, tables map[string]*Table,
+	inserts map[string]string) (*boundStatement, string, bool) {
+
+	p := &tokenParser{toks: tokenize(strings.TrimSpace(text))}
+	if !p.accept("INSERT", "INTO") {
+		return nil, "", false
+	}
+	keyspace, name := p.qualifiedName()
+	if !p.peekPunct("(") {
+		return nil, "", false
+	}
+	columns := p.identList()
+	if !p.accept("VALUES") || !p.acceptPunct("(") {
+		return nil, "", false
+	}
+	var values []interface{}
+	for !p.acceptPunct(")") {
+		if len(values) > 0 && !p.acceptPunct(",") {
+			return nil, "", false
+		}
+		t := p.next()
+		switch {
+		case t.kind == stringToken || t.kind == numberToken:
+			values = append(values, t.text)
+		case t.is("true") || t.is("false"):
+			values = append(values, strings.ToLower(t.text))
+		default:
+			return nil, "", false
+		}
+	}
+	if !p.done() || len(values) != len(columns) {
+		return nil, "", false
+	}
+
+	ref := name
+	if keyspace != "" {
+		ref = keyspace + "." + name
+	}
+	table, ok := tables[ref]
+	if !ok {
+		table, _ = m.readTable(session, ref)
+		tables[ref] = table
+	}
+	if table == nil {
+		return nil, "", false
+	}
+
+	row := make(map[string]interface{}, len(columns))
+	for i, c := range columns {
+		row[c] = values[i]
+	}
+	st, partition, err := insertRow(table, row, inserts)
+	if err != nil {
+		return nil, "", false
+	}
+	return st, partition, true
+}
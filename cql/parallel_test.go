@@ -0,0 +1,74 @@
+package cql
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Parallel Migrations", func() {
+
+	tmp := useTempDir()
+
+	team := &Table{Keyspace: "mystack", Name: "team", Columns: []*Column{
+		{Name: "org", Type: "text", Kind: PartitionKeyColumn},
+		{Name: "id", Type: "int", Kind: ClusteringColumn},
+		{Name: "name", Type: "text", Kind: RegularColumn},
+		{Name: "active", Type: "boolean", Kind: RegularColumn},
+	}}
+
+	It("Is opted into with a concurrency or batch size", func() {
+		m, err := MigrationFromFile(tmp.write("201501010600_seed.all.cql",
+			"-- @concurrency 8\n-- @batch-size 20\nINSERT INTO team (org, id) VALUES ('pearson', 1);\nUPDATE team SET name = 'x' WHERE org = 'pearson' AND id = 1;\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m.Parallel()).To(BeTrue())
+
+		m, err = MigrationFromFile(tmp.write("201501010600_seed.all.cql", "INSERT INTO team (org, id) VALUES ('pearson', 1);\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m.Parallel()).To(BeFalse())
+	})
+
+	It("Keeps schema changes sequential", func() {
+		_, err := MigrationFromFile(tmp.write("201501010600_seed.all.cql",
+			"-- @concurrency 8\nCREATE TABLE team (org text PRIMARY KEY);\nINSERT INTO team (org) VALUES ('pearson');\n"))
+		Expect(err).To(MatchError(ContainSubstring("can only change data: 'CREATE TABLE team")))
+	})
+
+	It("Can't keep going after a failure", func() {
+		_, err := MigrationFromFile(tmp.write("201501010600_seed.all.cql",
+			"-- @concurrency 8\n-- @transactional-none\nINSERT INTO team (org) VALUES ('pearson');\n"))
+		Expect(err).To(MatchError(ContainSubstring("@transactional-none")))
+	})
+
+	It("Prepares plain INSERTs and groups them by partition", func() {
+		m := &Migration{Concurrency: 4}
+		tables := map[string]*Table{"mystack.team": team}
+		inserts := map[string]string{}
+
+		st, partition, ok := m.prepareInsert(nil, "INSERT INTO mystack.team (org, id, name, active) VALUES ('pearson', 1, 'It''s', TRUE)", tables, inserts)
+		Expect(ok).To(BeTrue())
+		Expect(partition).To(Equal("pearson"))
+		Expect(st.cql).To(Equal("INSERT INTO mystack.team (active, id, name, org) VALUES (?, ?, ?, ?)"))
+		Expect(st.values).To(Equal([]interface{}{true, 1, "It's", "pearson"}))
+
+		other, _, ok := m.prepareInsert(nil, "insert into mystack.team (name, org, id, active) values ('b', 'pearson', 2, false)", tables, inserts)
+		Expect(ok).To(BeTrue())
+		Expect(other.cql).To(Equal(st.cql))
+	})
+
+	It("Runs anything else as written", func() {
+		m := &Migration{Concurrency: 4, Variables: map[string]string{keyspaceVariable: "mystack"}}
+		tables := map[string]*Table{"mystack.team": team, "team": team}
+		for _, text := range []string{
+			"UPDATE team SET name = 'x' WHERE org = 'pearson' AND id = 1",
+			"INSERT INTO team (org, id) VALUES ('pearson', 1) USING TTL 60",
+			"INSERT INTO team (org, id) VALUES ('pearson', 1) IF NOT EXISTS",
+			"INSERT INTO team (org, id, name) VALUES ('pearson', 1, now())",
+			"INSERT INTO team (org, id) VALUES ('pearson', 'one')",
+			"INSERT INTO team (org, name) VALUES ('pearson', 'no id')",
+			"INSERT INTO team JSON '{\"org\": \"pearson\", \"id\": 1}'",
+		} {
+			_, _, ok := m.prepareInsert(nil, text, tables, map[string]string{})
+			Expect(ok).To(BeFalse(), text)
+		}
+	})
+})
@@ -0,0 +1,174 @@
+package cql
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//
+// Write out, as a script cqlsh can run, everything 'up' would do to apply 'pending' in
+// 'env': the history tables being created, then each migration's statements followed by
+// the row recording it in schema_version, as of 'now'. 'history' is the schema_version
+// table as it is (see ReadHistoryTable), which older versions of this tool made without
+// some columns; they are added first, or if it's nil all of them are in case they're
+// needed. Migrations whose work isn't CQL we can show (Go ones, data files and backfills)
+// are described in comments instead, and the script says up front that it won't do
+// everything.
+//
+func WritePlan(out io.Writer, pending Migrations, env, keyspace string, history *Table, now time.Time) error {
+	w := bufio.NewWriter(out)
+
+	fmt.Fprintf(w, "-- Plan for environment '%s', keyspace '%s': %d migrations, generated %s.\n",
+		env, keyspace, len(pending), now.UTC().Format(time.RFC3339))
+	var opaque []string
+	for _, m := range pending {
+		if !m.Baselined && !m.plainCQL() {
+			opaque = append(opaque, m.File)
+		}
+	}
+	if len(opaque) > 0 {
+		fmt.Fprintf(w, "-- WARNING: running this by hand won't do everything 'up' would; these can't be\n")
+		fmt.Fprintf(w, "-- written as CQL:\n")
+		for _, file := range opaque {
+			fmt.Fprintf(w, "--   %s\n", file)
+		}
+	}
+	fmt.Fprintf(w, "\nUSE %s;\n\n%s;\n\n%s;\n", quoteIdent(keyspace), createSchemaVersionCQL, createCheckpointCQL)
+	if alters := historyColumnsCQL(history); len(alters) > 0 {
+		fmt.Fprintln(w)
+		if history == nil {
+			fmt.Fprintf(w, "-- Older versions of this tool made schema_version without these columns. Where it\n")
+			fmt.Fprintf(w, "-- already has them they fail, which is safe to ignore.\n")
+		}
+		for _, st := range alters {
+			fmt.Fprintf(w, "%s;\n", st)
+		}
+	}
+
+	for _, m := range pending {
+		if err := writeMigrationPlan(w, m, now); err != nil {
+			return fmt.Errorf("Unable to plan '%s': %s", m.File, err.Error())
+		}
+	}
+	return w.Flush()
+}
+
+//
+// Is everything the migration does in its CQL? Go migrations, data files and backfills
+// do more than can be written down.
+//
+func (m *Migration) plainCQL() bool {
+	return m.Func == nil && m.Data == "" && m.Scan == ""
+}
+
+func writeMigrationPlan(w io.Writer, m *Migration, now time.Time) error {
+	version := m.Version
+	if m.Repeatable {
+		version = "repeatable"
+	}
+	fmt.Fprintf(w, "\n-- ---- %s (%s, %s)", m.File, version, m.Environment)
+	if m.Description != "" {
+		fmt.Fprintf(w, ": %s", m.Description)
+	}
+	fmt.Fprintln(w)
+
+	switch {
+	case m.Baselined:
+		fmt.Fprintf(w, "-- Only recorded as applied: everything it replaces has been.\n")
+
+	case m.Func != nil:
+		fmt.Fprintf(w, "-- A Go migration; runs code, not CQL.\n")
+
+	case m.Data != "":
+		fmt.Fprintf(w, "-- Loads the rows of '%s' into %s.\n", m.Data, m.Table)
+
+	default:
+		statements, err := m.readCQL()
+		if err != nil {
+			return err
+		}
+		prefix := ""
+		if m.Scan != "" {
+			fmt.Fprintf(w, "-- For each row of %s:\n", m.Scan)
+			prefix = "--   "
+		} else if m.Parallel() {
+			n := m.Concurrency
+			if n < 1 {
+				n = 1
+			}
+			fmt.Fprintf(w, "-- Run in no particular order, %d at a time.\n", n)
+		}
+		for _, st := range nonEmpty(statements) {
+			text := strings.Replace(strings.TrimSpace(st), "\n", "\n"+prefix, -1)
+			fmt.Fprintf(w, "%s%s;\n", prefix, text)
+		}
+	}
+
+	fmt.Fprintf(w, "%s;\n", historyInsertCQL(m.historyRow(now)))
+	fmt.Fprintf(w, "-- ---- end of %s\n", m.File)
+	return nil
+}
+
+//
+// The INSERT recording a migration in schema_version, with the values written out.
+//
+func historyInsertCQL(values []interface{}) string {
+	literals := make([]string, len(values))
+	for i, v := range values {
+		literals[i] = cqlLiteral(v)
+	}
+	return fmt.Sprintf("INSERT INTO schema_version (%s) VALUES (%s)", strings.Join(historyColumns, ", "), strings.Join(literals, ", "))
+}
+
+//
+// A value of one of the types in a schema_version row as a CQL literal.
+//
+func cqlLiteral(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return quoteString(val)
+	case []byte:
+		if val == nil {
+			return "null"
+		}
+		return "0x" + hex.EncodeToString(val)
+	case time.Time:
+		return quoteString(val.UTC().Format("2006-01-02 15:04:05.000-0700"))
+	case []string:
+		if val == nil {
+			return "null"
+		}
+		items := make([]string, len(val))
+		for i, s := range val {
+			items[i] = quoteString(s)
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	}
+	return fmt.Sprint(v)
+}
+
+//
+// The plan for 'pending' written to 'path', a .cql file.
+//
+func WritePlanFile(path string, pending Migrations, env, keyspace string, history *Table, now time.Time) error {
+	if filepath.Ext(path) != ".cql" {
+		return fmt.Errorf("Plans are CQL scripts; '%s' should end in .cql", path)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := WritePlan(f, pending, env, keyspace, history, now); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,106 @@
+package cql
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Plans", func() {
+
+	tmp := useTempDir()
+	var history *Table
+	now := time.Date(2015, 1, 2, 6, 0, 0, 0, time.UTC)
+
+	plan := func(pending Migrations) string {
+		buf := &bytes.Buffer{}
+		Expect(WritePlan(buf, pending, "uat1", "mystack", history, now)).To(Succeed())
+		return buf.String()
+	}
+
+	BeforeEach(func() {
+		r := NewSchemaReplay("mystack")
+		Expect(r.Apply(createSchemaVersionCQL)).To(Succeed())
+		history = r.Schema.Keyspaces["mystack"].Tables["schema_version"]
+	})
+
+	It("Shows every statement and the history row for each migration, in order", func() {
+		create := tmp.migration("201501010600_create_team.all.cql",
+			"-- @description Teams\n-- @tags teams\nCREATE TABLE team (id int PRIMARY KEY);\n\nINSERT INTO team (id) VALUES (1);\n")
+		create.User = "gareth"
+		views := tmp.migration("R__views.all.cql", "CREATE TABLE IF NOT EXISTS team_view (id int PRIMARY KEY);\n")
+		views.User = "gareth"
+
+		out := plan(Migrations{create, views})
+		Expect(out).To(HavePrefix("-- Plan for environment 'uat1', keyspace 'mystack': 2 migrations, generated 2015-01-02T06:00:00Z.\n"))
+		Expect(out).To(ContainSubstring("USE mystack;\n\nCREATE TABLE IF NOT EXISTS schema_version("))
+		Expect(out).NotTo(ContainSubstring("WARNING"))
+
+		at := strings.Index(out, "-- ---- "+create.File)
+		Expect(at).To(BeNumerically(">", 0))
+		Expect(out[at:]).To(HavePrefix("-- ---- " + create.File + " (201501010600, all): Teams\n" +
+			"CREATE TABLE team (id int PRIMARY KEY);\n" +
+			"INSERT INTO team (id) VALUES (1);\n" +
+			"INSERT INTO schema_version (applied, environment, checksum, name, user, version, kind, description, author, tags, rows) " +
+			"VALUES ('2015-01-02 06:00:00.000+0000', 'all', 0x" + hex.EncodeToString(create.Sum) + ", 'create_team', 'gareth', '201501010600', 'versioned', 'Teams', '', {'teams'}, 0);\n" +
+			"-- ---- end of " + create.File + "\n"))
+
+		Expect(out).To(ContainSubstring("-- ---- " + views.File + " (repeatable, all)\n"))
+		Expect(out).To(ContainSubstring("'views', 'gareth', 'R20150102060000.000000', 'repeatable'"))
+		Expect(strings.Index(out, views.File)).To(BeNumerically(">", at))
+	})
+
+	It("Adds the columns an older history table is missing first", func() {
+		Expect(plan(nil)).NotTo(ContainSubstring("ALTER TABLE schema_version"))
+
+		history = &Table{Keyspace: "mystack", Name: "schema_version", Columns: []*Column{
+			{Name: "name", Type: "text", Kind: PartitionKeyColumn},
+			{Name: "version", Type: "text", Kind: ClusteringColumn},
+			{Name: "kind", Type: "text", Kind: RegularColumn},
+		}}
+		Expect(plan(nil)).To(ContainSubstring(createCheckpointCQL + ";\n\n" +
+			"ALTER TABLE schema_version ADD description text;\n" +
+			"ALTER TABLE schema_version ADD author text;\n" +
+			"ALTER TABLE schema_version ADD tags set<text>;\n" +
+			"ALTER TABLE schema_version ADD rows bigint;\n"))
+
+		history = nil
+		out := plan(nil)
+		Expect(out).To(ContainSubstring("which is safe to ignore.\nALTER TABLE schema_version ADD kind text;\n"))
+	})
+
+	It("Renders templates", func() {
+		m := tmp.migration("201501010600_ttl.all.cql", "-- @template\nALTER TABLE events WITH default_time_to_live = {{ .ttl }};\n")
+		Migrations{m}.SetVariables(TemplateVariables("mystack", "uat1", map[string]string{"ttl": "3600"}))
+		Expect(plan(Migrations{m})).To(ContainSubstring("ALTER TABLE events WITH default_time_to_live = 3600;\n"))
+	})
+
+	It("Warns about what can't be written as CQL", func() {
+		fn, err := NewFuncMigration("201501010600", "backfill", "", func(ctx context.Context, session *gocql.Session) error { return nil })
+		Expect(err).NotTo(HaveOccurred())
+		scan := tmp.migration("201501010700_team_by_name.all.cql", "-- @scan team\nINSERT INTO team_by_name (name, id)\nVALUES (:name, :id);\n")
+		snapshot := &Migration{Version: "201501010500", Name: "squashed", Environment: "all", File: "B__201501010500_squashed.all.cql", Snapshot: true, Baselined: true}
+
+		out := plan(Migrations{snapshot, fn, scan})
+		Expect(out).To(ContainSubstring("-- WARNING: running this by hand won't do everything 'up' would; these can't be\n-- written as CQL:\n--   " + fn.File + "\n--   " + scan.File + "\n"))
+		Expect(out).To(ContainSubstring("-- Only recorded as applied: everything it replaces has been.\nINSERT INTO schema_version"))
+		Expect(out).To(ContainSubstring("'baseline'"))
+		Expect(out).To(ContainSubstring("-- A Go migration; runs code, not CQL.\n"))
+		Expect(out).To(ContainSubstring("-- For each row of team:\n--   INSERT INTO team_by_name (name, id)\n--   VALUES (:name, :id);\n"))
+	})
+
+	It("Only writes plans to .cql files", func() {
+		Expect(WritePlanFile(filepath.Join(tmp.dir, "plan.txt"), nil, "uat1", "mystack", nil, now)).To(MatchError(ContainSubstring("should end in .cql")))
+		Expect(WritePlanFile(filepath.Join(tmp.dir, "plan.cql"), nil, "uat1", "mystack", nil, now)).To(Succeed())
+		_, err := os.Stat(filepath.Join(tmp.dir, "plan.cql"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
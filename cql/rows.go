@@ -0,0 +1,176 @@
+package cql
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+const (
+	JSONLinesFormat = "jsonl"
+	CSVFormat       = "csv"
+)
+
+//
+// How a null is written in a CSV file, so it can't be mistaken for an empty string. A
+// value which is one or more backslashes and an 'N' gets another backslash in front.
+//
+const csvNull = `\N`
+
+var csvNullRe = regexp.MustCompile(`^\\+N$`)
+
+//
+// Writes rows, as read by gocql, out to a file in one of the formats above.
+//
+type RowWriter interface {
+	Write(row map[string]interface{}) error
+	Flush() error
+}
+
+//
+// Reads rows back in. Values are either JSON decoded (numbers as json.Number) or the
+// raw strings from a CSV file and need ConvertValue'ing before gocql can use them.
+//
+type RowReader interface {
+	Read() (map[string]interface{}, error)
+}
+
+func NewRowWriter(format string, w io.Writer, columns []string) (RowWriter, error) {
+	switch format {
+	case JSONLinesFormat:
+		bw := bufio.NewWriter(w)
+		return &jsonRowWriter{w: bw, enc: json.NewEncoder(bw)}, nil
+	case CSVFormat:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(columns); err != nil {
+			return nil, err
+		}
+		return &csvRowWriter{w: cw, columns: columns}, nil
+	}
+	return nil, fmt.Errorf("Unknown data format '%s'", format)
+}
+
+func NewRowReader(format string, r io.Reader) (RowReader, error) {
+	switch format {
+	case JSONLinesFormat:
+		d := json.NewDecoder(r)
+		d.UseNumber()
+		return &jsonRowReader{d: d}, nil
+	case CSVFormat:
+		cr := csv.NewReader(r)
+		columns, err := cr.Read()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CSV header: %s", err.Error())
+		}
+		for i := range columns {
+			columns[i] = strings.TrimSpace(columns[i])
+		}
+		return &csvRowReader{r: cr, columns: columns}, nil
+	}
+	return nil, fmt.Errorf("Unknown data format '%s'", format)
+}
+
+//
+// Work out the data format from a file name, going by its extension.
+//
+func DataFormatFromPath(path string) (string, error) {
+	switch {
+	case strings.HasSuffix(path, ".jsonl"), strings.HasSuffix(path, ".json"):
+		return JSONLinesFormat, nil
+	case strings.HasSuffix(path, ".csv"):
+		return CSVFormat, nil
+	}
+	return "", fmt.Errorf("Can't tell the data format of '%s' (expected .csv, .json or .jsonl)", path)
+}
+
+type jsonRowWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (j *jsonRowWriter) Write(row map[string]interface{}) error {
+	out := make(map[string]interface{}, len(row))
+	for k, v := range row {
+		out[k] = ToJSONValue(v)
+	}
+	return j.enc.Encode(out)
+}
+
+func (j *jsonRowWriter) Flush() error {
+	return j.w.Flush()
+}
+
+type csvRowWriter struct {
+	w       *csv.Writer
+	columns []string
+}
+
+func (c *csvRowWriter) Write(row map[string]interface{}) error {
+	record := make([]string, len(c.columns))
+	for i, col := range c.columns {
+		switch v := ToJSONValue(row[col]).(type) {
+		case nil:
+			record[i] = csvNull
+		case string:
+			if csvNullRe.MatchString(v) {
+				v = `\` + v
+			}
+			record[i] = v
+		case []interface{}, map[string]interface{}:
+			b, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			record[i] = string(b)
+		default:
+			record[i] = fmt.Sprint(v)
+		}
+	}
+	return c.w.Write(record)
+}
+
+func (c *csvRowWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type jsonRowReader struct {
+	d *json.Decoder
+}
+
+func (j *jsonRowReader) Read() (map[string]interface{}, error) {
+	row := map[string]interface{}{}
+	if err := j.d.Decode(&row); err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+type csvRowReader struct {
+	r       *csv.Reader
+	columns []string
+}
+
+func (c *csvRowReader) Read() (map[string]interface{}, error) {
+	record, err := c.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	row := make(map[string]interface{}, len(c.columns))
+	for i, col := range c.columns {
+		switch {
+		case i >= len(record):
+		case record[i] == csvNull:
+			row[col] = nil
+		case csvNullRe.MatchString(record[i]):
+			row[col] = record[i][1:]
+		default:
+			row[col] = record[i]
+		}
+	}
+	return row, nil
+}
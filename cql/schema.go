@@ -0,0 +1,555 @@
+package cql
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type ColumnKind string
+
+const (
+	PartitionKeyColumn ColumnKind = "partition_key"
+	ClusteringColumn   ColumnKind = "clustering"
+	RegularColumn      ColumnKind = "regular"
+	StaticColumn       ColumnKind = "static"
+)
+
+//
+// A column of a table. Position is the column's place within the partition key or
+// clustering columns (and is meaningless otherwise) and Order is "ASC" or "DESC" for
+// clustering columns.
+//
+type Column struct {
+	Name     string     `json:"name"`
+	Type     string     `json:"type"`
+	Kind     ColumnKind `json:"kind"`
+	Position int        `json:"position"`
+	Order    string     `json:"order,omitempty"`
+}
+
+type Table struct {
+	Keyspace string    `json:"keyspace"`
+	Name     string    `json:"name"`
+	Columns  []*Column `json:"columns"`
+
+	// Table properties from the WITH clause (other than the clustering order), as CQL
+	// literals, e.g. "gc_grace_seconds" -> "864000".
+	Options        map[string]string `json:"options,omitempty"`
+	CompactStorage bool              `json:"compact_storage,omitempty"`
+}
+
+//
+// Find a column by name, or nil if the table doesn't have it.
+//
+func (t *Table) Column(name string) *Column {
+	for _, c := range t.Columns {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+//
+// All of the table's columns of a particular kind, in position order.
+//
+func (t *Table) ColumnsOfKind(kind ColumnKind) (columns []*Column) {
+	for _, c := range t.Columns {
+		if c.Kind == kind {
+			columns = append(columns, c)
+		}
+	}
+	sort.Stable(byPosition(columns))
+	return columns
+}
+
+func (t *Table) PartitionKey() []*Column {
+	return t.ColumnsOfKind(PartitionKeyColumn)
+}
+
+//
+// Partition key columns followed by clustering columns.
+//
+func (t *Table) PrimaryKey() []*Column {
+	return append(t.PartitionKey(), t.ColumnsOfKind(ClusteringColumn)...)
+}
+
+func (t *Table) QualifiedName() string {
+	return qualifiedName(t.Keyspace, t.Name)
+}
+
+//
+// CQL to create the table from scratch.
+//
+func (t *Table) CreateCQL() string {
+	var lines []string
+	for _, c := range t.PrimaryKey() {
+		lines = append(lines, fmt.Sprintf("    %s %s", quoteIdent(c.Name), c.Type))
+	}
+	for _, kind := range []ColumnKind{StaticColumn, RegularColumn} {
+		for _, c := range t.sortedColumnsOfKind(kind) {
+			def := fmt.Sprintf("    %s %s", quoteIdent(c.Name), c.Type)
+			if kind == StaticColumn {
+				def += " static"
+			}
+			lines = append(lines, def)
+		}
+	}
+
+	pk := quoteIdents(t.PartitionKey())
+	if len(t.PartitionKey()) > 1 {
+		pk = "(" + pk + ")"
+	}
+	clustering := t.ColumnsOfKind(ClusteringColumn)
+	if len(clustering) > 0 {
+		pk += ", " + quoteIdents(clustering)
+	}
+	lines = append(lines, fmt.Sprintf("    PRIMARY KEY (%s)", pk))
+
+	cql := fmt.Sprintf("CREATE TABLE %s (\n%s\n)", t.QualifiedName(), strings.Join(lines, ",\n"))
+
+	var with []string
+	if t.CompactStorage {
+		with = append(with, "COMPACT STORAGE")
+	}
+	var orders []string
+	for _, c := range clustering {
+		if c.Order != "" {
+			orders = append(orders, quoteIdent(c.Name)+" "+strings.ToUpper(c.Order))
+		}
+	}
+	if len(orders) > 0 {
+		with = append(with, fmt.Sprintf("CLUSTERING ORDER BY (%s)", strings.Join(orders, ", ")))
+	}
+	with = append(with, optionsCQL(t.Options)...)
+	if len(with) > 0 {
+		cql += " WITH " + strings.Join(with, "\n    AND ")
+	}
+	return cql
+}
+
+func (t *Table) sortedColumnsOfKind(kind ColumnKind) (columns []*Column) {
+	for _, c := range t.Columns {
+		if c.Kind == kind {
+			columns = append(columns, c)
+		}
+	}
+	sort.Stable(byName(columns))
+	return columns
+}
+
+type byPosition []*Column
+
+func (s byPosition) Len() int           { return len(s) }
+func (s byPosition) Less(i, j int) bool { return s[i].Position < s[j].Position }
+func (s byPosition) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type byName []*Column
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+//
+// Quote an identifier so that its case is kept, escaping any quotes inside it. Plain
+// lower case names are left alone since quoting them would just be noise.
+//
+func quoteIdent(name string) string {
+	plain := name != ""
+	for i, r := range name {
+		if !(r >= 'a' && r <= 'z' || r == '_' || (i > 0 && r >= '0' && r <= '9')) {
+			plain = false
+			break
+		}
+	}
+	if plain && !reservedWords[name] {
+		return name
+	}
+	return "\"" + strings.Replace(name, "\"", "\"\"", -1) + "\""
+}
+
+func quoteIdents(columns []*Column) string {
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = quoteIdent(c.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// Reserved CQL keywords which have to be quoted to be used as identifiers.
+var reservedWords = map[string]bool{
+	"add": true, "allow": true, "alter": true, "and": true, "apply": true, "asc": true,
+	"authorize": true, "batch": true, "begin": true, "by": true, "columnfamily": true,
+	"create": true, "delete": true, "desc": true, "describe": true, "drop": true,
+	"entries": true, "execute": true, "from": true, "full": true, "grant": true, "if": true,
+	"in": true, "index": true, "infinity": true, "insert": true, "into": true,
+	"keyspace": true, "limit": true, "materialized": true, "modify": true, "nan": true,
+	"norecursive": true, "not": true, "null": true, "of": true, "on": true, "or": true,
+	"order": true, "primary": true, "rename": true, "replace": true, "revoke": true,
+	"schema": true, "select": true, "set": true, "table": true, "to": true, "token": true,
+	"truncate": true, "unlogged": true, "update": true, "use": true, "using": true,
+	"view": true, "where": true, "with": true,
+}
+
+//
+// Everything we know about the schema of one or more keyspaces: either worked out by
+// replaying migrations or read from a live cluster.
+//
+type Schema struct {
+	Keyspaces map[string]*Keyspace
+}
+
+func NewSchema() *Schema {
+	return &Schema{Keyspaces: map[string]*Keyspace{}}
+}
+
+//
+// A keyspace and the objects in it. Options holds the keyspace's properties
+// (replication, durable_writes) as CQL literals; it is empty for a keyspace which
+// something refers to but which we have never seen created. Functions are keyed by
+// their signature since they can be overloaded.
+//
+type Keyspace struct {
+	Name      string
+	Options   map[string]string
+	Tables    map[string]*Table
+	Types     map[string]*UserType
+	Indexes   map[string]*Index
+	Views     map[string]*View
+	Functions map[string]*Function
+}
+
+func NewKeyspace(name string) *Keyspace {
+	return &Keyspace{
+		Name:      name,
+		Options:   map[string]string{},
+		Tables:    map[string]*Table{},
+		Types:     map[string]*UserType{},
+		Indexes:   map[string]*Index{},
+		Views:     map[string]*View{},
+		Functions: map[string]*Function{},
+	}
+}
+
+//
+// Find a keyspace, adding an empty one if we haven't come across it before.
+//
+func (s *Schema) Keyspace(name string) *Keyspace {
+	ks, ok := s.Keyspaces[name]
+	if !ok {
+		ks = NewKeyspace(name)
+		s.Keyspaces[name] = ks
+	}
+	return ks
+}
+
+func (s *Schema) KeyspaceNames() []string {
+	return sortedKeys(s.Keyspaces)
+}
+
+//
+// CQL to create the whole schema from nothing, one statement per element, with
+// everything in an order that it can be run in.
+//
+func (s *Schema) CQL() (statements []string) {
+	for _, name := range s.KeyspaceNames() {
+		statements = append(statements, s.Keyspaces[name].CQL()...)
+	}
+	return statements
+}
+
+//
+// CQL to create the keyspace and everything in it. The keyspace itself is only created
+// if we know how it was defined.
+//
+func (ks *Keyspace) CQL() (statements []string) {
+	if ks.Name != "" && len(ks.Options) > 0 {
+		statements = append(statements, ks.CreateCQL())
+	}
+	for _, t := range ks.sortedTypes() {
+		statements = append(statements, t.CreateCQL())
+	}
+	for _, name := range sortedKeys(ks.Tables) {
+		statements = append(statements, ks.Tables[name].CreateCQL())
+	}
+	for _, name := range sortedKeys(ks.Indexes) {
+		statements = append(statements, ks.Indexes[name].CreateCQL())
+	}
+	for _, name := range sortedKeys(ks.Views) {
+		statements = append(statements, ks.Views[name].CreateCQL())
+	}
+	// Aggregates are made from functions so the functions have to come first.
+	for _, aggregates := range []bool{false, true} {
+		for _, sig := range sortedKeys(ks.Functions) {
+			if f := ks.Functions[sig]; f.Aggregate == aggregates {
+				statements = append(statements, f.CreateCQL())
+			}
+		}
+	}
+	return statements
+}
+
+func (ks *Keyspace) CreateCQL() string {
+	return fmt.Sprintf("CREATE KEYSPACE %s WITH %s", quoteIdent(ks.Name), strings.Join(optionsCQL(ks.Options), "\n    AND "))
+}
+
+//
+// The keyspace's types with any type used by another one before it.
+//
+func (ks *Keyspace) sortedTypes() (sorted []*UserType) {
+	done := map[string]bool{}
+	names := sortedKeys(ks.Types)
+	for len(sorted) < len(names) {
+		progress := false
+		for _, name := range names {
+			if done[name] {
+				continue
+			}
+			ready := true
+			for _, dep := range ks.Types[name].uses() {
+				if _, ok := ks.Types[dep]; ok && dep != name && !done[dep] {
+					ready = false
+				}
+			}
+			if ready {
+				sorted = append(sorted, ks.Types[name])
+				done[name] = true
+				progress = true
+			}
+		}
+		// A cycle can't really happen but don't loop forever if one does.
+		for _, name := range names {
+			if !progress && !done[name] {
+				sorted = append(sorted, ks.Types[name])
+				done[name] = true
+			}
+		}
+	}
+	return sorted
+}
+
+//
+// A user defined type.
+//
+type UserType struct {
+	Keyspace string   `json:"keyspace"`
+	Name     string   `json:"name"`
+	Fields   []*Field `json:"fields"`
+}
+
+type Field struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+func (t *UserType) QualifiedName() string {
+	return qualifiedName(t.Keyspace, t.Name)
+}
+
+func (t *UserType) Field(name string) *Field {
+	for _, f := range t.Fields {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func (t *UserType) CreateCQL() string {
+	fields := make([]string, len(t.Fields))
+	for i, f := range t.Fields {
+		fields[i] = fmt.Sprintf("    %s %s", quoteIdent(f.Name), f.Type)
+	}
+	return fmt.Sprintf("CREATE TYPE %s (\n%s\n)", t.QualifiedName(), strings.Join(fields, ",\n"))
+}
+
+//
+// Names of the other types this one's fields are made of.
+//
+func (t *UserType) uses() (names []string) {
+	for _, f := range t.Fields {
+		if dt, err := ParseType(f.Type); err == nil {
+			names = append(names, dt.typeNames()...)
+		}
+	}
+	return names
+}
+
+//
+// A secondary index. Target is the indexed column as it appears in the CREATE INDEX
+// statement, e.g. 'email' or 'keys(attributes)'. Class is only set for custom indexes.
+//
+type Index struct {
+	Keyspace string            `json:"keyspace"`
+	Name     string            `json:"name"`
+	Table    string            `json:"table"`
+	Target   string            `json:"target"`
+	Class    string            `json:"class,omitempty"`
+	Options  map[string]string `json:"options,omitempty"`
+}
+
+func (ix *Index) CreateCQL() string {
+	custom := ""
+	if ix.Class != "" {
+		custom = "CUSTOM "
+	}
+	cql := fmt.Sprintf("CREATE %sINDEX %s ON %s (%s)", custom, quoteIdent(ix.Name), qualifiedName(ix.Keyspace, ix.Table), ix.Target)
+	if ix.Class != "" {
+		cql += fmt.Sprintf(" USING '%s'", strings.Replace(ix.Class, "'", "''", -1))
+	}
+	if len(ix.Options) > 0 {
+		cql += " WITH OPTIONS = " + mapLiteral(ix.Options)
+	}
+	return cql
+}
+
+//
+// The name of the column the index is on, without any keys()/values() around it.
+//
+func (ix *Index) Column() string {
+	target := ix.Target
+	if open := strings.Index(target, "("); open >= 0 && strings.HasSuffix(target, ")") {
+		target = target[open+1 : len(target)-1]
+	}
+	return unquoteIdent(target)
+}
+
+//
+// A materialized view. Columns are the view's own columns, with their kinds describing
+// its primary key. IncludeAll is set when it selects '*' from the base table.
+//
+type View struct {
+	Keyspace   string            `json:"keyspace"`
+	Name       string            `json:"name"`
+	BaseTable  string            `json:"base_table"`
+	IncludeAll bool              `json:"include_all,omitempty"`
+	Where      string            `json:"where"`
+	Columns    []*Column         `json:"columns"`
+	Options    map[string]string `json:"options,omitempty"`
+}
+
+func (v *View) QualifiedName() string {
+	return qualifiedName(v.Keyspace, v.Name)
+}
+
+func (v *View) CreateCQL() string {
+	// The view's columns behave just like a table's when it comes to the key.
+	t := &Table{Columns: v.Columns}
+
+	selected := "*"
+	if !v.IncludeAll {
+		var names []*Column
+		names = append(names, t.PrimaryKey()...)
+		names = append(names, t.sortedColumnsOfKind(StaticColumn)...)
+		names = append(names, t.sortedColumnsOfKind(RegularColumn)...)
+		selected = quoteIdents(names)
+	}
+
+	pk := quoteIdents(t.PartitionKey())
+	if len(t.PartitionKey()) > 1 {
+		pk = "(" + pk + ")"
+	}
+	clustering := t.ColumnsOfKind(ClusteringColumn)
+	if len(clustering) > 0 {
+		pk += ", " + quoteIdents(clustering)
+	}
+
+	cql := fmt.Sprintf("CREATE MATERIALIZED VIEW %s AS\n    SELECT %s FROM %s\n    WHERE %s\n    PRIMARY KEY (%s)",
+		v.QualifiedName(), selected, qualifiedName(v.Keyspace, v.BaseTable), v.Where, pk)
+
+	var with []string
+	var orders []string
+	for _, c := range clustering {
+		if c.Order != "" {
+			orders = append(orders, quoteIdent(c.Name)+" "+strings.ToUpper(c.Order))
+		}
+	}
+	if len(orders) > 0 {
+		with = append(with, fmt.Sprintf("CLUSTERING ORDER BY (%s)", strings.Join(orders, ", ")))
+	}
+	with = append(with, optionsCQL(v.Options)...)
+	if len(with) > 0 {
+		cql += "\n    WITH " + strings.Join(with, "\n    AND ")
+	}
+	return cql
+}
+
+//
+// A user defined function or aggregate. Arguments are the argument types (functions
+// have names for them too, which are kept in Body along with everything else after
+// the argument list).
+//
+type Function struct {
+	Keyspace  string   `json:"keyspace"`
+	Name      string   `json:"name"`
+	Aggregate bool     `json:"aggregate,omitempty"`
+	Arguments []string `json:"arguments"`
+	Body      string   `json:"body"`
+}
+
+//
+// The name and argument types, which is what identifies a function.
+//
+func (f *Function) Signature() string {
+	return f.Name + "(" + strings.Join(f.Arguments, ", ") + ")"
+}
+
+func (f *Function) CreateCQL() string {
+	kind := "FUNCTION"
+	if f.Aggregate {
+		kind = "AGGREGATE"
+	}
+	return fmt.Sprintf("CREATE %s %s%s", kind, qualifiedName(f.Keyspace, f.Name), f.Body)
+}
+
+func qualifiedName(keyspace, name string) string {
+	if keyspace == "" {
+		return quoteIdent(name)
+	}
+	return quoteIdent(keyspace) + "." + quoteIdent(name)
+}
+
+//
+// The inverse of quoteIdent.
+//
+func unquoteIdent(name string) string {
+	if len(name) >= 2 && strings.HasPrefix(name, "\"") && strings.HasSuffix(name, "\"") {
+		return strings.Replace(name[1:len(name)-1], "\"\"", "\"", -1)
+	}
+	return strings.ToLower(name)
+}
+
+//
+// 'name = value' for each option, in name order.
+//
+func optionsCQL(options map[string]string) (with []string) {
+	for _, name := range sortedKeys(options) {
+		with = append(with, name+" = "+options[name])
+	}
+	return with
+}
+
+//
+// A CQL map literal of strings, with the keys in order.
+//
+func mapLiteral(m map[string]string) string {
+	var entries []string
+	for _, k := range sortedKeys(m) {
+		entries = append(entries, quoteString(k)+": "+quoteString(m[k]))
+	}
+	return "{" + strings.Join(entries, ", ") + "}"
+}
+
+func quoteString(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
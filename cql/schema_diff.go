@@ -0,0 +1,421 @@
+package cql
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gocql/gocql"
+)
+
+type DifferenceKind string
+
+const (
+	// Something the migrations create that the cluster doesn't have.
+	MissingObject DifferenceKind = "missing"
+	// Something the cluster has that no migration created.
+	ExtraObject DifferenceKind = "extra"
+	// Something both have, but which isn't the same.
+	ChangedObject DifferenceKind = "changed"
+)
+
+//
+// One way a live schema differs from the one the migrations should have built. Object
+// is what sort of thing differs ("table", "column", "field", ...) and Name its qualified
+// name, e.g. 'mystack.team.name' for a column. For changed objects Property says what's
+// different, e.g. "type" or "option gc_grace_seconds", and Expected and Actual what the
+// migrations and cluster have.
+//
+type SchemaDifference struct {
+	Kind     DifferenceKind
+	Object   string
+	Name     string
+	Property string
+	Expected string
+	Actual   string
+}
+
+func (d *SchemaDifference) String() string {
+	switch d.Kind {
+	case MissingObject:
+		return fmt.Sprintf("%s %s is missing", d.Object, d.Name)
+	case ExtraObject:
+		return fmt.Sprintf("%s %s isn't in the migrations", d.Object, d.Name)
+	}
+	return fmt.Sprintf("%s %s: %s is %s, the migrations say %s", d.Object, d.Name, d.Property, d.Actual, d.Expected)
+}
+
+//
+// Work out the schema the migrations that have been applied to a keyspace should have
+// built, by replaying their statements in order. Only the files matter: 'applied' (the
+// history) just says which of them to include. Go migrations don't show up since we
+// can't see what they do, and snapshots which were only recorded as applied are left
+// out in favour of the migrations they replace, which were run.
+//
+func AppliedSchema(updates, applied Migrations, env, keyspace string) (*Schema, error) {
+	ordered, err := OrderMigrations(updates)
+	if err != nil {
+		return nil, err
+	}
+	var replayed Migrations
+	for _, m := range ordered {
+		if !m.AppliesTo(env) {
+			continue
+		}
+		var ran *Migration
+		if m.Repeatable {
+			ran = applied.LastRun(m)
+		} else {
+			for _, a := range applied {
+				if a.Compare(m) {
+					ran = a
+					break
+				}
+			}
+		}
+		if ran == nil || (m.Snapshot && ran.Baselined) {
+			continue
+		}
+		replayed = append(replayed, m)
+	}
+	return ReplayMigrations(replayed, keyspace)
+}
+
+//
+// Compare the schema the migrations should have built with what the cluster actually
+// has in each of its keyspaces.
+//
+func DiffLiveSchema(session *gocql.Session, expected *Schema) ([]*SchemaDifference, error) {
+	actual := NewSchema()
+	for _, name := range expected.KeyspaceNames() {
+		live, err := ReadSchema(session, name)
+		if _, missing := err.(missingKeyspaceError); missing {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		actual.Keyspaces[name] = live.Keyspaces[name]
+	}
+	return DiffSchemas(expected, actual), nil
+}
+
+//
+// Everything that differs between two schemas, 'expected' from replaying migrations and
+// 'actual' read from a cluster. Only the keyspaces of 'expected' are compared, and the
+// history tables we keep in them are ignored. Options are only compared when the
+// migrations set them: the cluster fills in defaults for everything else, and for maps
+// like compaction only the entries the migrations give are checked.
+//
+func DiffSchemas(expected, actual *Schema) (diffs []*SchemaDifference) {
+	for _, name := range expected.KeyspaceNames() {
+		ks := expected.Keyspaces[name]
+		live, ok := actual.Keyspaces[name]
+		if !ok {
+			diffs = append(diffs, &SchemaDifference{Kind: MissingObject, Object: "keyspace", Name: quoteIdent(name)})
+			continue
+		}
+		diffs = append(diffs, diffKeyspaces(ks, live)...)
+	}
+	return diffs
+}
+
+func diffKeyspaces(expected, actual *Keyspace) (diffs []*SchemaDifference) {
+	d := &schemaDiff{}
+	d.options("keyspace", quoteIdent(expected.Name), expected.Options, actual.Options)
+
+	for _, name := range unionKeys(expected.Types, actual.Types) {
+		exp, act := expected.Types[name], actual.Types[name]
+		if d.presence("type", qualifiedName(expected.Name, name), exp != nil, act != nil) {
+			d.types(exp, act)
+		}
+	}
+	for _, name := range unionKeys(expected.Tables, actual.Tables) {
+		if isHistoryTable(name) {
+			continue
+		}
+		exp, act := expected.Tables[name], actual.Tables[name]
+		if d.presence("table", qualifiedName(expected.Name, name), exp != nil, act != nil) {
+			d.tables(exp, act)
+		}
+	}
+	for _, name := range unionKeys(expected.Indexes, actual.Indexes) {
+		exp, act := expected.Indexes[name], actual.Indexes[name]
+		if d.presence("index", qualifiedName(expected.Name, name), exp != nil, act != nil) {
+			d.indexes(exp, act)
+		}
+	}
+	for _, name := range unionKeys(expected.Views, actual.Views) {
+		exp, act := expected.Views[name], actual.Views[name]
+		if d.presence("view", qualifiedName(expected.Name, name), exp != nil, act != nil) {
+			d.views(exp, act)
+		}
+	}
+
+	// Functions are keyed by a signature the cluster may write differently.
+	expFuncs, actFuncs := functionsBySignature(expected), functionsBySignature(actual)
+	for _, sig := range unionKeys(expFuncs, actFuncs) {
+		exp, act := expFuncs[sig], actFuncs[sig]
+		f := exp
+		if f == nil {
+			f = act
+		}
+		object := "function"
+		if f.Aggregate {
+			object = "aggregate"
+		}
+		d.presence(object, quoteIdent(expected.Name)+"."+sig, exp != nil, act != nil)
+	}
+	return d.diffs
+}
+
+type schemaDiff struct {
+	diffs []*SchemaDifference
+}
+
+//
+// Note an object only one side has. Reports whether both have it, so can be compared.
+//
+func (d *schemaDiff) presence(object, name string, expected, actual bool) bool {
+	switch {
+	case expected && !actual:
+		d.diffs = append(d.diffs, &SchemaDifference{Kind: MissingObject, Object: object, Name: name})
+	case actual && !expected:
+		d.diffs = append(d.diffs, &SchemaDifference{Kind: ExtraObject, Object: object, Name: name})
+	}
+	return expected && actual
+}
+
+func (d *schemaDiff) changed(object, name, property, expected, actual string) {
+	d.diffs = append(d.diffs, &SchemaDifference{Kind: ChangedObject, Object: object, Name: name,
+		Property: property, Expected: expected, Actual: actual})
+}
+
+func (d *schemaDiff) types(expected, actual *UserType) {
+	name := expected.QualifiedName()
+	var names []string
+	for _, f := range expected.Fields {
+		names = append(names, f.Name)
+	}
+	for _, f := range actual.Fields {
+		if expected.Field(f.Name) == nil {
+			names = append(names, f.Name)
+		}
+	}
+	for _, field := range names {
+		exp, act := expected.Field(field), actual.Field(field)
+		if d.presence("field", name+"."+quoteIdent(field), exp != nil, act != nil) {
+			if normalizeType(exp.Type) != normalizeType(act.Type) {
+				d.changed("field", name+"."+quoteIdent(field), "type", exp.Type, act.Type)
+			}
+		}
+	}
+}
+
+func (d *schemaDiff) tables(expected, actual *Table) {
+	name := expected.QualifiedName()
+	d.columns(name, expected.Columns, actual.Columns)
+	if exp, act := primaryKeyText(expected.Columns), primaryKeyText(actual.Columns); exp != act {
+		d.changed("table", name, "primary key", exp, act)
+	}
+	if expected.CompactStorage != actual.CompactStorage {
+		d.changed("table", name, "compact storage", strconv.FormatBool(expected.CompactStorage), strconv.FormatBool(actual.CompactStorage))
+	}
+	d.options("table", name, expected.Options, actual.Options)
+}
+
+//
+// Compare the columns of a table or view, other than which are in the primary key.
+//
+func (d *schemaDiff) columns(name string, expected, actual []*Column) {
+	exp, act := columnsByName(expected), columnsByName(actual)
+	for _, column := range unionKeys(exp, act) {
+		e, a := exp[column], act[column]
+		qualified := name + "." + quoteIdent(column)
+		if !d.presence("column", qualified, e != nil, a != nil) {
+			continue
+		}
+		if normalizeType(e.Type) != normalizeType(a.Type) {
+			d.changed("column", qualified, "type", e.Type, a.Type)
+		}
+		if (e.Kind == StaticColumn) != (a.Kind == StaticColumn) {
+			d.changed("column", qualified, "static", strconv.FormatBool(e.Kind == StaticColumn), strconv.FormatBool(a.Kind == StaticColumn))
+		}
+	}
+}
+
+func (d *schemaDiff) indexes(expected, actual *Index) {
+	name := qualifiedName(expected.Keyspace, expected.Name)
+	if expected.Table != actual.Table {
+		d.changed("index", name, "table", expected.Table, actual.Table)
+	}
+	if normalizeTarget(expected.Target) != normalizeTarget(actual.Target) {
+		d.changed("index", name, "target", expected.Target, actual.Target)
+	}
+	if normalizeOptionValue(expected.Class) != normalizeOptionValue(actual.Class) {
+		d.changed("index", name, "class", expected.Class, actual.Class)
+	}
+}
+
+func (d *schemaDiff) views(expected, actual *View) {
+	name := expected.QualifiedName()
+	if expected.BaseTable != actual.BaseTable {
+		d.changed("view", name, "base table", expected.BaseTable, actual.BaseTable)
+	}
+	// The cluster lists every column a view selects, even for '*', so only compare them
+	// when the migrations name them.
+	if !expected.IncludeAll {
+		d.columns(name, expected.Columns, actual.Columns)
+	}
+	if exp, act := primaryKeyText(expected.Columns), primaryKeyText(actual.Columns); exp != act {
+		d.changed("view", name, "primary key", exp, act)
+	}
+	d.options("view", name, expected.Options, actual.Options)
+}
+
+//
+// Compare the options the migrations set with the cluster's.
+//
+func (d *schemaDiff) options(object, name string, expected, actual map[string]string) {
+	for _, option := range sortedKeys(expected) {
+		exp, act := expected[option], actual[option]
+		if !optionsMatch(exp, act) {
+			if act == "" {
+				act = "unset"
+			}
+			d.changed(object, name, "option "+option, exp, act)
+		}
+	}
+}
+
+//
+// Do the option literals 'expected' and 'actual' amount to the same thing? Quotes, case
+// and the package of Cassandra's classes don't matter, and nor do any entries of a map
+// that 'expected' doesn't have.
+//
+func optionsMatch(expected, actual string) bool {
+	exp, isMap := optionMap(expected)
+	if !isMap {
+		return normalizeOptionValue(expected) == normalizeOptionValue(actual)
+	}
+	act, isMap := optionMap(actual)
+	if !isMap {
+		return false
+	}
+	for k, v := range exp {
+		if a, ok := act[k]; !ok || a != v {
+			return false
+		}
+	}
+	return true
+}
+
+//
+// A map literal's keys and values, normalized.
+//
+func optionMap(literal string) (map[string]string, bool) {
+	p := &tokenParser{toks: tokenize(literal)}
+	if !p.acceptPunct("{") {
+		return nil, false
+	}
+	m := map[string]string{}
+	for !p.acceptPunct("}") {
+		if p.done() {
+			return nil, false
+		}
+		k, err := p.literal()
+		if err != nil || !p.acceptPunct(":") {
+			return nil, false
+		}
+		v, err := p.literal()
+		if err != nil {
+			return nil, false
+		}
+		m[normalizeOptionValue(k)] = normalizeOptionValue(v)
+		p.acceptPunct(",")
+	}
+	return m, p.done()
+}
+
+func normalizeOptionValue(v string) string {
+	v = strings.TrimSpace(v)
+	if len(v) >= 2 && strings.HasPrefix(v, "'") && strings.HasSuffix(v, "'") {
+		v = strings.Replace(v[1:len(v)-1], "''", "'", -1)
+	}
+	if strings.HasPrefix(v, "org.apache.cassandra.") {
+		v = v[strings.LastIndex(v, ".")+1:]
+	}
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return strings.ToLower(v)
+}
+
+func normalizeType(t string) string {
+	if dt, err := ParseType(t); err == nil {
+		return dt.String()
+	}
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+func normalizeTarget(target string) string {
+	return strings.ToLower(strings.Replace(target, " ", "", -1))
+}
+
+//
+// The primary key written out, e.g. '((org), id DESC)', to compare and report.
+//
+func primaryKeyText(columns []*Column) string {
+	t := &Table{Columns: columns}
+	var partition, clustering []string
+	for _, c := range t.PartitionKey() {
+		partition = append(partition, quoteIdent(c.Name))
+	}
+	for _, c := range t.ColumnsOfKind(ClusteringColumn) {
+		order := strings.ToUpper(c.Order)
+		if order == "" {
+			order = "ASC"
+		}
+		clustering = append(clustering, quoteIdent(c.Name)+" "+order)
+	}
+	key := "(" + strings.Join(partition, ", ") + ")"
+	if len(clustering) > 0 {
+		key += ", " + strings.Join(clustering, ", ")
+	}
+	return "(" + key + ")"
+}
+
+func columnsByName(columns []*Column) map[string]*Column {
+	m := make(map[string]*Column, len(columns))
+	for _, c := range columns {
+		m[c.Name] = c
+	}
+	return m
+}
+
+func functionsBySignature(ks *Keyspace) map[string]*Function {
+	m := make(map[string]*Function, len(ks.Functions))
+	for _, f := range ks.Functions {
+		args := make([]string, len(f.Arguments))
+		for i, a := range f.Arguments {
+			args[i] = normalizeType(a)
+		}
+		m[quoteIdent(f.Name)+"("+strings.Join(args, ", ")+")"] = f
+	}
+	return m
+}
+
+//
+// The keys of two maps together, in order.
+//
+func unionKeys[V any](a, b map[string]V) []string {
+	keys := sortedKeys(a)
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,114 @@
+package cql
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Schema Diffs", func() {
+
+	tmp := useTempDir()
+
+	replay := func(text string) *Schema {
+		r := NewSchemaReplay("mystack")
+		statements, err := ReadCQLFile(strings.NewReader(text))
+		Expect(err).NotTo(HaveOccurred())
+		for _, st := range nonEmpty(statements) {
+			Expect(r.Apply(st)).To(Succeed(), st)
+		}
+		return r.Schema
+	}
+
+	diff := func(expected, actual string) (lines []string) {
+		for _, d := range DiffSchemas(replay(expected), replay(actual)) {
+			lines = append(lines, d.String())
+		}
+		return lines
+	}
+
+	It("Finds nothing when they match", func() {
+		schema := "CREATE TYPE address (street text, city text);" +
+			"CREATE TABLE team (org text, id int, name text, home frozen<address>, PRIMARY KEY (org, id)) WITH CLUSTERING ORDER BY (id DESC);" +
+			"CREATE INDEX team_name ON team (name);"
+		Expect(diff(schema, schema)).To(BeEmpty())
+	})
+
+	It("Finds missing and extra objects", func() {
+		Expect(diff(
+			"CREATE TABLE team (id int PRIMARY KEY, name text);CREATE TABLE player (id int PRIMARY KEY);CREATE TYPE address (street text);",
+			"CREATE TABLE team (id int PRIMARY KEY, nickname text);CREATE TABLE league (id int PRIMARY KEY);CREATE INDEX team_nickname ON team (nickname);",
+		)).To(Equal([]string{
+			"type mystack.address is missing",
+			"table mystack.league isn't in the migrations",
+			"table mystack.player is missing",
+			"column mystack.team.name is missing",
+			"column mystack.team.nickname isn't in the migrations",
+			"index mystack.team_nickname isn't in the migrations",
+		}))
+	})
+
+	It("Finds changed types and keys", func() {
+		Expect(diff(
+			"CREATE TABLE team (org text, id int, name text, tags set<text>, PRIMARY KEY (org, id));",
+			"CREATE TABLE team (org text, id bigint, name text static, tags SET<TEXT>, PRIMARY KEY (org, id)) WITH CLUSTERING ORDER BY (id DESC);",
+		)).To(Equal([]string{
+			"column mystack.team.id: type is bigint, the migrations say int",
+			"column mystack.team.name: static is true, the migrations say false",
+			"table mystack.team: primary key is ((org), id DESC), the migrations say ((org), id ASC)",
+		}))
+	})
+
+	It("Only compares the options the migrations set", func() {
+		live := NewSchema()
+		live.Keyspaces["mystack"] = NewKeyspace("mystack")
+		live.Keyspaces["mystack"].Tables["team"] = &Table{Keyspace: "mystack", Name: "team",
+			Columns: []*Column{{Name: "id", Type: "int", Kind: PartitionKeyColumn}},
+			Options: map[string]string{
+				"compaction":          "{'class': 'org.apache.cassandra.db.compaction.LeveledCompactionStrategy', 'max_threshold': '32'}",
+				"gc_grace_seconds":    "864000",
+				"bloom_filter_chance": "0.01",
+			}}
+
+		same := replay("CREATE TABLE team (id int PRIMARY KEY) WITH compaction = {'class': 'LeveledCompactionStrategy'} AND gc_grace_seconds = 864000;")
+		Expect(DiffSchemas(same, live)).To(BeEmpty())
+
+		changed := replay("CREATE TABLE team (id int PRIMARY KEY) WITH compaction = {'class': 'SizeTieredCompactionStrategy'} AND default_time_to_live = 60;")
+		var lines []string
+		for _, d := range DiffSchemas(changed, live) {
+			lines = append(lines, d.String())
+		}
+		Expect(lines).To(Equal([]string{
+			"table mystack.team: option compaction is {'class': 'org.apache.cassandra.db.compaction.LeveledCompactionStrategy', 'max_threshold': '32'}, the migrations say {'class': 'SizeTieredCompactionStrategy'}",
+			"table mystack.team: option default_time_to_live is unset, the migrations say 60",
+		}))
+	})
+
+	It("Ignores the history tables and reports missing keyspaces", func() {
+		expected := replay("CREATE TABLE team (id int PRIMARY KEY);CREATE KEYSPACE reporting WITH replication = {'class': 'SimpleStrategy', 'replication_factor': 1};")
+		actual := replay("CREATE TABLE team (id int PRIMARY KEY);" + createSchemaVersionCQL + ";" + createCheckpointCQL + ";")
+		Expect(DiffSchemas(expected, actual)).To(Equal([]*SchemaDifference{{Kind: MissingObject, Object: "keyspace", Name: "reporting"}}))
+	})
+
+	It("Replays the migrations that have been applied", func() {
+		create := tmp.migration("201501010600_create.all.cql", "CREATE TABLE team (id int PRIMARY KEY);\n")
+		add := tmp.migration("201501010700_add.all.cql", "ALTER TABLE team ADD name text;\n")
+		pending := tmp.migration("201501010800_pending.all.cql", "ALTER TABLE team ADD nickname text;\n")
+		other := tmp.migration("201501010650_other.prod.cql", "CREATE TABLE prod_only (id int PRIMARY KEY);\n")
+		views := tmp.migration("R__views.all.cql", "CREATE TABLE IF NOT EXISTS team_view (id int PRIMARY KEY);\n")
+		applied := Migrations{
+			{Version: create.Version, Name: create.Name, Environment: "all"},
+			{Version: add.Version, Name: add.Name, Environment: "all"},
+			{Version: other.Version, Name: other.Name, Environment: "prod"},
+			{Version: "R1", Name: views.Name, Environment: "all", Repeatable: true},
+		}
+
+		schema, err := AppliedSchema(Migrations{pending, views, add, create, other}, applied, "uat1", "mystack")
+		Expect(err).NotTo(HaveOccurred())
+		ks := schema.Keyspaces["mystack"]
+		Expect(sortedKeys(ks.Tables)).To(Equal([]string{"team", "team_view"}))
+		Expect(ks.Tables["team"].Column("name")).NotTo(BeNil())
+		Expect(ks.Tables["team"].Column("nickname")).To(BeNil())
+	})
+})
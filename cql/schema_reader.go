@@ -0,0 +1,557 @@
+package cql
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gocql/gocql"
+)
+
+//
+// Read the definition of a single table from the cluster's system schema tables. Both
+// the 3.x 'system_schema' keyspace and the older 'system.schema_columns' layout are
+// supported; we try the new one first and fall back if the cluster doesn't have it.
+//
+func ReadTable(session *gocql.Session, keyspace, name string) (*Table, error) {
+	table, err := readTable(session, keyspace, name)
+	if err != nil {
+		table, err = readLegacyTable(session, keyspace, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(table.Columns) == 0 {
+		return nil, missingTableError{keyspace, name}
+	}
+	return table, nil
+}
+
+//
+// A table that isn't there, as opposed to one we failed to read.
+//
+type missingTableError struct {
+	keyspace, name string
+}
+
+func (e missingTableError) Error() string {
+	return fmt.Sprintf("Table '%s.%s' does not exist", e.keyspace, e.name)
+}
+
+func isMissingTable(err error) bool {
+	_, missing := err.(missingTableError)
+	return missing
+}
+
+//
+// Names of all the tables in a keyspace.
+//
+func ReadTableNames(session *gocql.Session, keyspace string) (names []string, err error) {
+	iter := session.Query(`SELECT table_name FROM system_schema.tables WHERE keyspace_name = ?`, keyspace).Iter()
+	for name := ""; iter.Scan(&name); {
+		names = append(names, name)
+	}
+	if err = iter.Close(); err == nil {
+		return names, nil
+	}
+
+	names = nil
+	iter = session.Query(`SELECT columnfamily_name FROM system.schema_columnfamilies WHERE keyspace_name = ?`, keyspace).Iter()
+	for name := ""; iter.Scan(&name); {
+		names = append(names, name)
+	}
+	return names, iter.Close()
+}
+
+func readTable(session *gocql.Session, keyspace, name string) (*Table, error) {
+	table := &Table{Keyspace: keyspace, Name: name}
+
+	iter := session.Query(`SELECT column_name, type, kind, position, clustering_order
+	                         FROM system_schema.columns
+	                        WHERE keyspace_name = ? AND table_name = ?`, keyspace, name).Iter()
+
+	var colName, colType, kind, order string
+	var position int
+	for iter.Scan(&colName, &colType, &kind, &position, &order) {
+		c := &Column{Name: colName, Type: colType, Kind: columnKind(kind), Position: position}
+		if c.Kind == ClusteringColumn {
+			c.Order = strings.ToUpper(order)
+		}
+		table.Columns = append(table.Columns, c)
+	}
+	return table, iter.Close()
+}
+
+func readLegacyTable(session *gocql.Session, keyspace, name string) (*Table, error) {
+	table := &Table{Keyspace: keyspace, Name: name}
+
+	iter := session.Query(`SELECT column_name, validator, type, component_index
+	                         FROM system.schema_columns
+	                        WHERE keyspace_name = ? AND columnfamily_name = ?`, keyspace, name).Iter()
+
+	var colName, validator, kind string
+	var position int
+	for iter.Scan(&colName, &validator, &kind, &position) {
+		colType, reversed, err := LegacyTypeToCQL(validator)
+		if err != nil {
+			iter.Close()
+			return nil, fmt.Errorf("Column '%s' of '%s.%s': %s", colName, keyspace, name, err.Error())
+		}
+		c := &Column{Name: colName, Type: colType, Kind: columnKind(kind), Position: position}
+		if c.Kind == ClusteringColumn {
+			c.Order = "ASC"
+			if reversed {
+				c.Order = "DESC"
+			}
+		}
+		table.Columns = append(table.Columns, c)
+	}
+	return table, iter.Close()
+}
+
+func columnKind(kind string) ColumnKind {
+	switch kind {
+	case "partition_key":
+		return PartitionKeyColumn
+	case "clustering", "clustering_key":
+		return ClusteringColumn
+	case "static":
+		return StaticColumn
+	}
+	return RegularColumn
+}
+
+//
+// The partitioner the cluster was set up with (the bit after the last dot).
+//
+func readPartitioner(session *gocql.Session) (string, error) {
+	var partitioner string
+	if err := session.Query(`SELECT partitioner FROM system.local`).Scan(&partitioner); err != nil {
+		return "", err
+	}
+	return partitioner[strings.LastIndex(partitioner, ".")+1:], nil
+}
+
+//
+// A keyspace that isn't there, as opposed to one we failed to read.
+//
+type missingKeyspaceError string
+
+func (e missingKeyspaceError) Error() string {
+	return fmt.Sprintf("Keyspace '%s' does not exist", string(e))
+}
+
+//
+// Read the whole schema of each of 'keyspaces' from the cluster: their tables, types,
+// indexes, views and functions. Like ReadTable, this tries the 3.x system_schema tables
+// first and falls back on the older system.schema_* ones, which have no views (and whose
+// functions we don't read).
+//
+func ReadSchema(session *gocql.Session, keyspaces ...string) (*Schema, error) {
+	schema := NewSchema()
+	for _, name := range keyspaces {
+		ks, err := readKeyspace(session, name)
+		if _, missing := err.(missingKeyspaceError); err != nil && !missing {
+			ks, err = readLegacyKeyspace(session, name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		schema.Keyspaces[name] = ks
+	}
+	return schema, nil
+}
+
+func readKeyspace(session *gocql.Session, name string) (*Keyspace, error) {
+	var durable bool
+	var replication map[string]string
+	err := session.Query(`SELECT durable_writes, replication FROM system_schema.keyspaces WHERE keyspace_name = ?`,
+		name).Scan(&durable, &replication)
+	if err == gocql.ErrNotFound {
+		return nil, missingKeyspaceError(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ks := NewKeyspace(name)
+	ks.Options["replication"] = mapLiteral(replication)
+	ks.Options["durable_writes"] = strconv.FormatBool(durable)
+
+	// Views have their columns in here too.
+	columns := map[string][]*Column{}
+	iter := session.Query(`SELECT table_name, column_name, type, kind, position, clustering_order
+	                         FROM system_schema.columns
+	                        WHERE keyspace_name = ?`, name).Iter()
+	var table, colName, colType, kind, order string
+	var position int
+	for iter.Scan(&table, &colName, &colType, &kind, &position, &order) {
+		c := &Column{Name: colName, Type: colType, Kind: columnKind(kind), Position: position}
+		if c.Kind == ClusteringColumn {
+			c.Order = strings.ToUpper(order)
+		}
+		columns[table] = append(columns[table], c)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	rows, err := session.Query(`SELECT * FROM system_schema.tables WHERE keyspace_name = ?`, name).Iter().SliceMap()
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		t := &Table{Keyspace: name, Name: stringValue(row, "table_name"), Options: tableOptions(row)}
+		t.Columns = columns[t.Name]
+		flags, _ := row["flags"].([]string)
+		t.CompactStorage = compactStorage(flags)
+		ks.Tables[t.Name] = t
+	}
+
+	iter = session.Query(`SELECT type_name, field_names, field_types FROM system_schema.types WHERE keyspace_name = ?`, name).Iter()
+	var typeName string
+	var fieldNames, fieldTypes []string
+	for iter.Scan(&typeName, &fieldNames, &fieldTypes) {
+		ks.Types[typeName] = userType(name, typeName, fieldNames, fieldTypes)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	iter = session.Query(`SELECT table_name, index_name, kind, options FROM system_schema.indexes WHERE keyspace_name = ?`, name).Iter()
+	var indexName, indexKind string
+	var indexOptions map[string]string
+	for iter.Scan(&table, &indexName, &indexKind, &indexOptions) {
+		ks.Indexes[indexName] = index(name, table, indexName, indexKind == "CUSTOM", indexOptions)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	rows, err = session.Query(`SELECT * FROM system_schema.views WHERE keyspace_name = ?`, name).Iter().SliceMap()
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		v := &View{
+			Keyspace:  name,
+			Name:      stringValue(row, "view_name"),
+			BaseTable: stringValue(row, "base_table_name"),
+			Where:     stringValue(row, "where_clause"),
+			Options:   tableOptions(row),
+		}
+		v.IncludeAll, _ = row["include_all_columns"].(bool)
+		v.Columns = columns[v.Name]
+		ks.Views[v.Name] = v
+	}
+
+	if err := readFunctions(session, ks); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+func readFunctions(session *gocql.Session, ks *Keyspace) error {
+	iter := session.Query(`SELECT function_name, argument_names, argument_types, called_on_null_input, language, return_type, body
+	                         FROM system_schema.functions
+	                        WHERE keyspace_name = ?`, ks.Name).Iter()
+	var name, language, returnType, body string
+	var argNames, argTypes []string
+	var calledOnNull bool
+	for iter.Scan(&name, &argNames, &argTypes, &calledOnNull, &language, &returnType, &body) {
+		f := &Function{Keyspace: ks.Name, Name: name, Arguments: argTypes}
+		f.Body = functionBody(argNames, argTypes, calledOnNull, returnType, language, body)
+		ks.Functions[f.Signature()] = f
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	iter = session.Query(`SELECT aggregate_name, argument_types, state_func, state_type, final_func, initcond
+	                        FROM system_schema.aggregates
+	                       WHERE keyspace_name = ?`, ks.Name).Iter()
+	var stateFunc, stateType, finalFunc, initCond string
+	for iter.Scan(&name, &argTypes, &stateFunc, &stateType, &finalFunc, &initCond) {
+		f := &Function{Keyspace: ks.Name, Name: name, Aggregate: true, Arguments: argTypes}
+		f.Body = aggregateBody(argTypes, stateFunc, stateType, finalFunc, initCond)
+		ks.Functions[f.Signature()] = f
+	}
+	return iter.Close()
+}
+
+func readLegacyKeyspace(session *gocql.Session, name string) (*Keyspace, error) {
+	var durable bool
+	var strategy, strategyOptions string
+	err := session.Query(`SELECT durable_writes, strategy_class, strategy_options FROM system.schema_keyspaces WHERE keyspace_name = ?`,
+		name).Scan(&durable, &strategy, &strategyOptions)
+	if err == gocql.ErrNotFound {
+		return nil, missingKeyspaceError(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ks := NewKeyspace(name)
+	replication, _ := jsonStringMap(strategyOptions)
+	replication["class"] = strategy
+	ks.Options["replication"] = mapLiteral(replication)
+	ks.Options["durable_writes"] = strconv.FormatBool(durable)
+
+	// Indexes are kept with the column they're on.
+	columns := map[string][]*Column{}
+	iter := session.Query(`SELECT columnfamily_name, column_name, validator, type, component_index, index_name, index_type, index_options
+	                         FROM system.schema_columns
+	                        WHERE keyspace_name = ?`, name).Iter()
+	var table, colName, validator, kind, indexName, indexType, indexOptions string
+	var position int
+	for iter.Scan(&table, &colName, &validator, &kind, &position, &indexName, &indexType, &indexOptions) {
+		colType, reversed, err := LegacyTypeToCQL(validator)
+		if err != nil {
+			iter.Close()
+			return nil, fmt.Errorf("Column '%s' of '%s.%s': %s", colName, name, table, err.Error())
+		}
+		c := &Column{Name: colName, Type: colType, Kind: columnKind(kind), Position: position}
+		if c.Kind == ClusteringColumn {
+			c.Order = "ASC"
+			if reversed {
+				c.Order = "DESC"
+			}
+		}
+		columns[table] = append(columns[table], c)
+		if indexName != "" {
+			ks.Indexes[indexName] = legacyIndex(name, table, colName, indexName, indexType, indexOptions)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	rows, err := session.Query(`SELECT * FROM system.schema_columnfamilies WHERE keyspace_name = ?`, name).Iter().SliceMap()
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		t := &Table{Keyspace: name, Name: stringValue(row, "columnfamily_name"), Options: legacyTableOptions(row)}
+		t.Columns = columns[t.Name]
+		t.CompactStorage, _ = row["is_dense"].(bool)
+		ks.Tables[t.Name] = t
+	}
+
+	// 2.0 has no user types, or a table to keep them in, so a failure here just means
+	// there aren't any.
+	iter = session.Query(`SELECT type_name, field_names, field_types FROM system.schema_usertypes WHERE keyspace_name = ?`, name).Iter()
+	var typeName string
+	var fieldNames, fieldTypes []string
+	for iter.Scan(&typeName, &fieldNames, &fieldTypes) {
+		for i, validator := range fieldTypes {
+			if fieldTypes[i], _, err = LegacyTypeToCQL(validator); err != nil {
+				iter.Close()
+				return nil, fmt.Errorf("Field '%s' of type '%s.%s': %s", fieldNames[i], name, typeName, err.Error())
+			}
+		}
+		ks.Types[typeName] = userType(name, typeName, fieldNames, fieldTypes)
+	}
+	iter.Close()
+	return ks, nil
+}
+
+func stringValue(row map[string]interface{}, name string) string {
+	s, _ := row[name].(string)
+	return s
+}
+
+// Columns of system_schema.tables and views which aren't options in a WITH clause.
+var notTableOptions = map[string]bool{
+	"keyspace_name": true, "table_name": true, "view_name": true, "id": true, "flags": true,
+	"base_table_id": true, "base_table_name": true, "include_all_columns": true, "where_clause": true,
+	"extensions": true,
+}
+
+//
+// The options of a table or view, from its row of system_schema.tables or views, as
+// CQL literals.
+//
+func tableOptions(row map[string]interface{}) map[string]string {
+	options := map[string]string{}
+	for name, v := range row {
+		if notTableOptions[name] {
+			continue
+		}
+		if literal, ok := optionLiteral(v); ok {
+			options[name] = literal
+		}
+	}
+	return options
+}
+
+func optionLiteral(v interface{}) (string, bool) {
+	switch val := v.(type) {
+	case string:
+		return quoteString(val), true
+	case bool:
+		return strconv.FormatBool(val), true
+	case int:
+		return strconv.Itoa(val), true
+	case int64:
+		return strconv.FormatInt(val, 10), true
+	case float32:
+		return strconv.FormatFloat(float64(val), 'f', -1, 32), true
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64), true
+	case map[string]string:
+		return mapLiteral(val), true
+	}
+	return "", false
+}
+
+// Pre-3.0 table options kept as they are, by their old names and the ones CQL uses.
+var legacyOptionNames = map[string]string{
+	"bloom_filter_fp_chance":      "bloom_filter_fp_chance",
+	"comment":                     "comment",
+	"default_time_to_live":        "default_time_to_live",
+	"gc_grace_seconds":            "gc_grace_seconds",
+	"local_read_repair_chance":    "dclocal_read_repair_chance",
+	"max_index_interval":          "max_index_interval",
+	"memtable_flush_period_in_ms": "memtable_flush_period_in_ms",
+	"min_index_interval":          "min_index_interval",
+	"read_repair_chance":          "read_repair_chance",
+	"speculative_retry":           "speculative_retry",
+}
+
+//
+// The options of a table from its row of system.schema_columnfamilies. Caching,
+// compaction and compression are kept there as JSON.
+//
+func legacyTableOptions(row map[string]interface{}) map[string]string {
+	options := map[string]string{}
+	for old, name := range legacyOptionNames {
+		if literal, ok := optionLiteral(row[old]); ok {
+			options[name] = literal
+		}
+	}
+	if caching := stringValue(row, "caching"); caching != "" {
+		if m, ok := jsonStringMap(caching); ok {
+			options["caching"] = mapLiteral(m)
+		} else {
+			options["caching"] = quoteString(caching)
+		}
+	}
+	if class := stringValue(row, "compaction_strategy_class"); class != "" {
+		compaction, _ := jsonStringMap(stringValue(row, "compaction_strategy_options"))
+		compaction["class"] = class
+		options["compaction"] = mapLiteral(compaction)
+	}
+	if compression, ok := jsonStringMap(stringValue(row, "compression_parameters")); ok {
+		options["compression"] = mapLiteral(compression)
+	}
+	return options
+}
+
+//
+// A JSON object as a map of strings. Always returns a map, even if 's' isn't one.
+//
+func jsonStringMap(s string) (map[string]string, bool) {
+	var decoded map[string]interface{}
+	m := map[string]string{}
+	if err := json.Unmarshal([]byte(s), &decoded); err != nil || decoded == nil {
+		return m, false
+	}
+	for k, v := range decoded {
+		m[k] = fmt.Sprint(v)
+	}
+	return m, true
+}
+
+//
+// 3.x flags a table as 'compound' unless it was created WITH COMPACT STORAGE, and
+// 'dense' if it was and has clustering columns.
+//
+func compactStorage(flags []string) bool {
+	compound, dense := false, false
+	for _, f := range flags {
+		compound = compound || f == "compound"
+		dense = dense || f == "dense" || f == "super"
+	}
+	return dense || !compound
+}
+
+func userType(keyspace, name string, fieldNames, fieldTypes []string) *UserType {
+	t := &UserType{Keyspace: keyspace, Name: name}
+	for i := range fieldNames {
+		if i < len(fieldTypes) {
+			t.Fields = append(t.Fields, &Field{Name: fieldNames[i], Type: fieldTypes[i]})
+		}
+	}
+	return t
+}
+
+//
+// An index from system_schema.indexes. Its options include what it's on and, for custom
+// indexes, the class; the rest are the options it was created with.
+//
+func index(keyspace, table, name string, custom bool, options map[string]string) *Index {
+	ix := &Index{Keyspace: keyspace, Name: name, Table: table, Target: options["target"]}
+	if !custom {
+		return ix
+	}
+	ix.Class = options["class_name"]
+	for k, v := range options {
+		if k != "target" && k != "class_name" {
+			if ix.Options == nil {
+				ix.Options = map[string]string{}
+			}
+			ix.Options[k] = v
+		}
+	}
+	return ix
+}
+
+//
+// An index from its column's row of system.schema_columns, where its options (JSON) say
+// which part of a collection is indexed and, for custom indexes, the class.
+//
+func legacyIndex(keyspace, table, column, name, kind, jsonOptions string) *Index {
+	options, _ := jsonStringMap(jsonOptions)
+	target := quoteIdent(column)
+	if _, ok := options["index_keys"]; ok {
+		target = "keys(" + target + ")"
+	} else if _, ok := options["index_keys_and_values"]; ok {
+		target = "entries(" + target + ")"
+	}
+	delete(options, "index_keys")
+	delete(options, "index_keys_and_values")
+	options["target"] = target
+	return index(keyspace, table, name, kind == "CUSTOM", options)
+}
+
+//
+// What follows a function's name in the CREATE FUNCTION statement for it, the way
+// SchemaReplay keeps it.
+//
+func functionBody(argNames, argTypes []string, calledOnNull bool, returnType, language, body string) string {
+	args := make([]string, len(argTypes))
+	for i, t := range argTypes {
+		args[i] = t
+		if i < len(argNames) {
+			args[i] = quoteIdent(argNames[i]) + " " + t
+		}
+	}
+	onNull := "RETURNS NULL ON NULL INPUT"
+	if calledOnNull {
+		onNull = "CALLED ON NULL INPUT"
+	}
+	return fmt.Sprintf("(%s) %s RETURNS %s LANGUAGE %s AS %s", strings.Join(args, ", "), onNull, returnType, language, quoteString(body))
+}
+
+//
+// What follows an aggregate's name in the CREATE AGGREGATE statement for it.
+//
+func aggregateBody(argTypes []string, stateFunc, stateType, finalFunc, initCond string) string {
+	body := fmt.Sprintf("(%s) SFUNC %s STYPE %s", strings.Join(argTypes, ", "), quoteIdent(stateFunc), stateType)
+	if finalFunc != "" {
+		body += " FINALFUNC " + quoteIdent(finalFunc)
+	}
+	if initCond != "" {
+		body += " INITCOND " + initCond
+	}
+	return body
+}
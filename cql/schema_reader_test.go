@@ -0,0 +1,76 @@
+package cql
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Schema Reader", func() {
+
+	It("Turns a system_schema.tables row into table options", func() {
+		options := tableOptions(map[string]interface{}{
+			"keyspace_name":          "mystack",
+			"table_name":             "team",
+			"flags":                  []string{"compound"},
+			"extensions":             map[string][]byte{},
+			"bloom_filter_fp_chance": 0.01,
+			"comment":                "It's a team",
+			"gc_grace_seconds":       864000,
+			"compaction":             map[string]string{"class": "org.apache.cassandra.db.compaction.SizeTieredCompactionStrategy"},
+		})
+		Expect(options).To(Equal(map[string]string{
+			"bloom_filter_fp_chance": "0.01",
+			"comment":                "'It''s a team'",
+			"gc_grace_seconds":       "864000",
+			"compaction":             "{'class': 'org.apache.cassandra.db.compaction.SizeTieredCompactionStrategy'}",
+		}))
+	})
+
+	It("Turns a system.schema_columnfamilies row into table options", func() {
+		options := legacyTableOptions(map[string]interface{}{
+			"keyspace_name":               "mystack",
+			"columnfamily_name":           "team",
+			"local_read_repair_chance":    0.1,
+			"default_time_to_live":        0,
+			"caching":                     `{"keys":"ALL", "rows_per_partition":"NONE"}`,
+			"compaction_strategy_class":   "org.apache.cassandra.db.compaction.LeveledCompactionStrategy",
+			"compaction_strategy_options": `{"sstable_size_in_mb":"160"}`,
+			"compression_parameters":      `{"sstable_compression":"org.apache.cassandra.io.compress.LZ4Compressor"}`,
+		})
+		Expect(options).To(Equal(map[string]string{
+			"dclocal_read_repair_chance": "0.1",
+			"default_time_to_live":       "0",
+			"caching":                    "{'keys': 'ALL', 'rows_per_partition': 'NONE'}",
+			"compaction":                 "{'class': 'org.apache.cassandra.db.compaction.LeveledCompactionStrategy', 'sstable_size_in_mb': '160'}",
+			"compression":                "{'sstable_compression': 'org.apache.cassandra.io.compress.LZ4Compressor'}",
+		}))
+		Expect(legacyTableOptions(map[string]interface{}{"caching": "KEYS_ONLY"})).To(Equal(map[string]string{"caching": "'KEYS_ONLY'"}))
+	})
+
+	It("Knows which tables have compact storage", func() {
+		Expect(compactStorage([]string{"compound"})).To(BeFalse())
+		Expect(compactStorage([]string{"compound", "dense"})).To(BeTrue())
+		Expect(compactStorage([]string{})).To(BeTrue())
+	})
+
+	It("Reads indexes", func() {
+		Expect(index("mystack", "team", "team_name", false, map[string]string{"target": "name"})).To(Equal(
+			&Index{Keyspace: "mystack", Name: "team_name", Table: "team", Target: "name"}))
+		Expect(index("mystack", "team", "team_search", true, map[string]string{"target": "name", "class_name": "org.example.Search", "mode": "CONTAINS"})).To(Equal(
+			&Index{Keyspace: "mystack", Name: "team_search", Table: "team", Target: "name", Class: "org.example.Search", Options: map[string]string{"mode": "CONTAINS"}}))
+
+		Expect(legacyIndex("mystack", "team", "Attributes", "team_attrs", "COMPOSITES", `{"index_keys": ""}`)).To(Equal(
+			&Index{Keyspace: "mystack", Name: "team_attrs", Table: "team", Target: `keys("Attributes")`}))
+		Expect(legacyIndex("mystack", "team", "name", "team_name", "KEYS", "").Target).To(Equal("name"))
+	})
+
+	It("Writes functions and aggregates the way a replay keeps them", func() {
+		replay := NewSchemaReplay("mystack")
+		Expect(replay.Apply(`CREATE FUNCTION plus (a int, b int) CALLED ON NULL INPUT RETURNS int LANGUAGE java AS 'return a + b;'`)).To(Succeed())
+		Expect(replay.Apply(`CREATE AGGREGATE total (int) SFUNC plus STYPE int INITCOND 0`)).To(Succeed())
+		functions := replay.Schema.Keyspaces["mystack"].Functions
+
+		Expect(functionBody([]string{"a", "b"}, []string{"int", "int"}, true, "int", "java", "return a + b;")).To(Equal(functions["plus(int, int)"].Body))
+		Expect(aggregateBody([]string{"int"}, "plus", "int", "", "0")).To(Equal(functions["total(int)"].Body))
+	})
+})
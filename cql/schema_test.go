@@ -0,0 +1,36 @@
+package cql
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Schema Model", func() {
+
+	table := &Table{Keyspace: "mystack", Name: "events", Columns: []*Column{
+		{Name: "payload", Type: "text", Kind: RegularColumn},
+		{Name: "at", Type: "timestamp", Kind: ClusteringColumn, Position: 0, Order: "DESC"},
+		{Name: "bucket", Type: "int", Kind: PartitionKeyColumn, Position: 1},
+		{Name: "user", Type: "uuid", Kind: PartitionKeyColumn, Position: 0},
+		{Name: "Owner", Type: "text", Kind: StaticColumn},
+	}}
+
+	It("should order the primary key columns", func() {
+		names := []string{}
+		for _, c := range table.PrimaryKey() {
+			names = append(names, c.Name)
+		}
+		Expect(names).To(Equal([]string{"user", "bucket", "at"}))
+	})
+
+	It("should produce CQL to create the table", func() {
+		Expect(table.CreateCQL()).To(Equal(`CREATE TABLE mystack.events (
+    user uuid,
+    bucket int,
+    at timestamp,
+    "Owner" text static,
+    payload text,
+    PRIMARY KEY ((user, bucket), at)
+) WITH CLUSTERING ORDER BY (at DESC)`))
+	})
+})
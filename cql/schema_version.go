@@ -0,0 +1,225 @@
+package cql
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Kinds of row in the schema_version table.
+const (
+	VersionedKind  = "versioned"
+	RepeatableKind = "repeatable"
+	BaselineKind   = "baseline"
+	SnapshotKind   = "snapshot"
+)
+
+//
+// Is 'name' one of the tables we keep the history in, rather than one of the keyspace's?
+//
+func isHistoryTable(name string) bool {
+	return name == "schema_version" || name == "schema_version_checkpoint"
+}
+
+const createSchemaVersionCQL = `CREATE TABLE IF NOT EXISTS schema_version(
+                    applied timestamp,
+                    environment text,
+                    name text,
+                    checksum blob,
+                    user text,
+                    version text,
+                    kind text,
+                    description text,
+                    author text,
+                    tags set<text>,
+                    rows bigint,
+                    PRIMARY KEY (name, version)) WITH CLUSTERING ORDER BY (version ASC)`
+
+//
+// The token ranges each backfill has finished, so an interrupted one can pick up where
+// it left off. A backfill's rows are removed once it has been applied.
+//
+const createCheckpointCQL = `CREATE TABLE IF NOT EXISTS schema_version_checkpoint(
+                    migration text,
+                    range_start bigint,
+                    range_end bigint,
+                    checksum blob,
+                    rows bigint,
+                    completed timestamp,
+                    PRIMARY KEY (migration, range_start))`
+
+//
+// Columns added to schema_version since it was first created. Tables created by older
+// versions of this tool get them added by InitSchemaVersion.
+//
+var addedSchemaVersionColumns = []*Column{
+	{Name: "kind", Type: "text"},
+	{Name: "description", Type: "text"},
+	{Name: "author", Type: "text"},
+	{Name: "tags", Type: "set<text>"},
+	{Name: "rows", Type: "bigint"},
+}
+
+//
+// Create the schema_version (and checkpoint) table if it doesn't exist and add any
+// columns it is missing if it does.
+//
+func InitSchemaVersion(session *gocql.Session, keyspace string) error {
+	if err := session.Query(createSchemaVersionCQL).Exec(); err != nil {
+		return err
+	}
+	if err := session.Query(createCheckpointCQL).Exec(); err != nil {
+		return err
+	}
+
+	table, err := ReadTable(session, keyspace, "schema_version")
+	if err != nil {
+		return err
+	}
+	for _, st := range historyColumnsCQL(table) {
+		if err := session.Query(st).Exec(); err != nil {
+			return fmt.Errorf("Failed to update schema_version: '%s': %s", st, err.Error())
+		}
+	}
+	return nil
+}
+
+//
+// The schema_version table as it is in 'keyspace' or, if there isn't one yet, as
+// InitSchemaVersion would create it.
+//
+func ReadHistoryTable(session *gocql.Session, keyspace string) (*Table, error) {
+	table, err := ReadTable(session, keyspace, "schema_version")
+	if !isMissingTable(err) {
+		return table, err
+	}
+	r := NewSchemaReplay(keyspace)
+	if err := r.Apply(createSchemaVersionCQL); err != nil {
+		return nil, err
+	}
+	return r.Schema.Keyspace(keyspace).Tables["schema_version"], nil
+}
+
+//
+// The statements adding the columns 'history' (a schema_version table) is missing, or
+// all of them if it is nil and we can't tell.
+//
+func historyColumnsCQL(history *Table) (statements []string) {
+	for _, c := range addedSchemaVersionColumns {
+		if history == nil || history.Column(c.Name) == nil {
+			statements = append(statements, fmt.Sprintf("ALTER TABLE schema_version ADD %s %s", c.Name, c.Type))
+		}
+	}
+	return statements
+}
+
+//
+// Pull out all of the Migrations that the schema_version table knows about. Rows are
+// read as maps so that tables which haven't had the newer columns added yet can still
+// be read. A keyspace without the table has had nothing applied, but failing to read it
+// is an error: carrying on as if the history were empty could re-run or baseline
+// everything.
+//
+func ListAppliedMigrations(session *gocql.Session) (applied Migrations, err error) {
+	iter := session.Query(`SELECT * FROM schema_version`).Iter()
+
+	for row := map[string]interface{}{}; iter.MapScan(row); row = map[string]interface{}{} {
+		applied = append(applied, migrationFromRow(row))
+	}
+	if err := iter.Close(); err != nil {
+		if isMissingHistory(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed to read schema_version: %s", err.Error())
+	}
+	return applied, nil
+}
+
+//
+// Is 'err' Cassandra telling us schema_version hasn't been created?
+//
+func isMissingHistory(err error) bool {
+	reqErr, ok := err.(gocql.RequestError)
+	if !ok || reqErr.Code() != invalidRequestCode {
+		return false
+	}
+	msg := strings.ToLower(reqErr.Message())
+	return strings.Contains(msg, "unconfigured") || strings.Contains(msg, "does not exist")
+}
+
+// The protocol's error code for an invalid request, which is what a missing table is.
+const invalidRequestCode = 0x2200
+
+func migrationFromRow(row map[string]interface{}) *Migration {
+	m := &Migration{}
+	m.Applied, _ = row["applied"].(time.Time)
+	m.Environment, _ = row["environment"].(string)
+	m.Sum, _ = row["checksum"].([]byte)
+	m.Name, _ = row["name"].(string)
+	m.User, _ = row["user"].(string)
+	m.Version, _ = row["version"].(string)
+	m.Description, _ = row["description"].(string)
+	m.Author, _ = row["author"].(string)
+	m.Tags, _ = row["tags"].([]string)
+	m.Rows, _ = row["rows"].(int64)
+
+	kind, _ := row["kind"].(string)
+	m.Repeatable = kind == RepeatableKind
+	m.Baselined = kind == BaselineKind
+	m.Snapshot = kind == SnapshotKind
+	return m
+}
+
+//
+// How a row came to be in schema_version, for display.
+//
+func (m *Migration) Kind() string {
+	switch {
+	case m.Repeatable:
+		return RepeatableKind
+	case m.Baselined:
+		return BaselineKind
+	case m.Snapshot:
+		return SnapshotKind
+	}
+	return VersionedKind
+}
+
+//
+// The version recorded for a run of a repeatable migration. Each run gets its own row
+// so the version is just when it ran; the 'R' keeps them clear of real versions.
+//
+func repeatableRunVersion(t time.Time) string {
+	return "R" + t.UTC().Format("20060102150405.000000")
+}
+
+//
+// The ranges of the backfill 'm' that are done, and how many rows each had. Ranges
+// checkpointed by a different version of the migration don't count.
+//
+func readCheckpoints(session *gocql.Session, m *Migration) (map[TokenRange]int64, error) {
+	done := map[TokenRange]int64{}
+	iter := session.Query(`SELECT range_start, range_end, checksum, rows FROM schema_version_checkpoint WHERE migration = ?`,
+		m.Key()).Iter()
+	var r TokenRange
+	var sum []byte
+	var rows int64
+	for iter.Scan(&r.Start, &r.End, &sum, &rows) {
+		if bytes.Equal(sum, m.Sum) {
+			done[r] = rows
+		}
+	}
+	return done, iter.Close()
+}
+
+func saveCheckpoint(session *gocql.Session, m *Migration, r TokenRange, rows int64) error {
+	return session.Query(`INSERT INTO schema_version_checkpoint (migration, range_start, range_end, checksum, rows, completed)
+			VALUES (?, ?, ?, ?, ?, ?)`, m.Key(), r.Start, r.End, m.Sum, rows, time.Now()).Exec()
+}
+
+func clearCheckpoints(session *gocql.Session, m *Migration) error {
+	return session.Query(`DELETE FROM schema_version_checkpoint WHERE migration = ?`, m.Key()).Exec()
+}
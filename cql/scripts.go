@@ -0,0 +1,135 @@
+package cql
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+//
+// The directories (and archives) migrations are read from, with any patterns expanded.
+// A pattern which matches nothing is an error; it's more likely a typo than intended.
+//
+func (s *Scripts) Dirs() ([]string, error) {
+	paths := s.Paths
+	if len(paths) == 0 {
+		paths = []string{s.Path}
+	}
+
+	var dirs []string
+	seen := map[string]bool{}
+	for _, p := range paths {
+		matches := []string{p}
+		if isGlob(p) {
+			var err error
+			if matches, err = filepath.Glob(p); err != nil {
+				return nil, fmt.Errorf("Bad scripts path '%s': %s", p, err.Error())
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("Scripts path '%s' doesn't match anything", p)
+			}
+		}
+		for _, m := range matches {
+			if clean := filepath.Clean(m); !seen[clean] {
+				seen[clean] = true
+				dirs = append(dirs, m)
+			}
+		}
+	}
+	return dirs, nil
+}
+
+//
+// The CQL migrations in all of the script directories, in the order they should be
+// applied.
+//
+func (s *Scripts) ListFiles() (Migrations, Errors) {
+	updates, errs := s.listFiles()
+	sort.Sort(updates)
+	return updates, checkVersions(updates, errs)
+}
+
+//
+// ListFiles plus the registered Go migrations, with their dependencies checked too.
+//
+func (s *Scripts) List() (Migrations, Errors) {
+	updates, errs := withRegistered(s.listFiles())
+	if _, err := OrderMigrations(updates); err != nil {
+		errs = append(errs, err)
+	}
+	return updates, checkVersions(updates, errs)
+}
+
+func (s *Scripts) listFiles() (updates Migrations, errs Errors) {
+	dirs, err := s.Dirs()
+	if err != nil {
+		return nil, Errors{err}
+	}
+	// Overlapping paths ("a" and "a/b" with Recursive set) mustn't list a file twice.
+	// Files in archives are named after the archive too, so are only ever the same as
+	// themselves.
+	seen := map[string]bool{}
+	for _, dir := range dirs {
+		found, dirErrs := ListMigrationTree(dir, s.Recursive)
+		for _, m := range found {
+			if !seen[filepath.Clean(m.File)] {
+				seen[filepath.Clean(m.File)] = true
+				updates = append(updates, m)
+			}
+			if m.envAnnotation != "" && s.config != nil {
+				if err := s.config.CheckTargetEnvironment(m.envAnnotation); err != nil {
+					errs = append(errs, fmt.Errorf("'%s': @env: %s", m.File, err.Error()))
+				}
+			}
+		}
+		errs = append(errs, dirErrs...)
+	}
+	return updates, errs
+}
+
+func checkVersions(updates Migrations, errs Errors) Errors {
+	errs = append(errs, FindDuplicateVersions(updates)...)
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+//
+// Check no two migrations which could both run in the same environment have the same
+// version. With migrations spread over several directories it's easy to end up with
+// two which were created in the same minute, and the order they'd be applied in would
+// be down to their names.
+//
+func FindDuplicateVersions(updates Migrations) (errs Errors) {
+	for i, a := range updates {
+		if b := updates[i+1:].SameVersion(a); b != nil {
+			errs = append(errs, fmt.Errorf("'%s' and '%s' have the same version '%s'", a.File, b.File, a.Version))
+		}
+	}
+	return errs
+}
+
+//
+// The first migration in the list with the same version as 'm' which could run in the
+// same environment, or nil if there isn't one.
+//
+func (s Migrations) SameVersion(m *Migration) *Migration {
+	if m.Repeatable || m.Snapshot {
+		return nil
+	}
+	for _, a := range s {
+		if a.Repeatable || a.Snapshot || CompareVersions(a.Version, m.Version) != 0 {
+			continue
+		}
+		if environmentsOverlap(a.environments(), m.environments()) {
+			return a
+		}
+	}
+	return nil
+}
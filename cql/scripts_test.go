@@ -0,0 +1,129 @@
+package cql
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Scripts", func() {
+
+	tmp := useTempDir()
+
+	files := func(updates Migrations) (names []string) {
+		for _, m := range updates {
+			rel, err := filepath.Rel(tmp.dir, m.File)
+			Expect(err).NotTo(HaveOccurred())
+			names = append(names, filepath.ToSlash(rel))
+		}
+		return names
+	}
+
+	BeforeEach(func() {
+		tmp.write("core/201501010600_init.all.cql", "CREATE TABLE team (id uuid PRIMARY KEY);\n")
+		tmp.write("core/2016/201601010600_add_name.all.cql", "ALTER TABLE team ADD name text;\n")
+		tmp.write("billing/201501020600_invoices.all.cql", "CREATE TABLE invoice (id uuid PRIMARY KEY);\n")
+		tmp.write("billing/201501030600_seed.uat1.cql", "INSERT INTO invoice (id) VALUES (uuid());\n")
+	})
+
+	It("Orders migrations from several directories by version", func() {
+		s := &Scripts{Paths: []string{filepath.Join(tmp.dir, "core"), filepath.Join(tmp.dir, "billing")}}
+		updates, errs := s.ListFiles()
+		Expect(errs).To(BeNil())
+		Expect(files(updates)).To(Equal([]string{
+			"core/201501010600_init.all.cql",
+			"billing/201501020600_invoices.all.cql",
+			"billing/201501030600_seed.uat1.cql",
+		}))
+	})
+
+	It("Descends into subdirectories if recursive", func() {
+		s := &Scripts{Path: filepath.Join(tmp.dir, "core"), Recursive: true}
+		updates, errs := s.ListFiles()
+		Expect(errs).To(BeNil())
+		Expect(files(updates)).To(Equal([]string{
+			"core/201501010600_init.all.cql",
+			"core/2016/201601010600_add_name.all.cql",
+		}))
+	})
+
+	It("Follows a symlink to the scripts directory", func() {
+		Expect(os.Symlink(filepath.Join(tmp.dir, "billing"), filepath.Join(tmp.dir, "linked"))).To(Succeed())
+		s := &Scripts{Path: filepath.Join(tmp.dir, "linked")}
+		updates, errs := s.ListFiles()
+		Expect(errs).To(BeNil())
+		Expect(files(updates)).To(Equal([]string{
+			"linked/201501020600_invoices.all.cql",
+			"linked/201501030600_seed.uat1.cql",
+		}))
+	})
+
+	It("Expands patterns and lists overlapping paths once", func() {
+		s := &Scripts{Paths: []string{filepath.Join(tmp.dir, "*"), filepath.Join(tmp.dir, "core", "2016")}, Recursive: true}
+		dirs, err := s.Dirs()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dirs).To(HaveLen(3))
+
+		updates, errs := s.ListFiles()
+		Expect(errs).To(BeNil())
+		Expect(updates).To(HaveLen(4))
+	})
+
+	It("Fails when a pattern matches nothing", func() {
+		s := &Scripts{Paths: []string{filepath.Join(tmp.dir, "nope-*")}}
+		_, errs := s.ListFiles()
+		Expect(errs).To(HaveLen(1))
+		Expect(errs[0].Error()).To(ContainSubstring("doesn't match anything"))
+	})
+
+	It("Names both files when two directories use the same version", func() {
+		tmp.write("billing/201501010600_payments.all.cql", "CREATE TABLE payment (id uuid PRIMARY KEY);\n")
+		s := &Scripts{Paths: []string{filepath.Join(tmp.dir, "core"), filepath.Join(tmp.dir, "billing")}}
+		_, errs := s.ListFiles()
+		Expect(errs).To(HaveLen(1))
+		Expect(errs[0].Error()).To(ContainSubstring("core/201501010600_init.all.cql"))
+		Expect(errs[0].Error()).To(ContainSubstring("billing/201501010600_payments.all.cql"))
+	})
+
+	It("Allows the same version for different environments", func() {
+		tmp.write("core/201501030600_seed.uat2.cql", "INSERT INTO team (id) VALUES (uuid());\n")
+		s := &Scripts{Paths: []string{filepath.Join(tmp.dir, "core"), filepath.Join(tmp.dir, "billing")}}
+		_, errs := s.ListFiles()
+		Expect(errs).To(BeNil())
+	})
+
+	It("Checks '@env' only narrows to environments in the config", func() {
+		tmp.write("core/201501040600_local.all.cql", "-- @env uat2\nSELECT * FROM team;\n")
+		conf := &MigrationConfig{Environments: map[string]Environment{"local": {}, "uat1": {}}}
+		conf.Scripts = Scripts{Path: filepath.Join(tmp.dir, "core"), config: conf}
+		_, errs := conf.Scripts.ListFiles()
+		Expect(errs).To(HaveLen(1))
+		Expect(errs[0].Error()).To(ContainSubstring("'uat2' is not an environment"))
+
+		conf.Environments["uat2"] = Environment{}
+		_, errs = conf.Scripts.ListFiles()
+		Expect(errs).To(BeNil())
+	})
+
+	It("Tells a file in an archive from one with the same name in a directory", func() {
+		buf := &bytes.Buffer{}
+		zw := zip.NewWriter(buf)
+		w, err := zw.Create("201501010600_init.all.cql")
+		Expect(err).NotTo(HaveOccurred())
+		w.Write([]byte("CREATE TABLE team (id uuid PRIMARY KEY);\n"))
+		Expect(zw.Close()).To(Succeed())
+		archive := filepath.Join(tmp.dir, "core.zip")
+		Expect(ioutil.WriteFile(archive, buf.Bytes(), 0644)).To(Succeed())
+
+		s := &Scripts{Paths: []string{filepath.Join(tmp.dir, "core"), archive}}
+		updates, errs := s.ListFiles()
+		Expect(updates).To(HaveLen(2))
+		Expect(errs).To(HaveLen(1))
+		Expect(errs[0].Error()).To(ContainSubstring("core.zip/201501010600_init.all.cql"))
+	})
+})
@@ -0,0 +1,196 @@
+package cql
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gocql/gocql"
+)
+
+//
+// Data migrations load a CSV or JSON lines file into a table rather than running CQL.
+// They're a migration file with no statements, just annotations:
+//
+//   -- @data teams.csv
+//   -- @table team
+//   -- @concurrency 8
+//   -- @batch-size 20
+//
+// The data file is found relative to the migration file. Its columns are matched up
+// with the table's by name and converted to the right types by reading the table's
+// definition from the cluster. Rows for the same partition are batched together (up to
+// @batch-size) and up to @concurrency batches are written at once.
+//
+const (
+	dataAnnotation        = "data"
+	tableAnnotation       = "table"
+	concurrencyAnnotation = "concurrency"
+	batchSizeAnnotation   = "batch-size"
+)
+
+//
+// Finish setting up a data migration once we know where its file lives: find the data
+// file and checksum it along with the migration, so editing either counts as a change.
+//
+func (m *Migration) loadDataFile(content []byte) error {
+	if m.Data == "" {
+		if m.Table != "" {
+			return fmt.Errorf("'%s' has '@table' but no '@data'", m.File)
+		}
+		return nil
+	}
+	if m.Table == "" {
+		return fmt.Errorf("'%s' has '@data' but no '@table' to load it into", m.File)
+	}
+	if _, err := DataFormatFromPath(m.Data); err != nil {
+		return err
+	}
+	if statements, err := ReadCQLFile(bytes.NewReader(content)); err != nil || len(nonEmpty(statements)) > 0 {
+		return fmt.Errorf("'%s' loads data, so it can't have statements of its own", m.File)
+	}
+
+	if m.FS != nil {
+		m.Data = path.Join(path.Dir(m.File), m.Data)
+	} else {
+		m.Data = filepath.Join(filepath.Dir(m.File), m.Data)
+	}
+	data, err := m.readData()
+	if err != nil {
+		return err
+	}
+	m.Sum, err = Checksum(RawSHA256Checksum, append(append([]byte{}, content...), data...))
+	return err
+}
+
+func nonEmpty(statements []string) (found []string) {
+	for _, st := range statements {
+		if strings.TrimSpace(st) != "" {
+			found = append(found, st)
+		}
+	}
+	return found
+}
+
+func (m *Migration) readData() ([]byte, error) {
+	if m.FS != nil {
+		return fs.ReadFile(m.FS, m.Data)
+	}
+	return ioutil.ReadFile(m.Data)
+}
+
+//
+// Load the migration's data file into its table, returning the number of rows written.
+//
+func (m *Migration) loadData(ctx context.Context, session *gocql.Session) (rows int64, err error) {
+	table, err := m.readTable(session, m.Table)
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := m.readData()
+	if err != nil {
+		return 0, err
+	}
+	format, err := DataFormatFromPath(m.Data)
+	if err != nil {
+		return 0, err
+	}
+	r, err := NewRowReader(format, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+
+	w := newParallelWriter(ctx, session, m.Concurrency, m.BatchSize)
+	w.consistency = m.Consistency
+	inserts := map[string]string{}
+	for {
+		row, readErr := r.Read()
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			w.Close()
+			return rows, fmt.Errorf("Failed to read row %d of '%s': %s", rows+1, m.Data, readErr.Error())
+		}
+
+		st, partition, rowErr := insertRow(table, row, inserts)
+		if rowErr != nil {
+			w.Close()
+			return rows, fmt.Errorf("Row %d of '%s': %s", rows+1, m.Data, rowErr.Error())
+		}
+		if err := w.Add(partition, st); err != nil {
+			w.Close()
+			return rows, err
+		}
+		rows++
+	}
+	if err := w.Close(); err != nil {
+		return rows, err
+	}
+	fmt.Printf("   Loaded %d rows into %s\n", rows, table.QualifiedName())
+	return rows, nil
+}
+
+//
+// Read the definition of the table 'ref' names, which is in the keyspace being migrated
+// unless it says otherwise.
+//
+func (m *Migration) readTable(session *gocql.Session, ref string) (*Table, error) {
+	keyspace, name := "", ref
+	if i := strings.Index(ref, "."); i >= 0 {
+		keyspace, name = ref[:i], ref[i+1:]
+	}
+	if keyspace == "" {
+		keyspace = m.Variables[keyspaceVariable]
+	}
+	if keyspace == "" {
+		return nil, fmt.Errorf("Don't know which keyspace table '%s' is in", ref)
+	}
+	return ReadTable(session, unquoteIdent(keyspace), unquoteIdent(name))
+}
+
+//
+// The INSERT for one row of a data file, and the partition it goes in. 'inserts' keeps
+// the CQL for each set of columns, since rows of a JSON file needn't all have the same.
+//
+func insertRow(table *Table, row map[string]interface{}, inserts map[string]string) (*boundStatement, string, error) {
+	names := sortedKeys(row)
+	columns := make([]*Column, len(names))
+	values := make([]interface{}, len(names))
+	byName := map[string]interface{}{}
+	for i, name := range names {
+		if columns[i] = table.Column(name); columns[i] == nil {
+			return nil, "", fmt.Errorf("%s has no column '%s'", table.QualifiedName(), name)
+		}
+		v, err := ConvertValue(columns[i].Type, row[name])
+		if err != nil {
+			return nil, "", fmt.Errorf("Column '%s': %s", name, err.Error())
+		}
+		values[i] = v
+		byName[name] = v
+	}
+
+	var partition []string
+	for _, c := range table.PrimaryKey() {
+		if byName[c.Name] == nil {
+			return nil, "", fmt.Errorf("No value for primary key column '%s'", c.Name)
+		}
+		if c.Kind == PartitionKeyColumn {
+			partition = append(partition, fmt.Sprint(byName[c.Name]))
+		}
+	}
+
+	key := strings.Join(names, ",")
+	if _, ok := inserts[key]; !ok {
+		markers := strings.TrimRight(strings.Repeat("?, ", len(columns)), ", ")
+		inserts[key] = fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table.QualifiedName(), quoteIdents(columns), markers)
+	}
+	return &boundStatement{cql: inserts[key], values: values}, strings.Join(partition, "\x00"), nil
+}
@@ -0,0 +1,102 @@
+package cql
+
+import (
+	"path/filepath"
+	"testing/fstest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Data Migrations", func() {
+
+	tmp := useTempDir()
+
+	const migration = "-- @data teams.csv\n-- @table mystack.team\n-- @concurrency 4\n-- @batch-size 10\n"
+
+	team := &Table{Keyspace: "mystack", Name: "team", Columns: []*Column{
+		{Name: "org", Type: "text", Kind: PartitionKeyColumn},
+		{Name: "id", Type: "int", Kind: ClusteringColumn},
+		{Name: "name", Type: "text", Kind: RegularColumn},
+		{Name: "tags", Type: "set<text>", Kind: RegularColumn},
+	}}
+
+	It("Reads the data file next to the migration", func() {
+		tmp.write("teams.csv", "org,id,name\npearson,1,Avengers\n")
+		m, err := MigrationFromFile(tmp.write("201501010600_seed_teams.uat1.cql", migration))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m.Data).To(Equal(filepath.Join(tmp.dir, "teams.csv")))
+		Expect(m.Table).To(Equal("mystack.team"))
+		Expect(m.Concurrency).To(Equal(4))
+		Expect(m.BatchSize).To(Equal(10))
+		Expect(ChecksumAlgorithm(m.Sum)).To(Equal(RawSHA256Checksum))
+	})
+
+	It("Counts a change to the data as a change to the migration", func() {
+		tmp.write("teams.csv", "org,id,name\npearson,1,Avengers\n")
+		m, err := MigrationFromFile(tmp.write("201501010600_seed_teams.uat1.cql", migration))
+		Expect(err).NotTo(HaveOccurred())
+
+		unchanged, err := m.VerifyChecksum(m.Sum)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unchanged).To(BeTrue())
+
+		tmp.write("teams.csv", "org,id,name\npearson,1,Defenders\n")
+		unchanged, err = m.VerifyChecksum(m.Sum)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unchanged).To(BeFalse())
+	})
+
+	It("Finds the data file in the same file system", func() {
+		fsys := fstest.MapFS{
+			"seed/201501010600_seed_teams.uat1.cql": {Data: []byte("-- @data teams.jsonl\n-- @table team\n")},
+			"seed/teams.jsonl":                      {Data: []byte(`{"org": "pearson", "id": 1}` + "\n")},
+		}
+		m, err := MigrationFromFS(fsys, "seed/201501010600_seed_teams.uat1.cql")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m.Data).To(Equal("seed/teams.jsonl"))
+	})
+
+	It("Needs both a data file and a table, and nothing else", func() {
+		tmp.write("teams.csv", "org,id\n")
+		for name, content := range map[string]string{
+			"201501010600_a.all.cql": "-- @data teams.csv\n",
+			"201501010601_b.all.cql": "-- @table team\n",
+			"201501010602_c.all.cql": "-- @data teams.txt\n-- @table team\n",
+			"201501010603_d.all.cql": migration + "INSERT INTO team (org, id) VALUES ('x', 1);\n",
+			"201501010604_e.all.cql": "-- @data missing.csv\n-- @table team\n",
+			"201501010605_f.all.cql": "-- @data teams.csv\n-- @table team\n-- @batch-size 0\n",
+		} {
+			_, err := MigrationFromFile(tmp.write(name, content))
+			Expect(err).To(HaveOccurred(), name)
+		}
+	})
+
+	It("Makes an INSERT for each row with values of the right types", func() {
+		inserts := map[string]string{}
+		st, partition, err := insertRow(team, map[string]interface{}{"org": "pearson", "id": "7", "tags": `["a","b"]`}, inserts)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(st.cql).To(Equal(`INSERT INTO mystack.team (id, org, tags) VALUES (?, ?, ?)`))
+		Expect(st.values[:2]).To(Equal([]interface{}{7, "pearson"}))
+		Expect(st.values[2]).To(ConsistOf("a", "b"))
+		Expect(partition).To(Equal("pearson"))
+
+		st2, _, err := insertRow(team, map[string]interface{}{"org": "pearson", "id": "8", "tags": ""}, inserts)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(st2.cql).To(Equal(st.cql))
+		Expect(inserts).To(HaveLen(1))
+	})
+
+	It("Rejects rows with unknown columns or no primary key", func() {
+		_, _, err := insertRow(team, map[string]interface{}{"org": "pearson", "id": "1", "colour": "red"}, map[string]string{})
+		Expect(err).To(MatchError(ContainSubstring("no column 'colour'")))
+
+		_, _, err = insertRow(team, map[string]interface{}{"org": "pearson", "id": ""}, map[string]string{})
+		Expect(err).To(MatchError(ContainSubstring("primary key column 'id'")))
+	})
+
+	It("Reads the row count back from the history", func() {
+		m := migrationFromRow(map[string]interface{}{"name": "seed_teams", "version": "201501010600", "rows": int64(42)})
+		Expect(m.Rows).To(Equal(int64(42)))
+	})
+})
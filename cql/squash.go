@@ -0,0 +1,295 @@
+package cql
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// Snapshots made by squashing are named 'B__<version>_<name>.<env>.cql'.
+	snapshotPrefix = "B__"
+	snapshotName   = "squashed"
+
+	// Header lines in a snapshot listing what it replaces: the key of each migration,
+	// followed by the key of the older snapshot which replaced it if it wasn't this one.
+	supersedesAnnotation = "-- @supersedes"
+)
+
+//
+// A migration replaced by a snapshot. Via is set when it was replaced by an older
+// snapshot which has itself been squashed since.
+//
+type Superseded struct {
+	Key string
+	Via string
+}
+
+//
+// The name of the migration as it appears in file names and the manifest, e.g.
+// '201501020600_create_table_team.all'.
+//
+func (m *Migration) Key() string {
+	return m.Version + "_" + m.Name + "." + m.Environment
+}
+
+//
+// Read the @supersedes lines from the top of a snapshot file.
+//
+func readSupersedes(content []byte) (supersedes []Superseded, err error) {
+	s := bufio.NewScanner(bytes.NewReader(content))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if !strings.HasPrefix(line, supersedesAnnotation+" ") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, supersedesAnnotation))
+		if len(fields) < 1 || len(fields) > 2 {
+			return nil, fmt.Errorf("Malformed '%s' line: %s", supersedesAnnotation, line)
+		}
+		sup := Superseded{Key: fields[0]}
+		if len(fields) == 2 {
+			sup.Via = fields[1]
+		}
+		supersedes = append(supersedes, sup)
+	}
+	if len(supersedes) == 0 {
+		return nil, fmt.Errorf("Snapshot has no '%s' lines", supersedesAnnotation)
+	}
+	return supersedes, s.Err()
+}
+
+//
+// The snapshot in the list which replaced 'm', or nil if nothing has.
+//
+func (s Migrations) SupersededBy(m *Migration) *Migration {
+	for _, snapshot := range s {
+		for _, sup := range snapshot.Supersedes {
+			if sup.Key == m.Key() {
+				return snapshot
+			}
+		}
+	}
+	return nil
+}
+
+type SnapshotState int
+
+const (
+	// Nothing the snapshot replaces has been applied, so it should be run.
+	SnapshotPending SnapshotState = iota
+
+	// Everything it replaces has been applied, so it only needs recording.
+	SnapshotSatisfied
+
+	// The snapshot itself is in the history.
+	SnapshotApplied
+)
+
+//
+// Work out what should happen to snapshot 'm' given the 'applied' history. A history
+// which has some, but not all, of what the snapshot replaces can't be brought up to
+// date from it; the original migrations are needed for that.
+//
+func (m *Migration) SnapshotState(applied Migrations) (SnapshotState, error) {
+	if applied.Contains(m) {
+		return SnapshotApplied, nil
+	}
+	history := map[string]bool{}
+	for _, a := range applied {
+		history[a.Key()] = true
+	}
+
+	// A migration is covered if it's in the history, or if it was a snapshot and
+	// everything that it replaced is.
+	children := map[string][]string{}
+	for _, sup := range m.Supersedes {
+		children[sup.Via] = append(children[sup.Via], sup.Key)
+	}
+	var covered func(key string) bool
+	covered = func(key string) bool {
+		if history[key] {
+			return true
+		}
+		if len(children[key]) == 0 {
+			return false
+		}
+		for _, child := range children[key] {
+			if !covered(child) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if covered("") {
+		return SnapshotSatisfied, nil
+	}
+	var found []string
+	for _, sup := range m.Supersedes {
+		if history[sup.Key] {
+			found = append(found, sup.Key)
+		}
+	}
+	if len(found) == 0 {
+		return SnapshotPending, nil
+	}
+	return SnapshotPending, fmt.Errorf("'%s' replaces migrations which have only partly been applied here (%s); apply the rest from the original files first",
+		m.File, strings.Join(found, ", "))
+}
+
+//
+// A plan for replacing the migrations up to a version with a single snapshot.
+//
+type Squash struct {
+	Through string
+
+	// The migrations being replaced. Environment specific ones are never squashed since
+	// the snapshot has to do for every environment.
+	Squashed Migrations
+
+	// Environment specific, data migrations and backfills up to the version, which stay
+	// as they are.
+	Kept Migrations
+
+	// Data changes which are left out because their table doesn't exist by the end.
+	Skipped []*Statement
+
+	Schema *Schema
+	CQL    []byte
+}
+
+//
+// Work out the snapshot for everything up to and including 'through'. The schema comes
+// from replaying the DDL of the migrations; their data changes (INSERTs and so on) are
+// kept, in order, after it.
+//
+func PlanSquash(updates Migrations, through string) (*Squash, error) {
+	sorted := make(Migrations, len(updates))
+	copy(sorted, updates)
+	sort.Sort(sorted)
+
+	sq := &Squash{Through: through}
+	found := false
+	for _, m := range sorted {
+		// Files which a snapshot has already replaced, but which were kept, are
+		// covered by the snapshot.
+		if m.Repeatable || CompareVersions(m.Version, through) > 0 || sorted.SupersededBy(m) != nil {
+			continue
+		}
+		if CompareVersions(m.Version, through) == 0 {
+			// Named after the migration, however 'through' was written.
+			sq.Through = m.Version
+			found = true
+		}
+		if m.environments() == "all" && m.Data == "" && m.Scan == "" {
+			sq.Squashed = append(sq.Squashed, m)
+		} else {
+			sq.Kept = append(sq.Kept, m)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("There is no migration with version '%s'", through)
+	}
+	if len(sq.Squashed) < 2 {
+		return nil, fmt.Errorf("Nothing to squash up to '%s'", through)
+	}
+
+	r := NewSchemaReplay("")
+	var data []*Statement
+	for _, m := range sq.Squashed {
+		if m.Template {
+			return nil, fmt.Errorf("'%s' is a template, so it can't go in a snapshot for every environment", m.File)
+		}
+		if err := r.ApplyMigration(m); err != nil {
+			return nil, err
+		}
+		statements, err := m.Statements()
+		if err != nil {
+			return nil, err
+		}
+		for _, st := range statements {
+			if st.Kind == DMLStatement {
+				data = append(data, st)
+			}
+		}
+	}
+	sq.Schema = r.Schema
+
+	var kept []*Statement
+	for _, st := range data {
+		if ks, ok := sq.Schema.Keyspaces[st.Keyspace]; st.Object != "" && (!ok || ks.Tables[st.Object] == nil) {
+			sq.Skipped = append(sq.Skipped, st)
+			continue
+		}
+		kept = append(kept, st)
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "-- Snapshot of %d migrations up to and including %s, generated by 'squash'.\n", len(sq.Squashed), through)
+	fmt.Fprintf(buf, "-- Empty keyspaces get this instead of them; where they've all been applied it is\n")
+	fmt.Fprintf(buf, "-- just recorded. Leave the @supersedes lines alone.\n")
+	for _, sup := range sq.supersedes() {
+		fmt.Fprintf(buf, "%s %s", supersedesAnnotation, sup.Key)
+		if sup.Via != "" {
+			fmt.Fprintf(buf, " %s", sup.Via)
+		}
+		fmt.Fprintln(buf)
+	}
+	for _, st := range sq.Schema.CQL() {
+		fmt.Fprintf(buf, "\n%s;\n", st)
+	}
+	for _, st := range kept {
+		fmt.Fprintf(buf, "\n%s;\n", st.Text)
+	}
+	sq.CQL = buf.Bytes()
+	return sq, nil
+}
+
+//
+// Everything the new snapshot replaces. Anything an older snapshot replaced is kept,
+// marked as going via it, so histories which started from that snapshot still count.
+//
+func (sq *Squash) supersedes() (supersedes []Superseded) {
+	for _, m := range sq.Squashed {
+		for _, sup := range m.Supersedes {
+			if sup.Via == "" {
+				sup.Via = m.Key()
+			}
+			supersedes = append(supersedes, sup)
+		}
+		supersedes = append(supersedes, Superseded{Key: m.Key()})
+	}
+	return supersedes
+}
+
+func (sq *Squash) FileName() string {
+	return snapshotPrefix + sq.Through + "_" + snapshotName + ".all.cql"
+}
+
+//
+// Write the snapshot into 'dir' and, unless 'keep' is set, delete the files it
+// replaces.
+//
+func (sq *Squash) Write(dir string, keep bool) (*Migration, error) {
+	path := filepath.Join(dir, sq.FileName())
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("'%s' already exists", path)
+	}
+	if err := ioutil.WriteFile(path, sq.CQL, 0644); err != nil {
+		return nil, err
+	}
+	if !keep {
+		for _, m := range sq.Squashed {
+			if err := os.Remove(m.File); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return MigrationFromFile(path)
+}
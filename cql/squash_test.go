@@ -0,0 +1,141 @@
+package cql
+
+import (
+	"path/filepath"
+	"sort"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Squashing", func() {
+
+	tmp := useTempDir()
+
+	list := func() Migrations {
+		updates, errs := ListMigrationFiles(tmp.dir)
+		Expect(errs).To(BeNil())
+		sort.Sort(updates)
+		return updates
+	}
+
+	BeforeEach(func() {
+		tmp.write("201501010600_init.all.cql", "CREATE TABLE team (id uuid PRIMARY KEY, name text);\nCREATE TABLE old (id int PRIMARY KEY);\n")
+		tmp.write("201501020600_seed.uat1.cql", "INSERT INTO team (id, name) VALUES (uuid(), 'uat');\n")
+		tmp.write("201501030600_more.all.cql", "ALTER TABLE team ADD size int;\nINSERT INTO team (id, name) VALUES (uuid(), 'core');\nINSERT INTO old (id) VALUES (1);\nDROP TABLE old;\n")
+		tmp.write("201501040600_later.all.cql", "ALTER TABLE team ADD region text;\n")
+	})
+
+	It("should replace the migrations up to the version with a snapshot", func() {
+		sq, err := PlanSquash(list(), "201501030600")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(sq.Squashed)).To(Equal(2))
+		Expect(len(sq.Kept)).To(Equal(1))
+		Expect(len(sq.Skipped)).To(Equal(1))
+		Expect(sq.Skipped[0].Object).To(Equal("old"))
+
+		snapshot, err := sq.Write(tmp.dir, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(filepath.Base(snapshot.File)).To(Equal("B__201501030600_squashed.all.cql"))
+		Expect(snapshot.Snapshot).To(BeTrue())
+		Expect(snapshot.Version).To(Equal("201501030600"))
+		Expect(snapshot.Supersedes).To(Equal([]Superseded{{Key: "201501010600_init.all"}, {Key: "201501030600_more.all"}}))
+
+		statements, err := snapshot.Statements()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(statements)).To(Equal(2))
+		Expect(statements[0].Text).To(ContainSubstring("size int"))
+		Expect(statements[1].Text).To(ContainSubstring("'core'"))
+
+		// The snapshot goes first with whatever was left behind after it.
+		updates := list()
+		Expect(len(updates)).To(Equal(3))
+		Expect(updates[0].Snapshot).To(BeTrue())
+		Expect(updates[1].Name).To(Equal("seed"))
+	})
+
+	It("should squash an older snapshot again", func() {
+		sq, err := PlanSquash(list(), "201501030600")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = sq.Write(tmp.dir, false)
+		Expect(err).NotTo(HaveOccurred())
+
+		sq, err = PlanSquash(list(), "201501040600")
+		Expect(err).NotTo(HaveOccurred())
+		snapshot, err := sq.Write(tmp.dir, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(snapshot.Supersedes).To(Equal([]Superseded{
+			{Key: "201501010600_init.all", Via: "201501030600_squashed.all"},
+			{Key: "201501030600_more.all", Via: "201501030600_squashed.all"},
+			{Key: "201501030600_squashed.all"},
+			{Key: "201501040600_later.all"},
+		}))
+
+		// Histories from before either snapshot, and from the first one, both count.
+		applied := Migrations{
+			{Name: "init", Version: "201501010600", Environment: "all"},
+			{Name: "more", Version: "201501030600", Environment: "all"},
+			{Name: "later", Version: "201501040600", Environment: "all"},
+		}
+		state, err := snapshot.SnapshotState(applied)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(state).To(Equal(SnapshotSatisfied))
+
+		state, err = snapshot.SnapshotState(Migrations{
+			{Name: "squashed", Version: "201501030600", Environment: "all"},
+			{Name: "later", Version: "201501040600", Environment: "all"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(state).To(Equal(SnapshotSatisfied))
+	})
+
+	It("should work out what to do with a snapshot", func() {
+		sq, _ := PlanSquash(list(), "201501030600")
+		snapshot, err := sq.Write(tmp.dir, true)
+		Expect(err).NotTo(HaveOccurred())
+
+		state, err := snapshot.SnapshotState(nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(state).To(Equal(SnapshotPending))
+
+		_, err = snapshot.SnapshotState(Migrations{{Name: "init", Version: "201501010600", Environment: "all"}})
+		Expect(err).To(MatchError(ContainSubstring("only partly been applied")))
+
+		state, _ = snapshot.SnapshotState(Migrations{snapshot})
+		Expect(state).To(Equal(SnapshotApplied))
+
+		// The originals were kept, but they're covered by the snapshot now.
+		updates := list()
+		Expect(len(updates)).To(Equal(5))
+		Expect(updates.SupersededBy(updates[1])).To(Equal(updates[0]))
+		Expect(updates.SupersededBy(updates[len(updates)-1])).To(BeNil())
+	})
+
+	It("should round trip snapshots through the manifest", func() {
+		sq, _ := PlanSquash(list(), "201501030600")
+		_, err := sq.Write(tmp.dir, false)
+		Expect(err).NotTo(HaveOccurred())
+
+		path := filepath.Join(tmp.dir, ManifestFileName)
+		Expect(BuildManifest(list()).Write(path)).To(Succeed())
+		manifest, err := ReadManifest(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(manifest[0].Snapshot).To(BeTrue())
+		Expect(manifest[0].Version).To(Equal("201501030600"))
+		Expect(manifest.Verify(list())).To(BeNil())
+	})
+
+	It("should take the through version in the 'utc' form", func() {
+		sq, err := PlanSquash(list(), "20150103060000")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sq.Squashed).NotTo(BeEmpty())
+		Expect(sq.Through).To(Equal("201501030600"))
+	})
+
+	It("should refuse versions it can't squash to", func() {
+		_, err := PlanSquash(list(), "201501030601")
+		Expect(err).To(HaveOccurred())
+		_, err = PlanSquash(list(), "201501010600")
+		Expect(err).To(MatchError(ContainSubstring("Nothing to squash")))
+	})
+})
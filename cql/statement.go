@@ -0,0 +1,373 @@
+package cql
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type StatementKind int
+
+const (
+	OtherStatement StatementKind = iota
+	DDLStatement
+	DMLStatement
+)
+
+func (k StatementKind) String() string {
+	switch k {
+	case DDLStatement:
+		return "ddl"
+	case DMLStatement:
+		return "dml"
+	}
+	return "other"
+}
+
+//
+// A single CQL statement along with what we could work out about it without having
+// to write a full blown parser. Operation is the leading keywords, normalised to upper
+// case (e.g. "CREATE TABLE", "ALTER TABLE", "INSERT"), and Keyspace/Object name the
+// thing being operated on where we can find it.
+//
+type Statement struct {
+	Text        string
+	Kind        StatementKind
+	Operation   string
+	Keyspace    string
+	Object      string
+	Columns     []string // Columns dropped by an ALTER TABLE ... DROP.
+	Destructive bool
+}
+
+//
+// Work out what kind of statement 'text' is and whether running it would throw data
+// away. Statements we don't recognise are classed as OtherStatement and are never
+// considered destructive.
+//
+func ClassifyStatement(text string) *Statement {
+	st := &Statement{Text: strings.TrimSpace(text)}
+	toks := tokenize(st.Text)
+	if len(toks) == 0 {
+		return st
+	}
+
+	p := &tokenParser{toks: toks}
+	switch {
+	case p.accept("CREATE"):
+		st.Kind = DDLStatement
+		p.accept("OR", "REPLACE")
+		p.accept("CUSTOM")
+		st.Operation = "CREATE " + p.objectType()
+		if st.Operation == "CREATE INDEX" {
+			p.ifExists()
+			if !p.peek("ON") {
+				p.next()
+			}
+			p.accept("ON")
+		}
+		p.ifExists()
+		st.Keyspace, st.Object = p.qualifiedName()
+
+	case p.accept("ALTER"):
+		st.Kind = DDLStatement
+		st.Operation = "ALTER " + p.objectType()
+		p.ifExists()
+		st.Keyspace, st.Object = p.qualifiedName()
+		// DROP COMPACT STORAGE changes how the table is stored, but keeps every column.
+		if st.Operation == "ALTER TABLE" && p.accept("DROP") && !p.peek("COMPACT", "STORAGE") {
+			st.Columns = p.identList()
+			st.Destructive = true
+		}
+
+	case p.accept("DROP"):
+		st.Kind = DDLStatement
+		st.Operation = "DROP " + p.objectType()
+		p.ifExists()
+		st.Keyspace, st.Object = p.qualifiedName()
+		switch st.Operation {
+		case "DROP TABLE", "DROP KEYSPACE":
+			st.Destructive = true
+		}
+
+	case p.accept("TRUNCATE"):
+		st.Kind = DDLStatement
+		st.Operation = "TRUNCATE"
+		p.accept("TABLE")
+		p.accept("COLUMNFAMILY")
+		st.Keyspace, st.Object = p.qualifiedName()
+		st.Destructive = true
+
+	case p.accept("INSERT"):
+		st.Kind = DMLStatement
+		st.Operation = "INSERT"
+		p.accept("INTO")
+		st.Keyspace, st.Object = p.qualifiedName()
+
+	case p.accept("UPDATE"):
+		st.Kind = DMLStatement
+		st.Operation = "UPDATE"
+		st.Keyspace, st.Object = p.qualifiedName()
+
+	case p.accept("DELETE"):
+		st.Kind = DMLStatement
+		st.Operation = "DELETE"
+		for !p.done() && !p.accept("FROM") {
+			p.next()
+		}
+		st.Keyspace, st.Object = p.qualifiedName()
+
+	case p.accept("BEGIN"):
+		st.Kind = DMLStatement
+		st.Operation = "BATCH"
+
+	default:
+		st.Operation = strings.ToUpper(p.next().text)
+	}
+	return st
+}
+
+//
+// Short, single line version of the statement suitable for printing in a list.
+//
+func (st *Statement) Summary() string {
+	summary := strings.Join(strings.Fields(st.Text), " ")
+	if len(summary) > 100 {
+		summary = summary[:97] + "..."
+	}
+	return summary
+}
+
+type tokenKind int
+
+const (
+	identToken tokenKind = iota
+	quotedIdentToken
+	stringToken
+	numberToken
+	punctToken
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+//
+// Is this token the (case insensitive) keyword 'word'?
+//
+func (t token) is(word string) bool {
+	return t.kind == identToken && strings.EqualFold(t.text, word)
+}
+
+//
+// The name this token refers to. Unquoted identifiers are case insensitive in CQL so
+// they are folded to lower case; quoted ones are kept as they are.
+//
+func (t token) name() string {
+	if t.kind == identToken {
+		return strings.ToLower(t.text)
+	}
+	return t.text
+}
+
+//
+// The token as it would be written in CQL, quotes and all.
+//
+func (t token) literal() string {
+	switch t.kind {
+	case stringToken:
+		return "'" + strings.Replace(t.text, "'", "''", -1) + "'"
+	case quotedIdentToken:
+		return "\"" + strings.Replace(t.text, "\"", "\"\"", -1) + "\""
+	}
+	return t.text
+}
+
+//
+// Break a single (comment free) CQL statement up into tokens. String literals and
+// quoted identifiers are returned without their quotes.
+//
+func tokenize(text string) (toks []token) {
+	for i := 0; i < len(text); {
+		r, width := utf8.DecodeRuneInString(text[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += width
+
+		case r == '\'' || r == '"':
+			val, n := readQuoted(text[i:], byte(r))
+			kind := stringToken
+			if r == '"' {
+				kind = quotedIdentToken
+			}
+			toks = append(toks, token{kind: kind, text: val})
+			i += n
+
+		case r == '$' && strings.HasPrefix(text[i:], "$$"):
+			end := strings.Index(text[i+2:], "$$")
+			if end < 0 {
+				toks = append(toks, token{kind: stringToken, text: text[i+2:]})
+				i = len(text)
+				continue
+			}
+			toks = append(toks, token{kind: stringToken, text: text[i+2 : i+2+end]})
+			i += end + 4
+
+		case unicode.IsLetter(r) || r == '_':
+			j := i
+			for j < len(text) {
+				r2, w2 := utf8.DecodeRuneInString(text[j:])
+				if !unicode.IsLetter(r2) && !unicode.IsDigit(r2) && r2 != '_' {
+					break
+				}
+				j += w2
+			}
+			toks = append(toks, token{kind: identToken, text: text[i:j]})
+			i = j
+
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(text) && text[i+1] >= '0' && text[i+1] <= '9'):
+			j := i + 1
+			for j < len(text) && strings.IndexByte("0123456789.eE+-abcdefABCDEFxX", text[j]) >= 0 {
+				j++
+			}
+			toks = append(toks, token{kind: numberToken, text: text[i:j]})
+			i = j
+
+		default:
+			toks = append(toks, token{kind: punctToken, text: text[i : i+width]})
+			i += width
+		}
+	}
+	return toks
+}
+
+//
+// Read a quoted string or identifier starting at text[0]. A doubled quote character
+// is an escaped quote. Returns the unquoted value and the number of bytes consumed.
+//
+func readQuoted(text string, quote byte) (string, int) {
+	var buf []byte
+	i := 1
+	for i < len(text) {
+		if text[i] == quote {
+			if i+1 < len(text) && text[i+1] == quote {
+				buf = append(buf, quote)
+				i += 2
+				continue
+			}
+			return string(buf), i + 1
+		}
+		buf = append(buf, text[i])
+		i++
+	}
+	return string(buf), i
+}
+
+type tokenParser struct {
+	toks []token
+	pos  int
+}
+
+func (p *tokenParser) done() bool {
+	return p.pos >= len(p.toks)
+}
+
+func (p *tokenParser) next() token {
+	if p.done() {
+		return token{kind: punctToken}
+	}
+	t := p.toks[p.pos]
+	p.pos++
+	return t
+}
+
+//
+// Does the upcoming run of tokens match the keywords 'words'?
+//
+func (p *tokenParser) peek(words ...string) bool {
+	if p.pos+len(words) > len(p.toks) {
+		return false
+	}
+	for i, w := range words {
+		if !p.toks[p.pos+i].is(w) {
+			return false
+		}
+	}
+	return true
+}
+
+//
+// Consume the keywords 'words' if they are next, reporting whether they were.
+//
+func (p *tokenParser) accept(words ...string) bool {
+	if p.peek(words...) {
+		p.pos += len(words)
+		return true
+	}
+	return false
+}
+
+func (p *tokenParser) acceptPunct(punct string) bool {
+	if !p.done() && p.toks[p.pos].kind == punctToken && p.toks[p.pos].text == punct {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *tokenParser) ifExists() {
+	p.accept("IF", "NOT", "EXISTS")
+	p.accept("IF", "EXISTS")
+}
+
+//
+// The type of schema object a CREATE/ALTER/DROP statement refers to. COLUMNFAMILY
+// is the old name for TABLE so we treat them as one and the same.
+//
+func (p *tokenParser) objectType() string {
+	if p.accept("MATERIALIZED", "VIEW") {
+		return "MATERIALIZED VIEW"
+	}
+	if p.accept("COLUMNFAMILY") {
+		return "TABLE"
+	}
+	if p.accept("SCHEMA") {
+		return "KEYSPACE"
+	}
+	return strings.ToUpper(p.next().text)
+}
+
+//
+// Read an optionally keyspace qualified name i.e: 'table' or 'keyspace.table'.
+//
+func (p *tokenParser) qualifiedName() (keyspace, name string) {
+	if p.done() {
+		return "", ""
+	}
+	name = p.next().name()
+	if p.acceptPunct(".") {
+		keyspace = name
+		name = p.next().name()
+	}
+	return keyspace, name
+}
+
+//
+// Read either a single identifier or a parenthesised, comma separated list of them.
+//
+func (p *tokenParser) identList() (names []string) {
+	if !p.acceptPunct("(") {
+		if !p.done() {
+			names = append(names, p.next().name())
+		}
+		return names
+	}
+	for !p.done() && !p.acceptPunct(")") {
+		if p.acceptPunct(",") {
+			continue
+		}
+		names = append(names, p.next().name())
+	}
+	return names
+}
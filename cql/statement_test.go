@@ -0,0 +1,105 @@
+package cql
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cassandra CQL Statements", func() {
+
+	Context("Classifying statements", func() {
+
+		It("should recognise DDL that doesn't lose data", func() {
+			st := ClassifyStatement("CREATE TABLE IF NOT EXISTS mystack.user (id uuid PRIMARY KEY)")
+			Expect(st.Kind).To(Equal(DDLStatement))
+			Expect(st.Operation).To(Equal("CREATE TABLE"))
+			Expect(st.Keyspace).To(Equal("mystack"))
+			Expect(st.Object).To(Equal("user"))
+			Expect(st.Destructive).To(BeFalse())
+
+			st = ClassifyStatement("create index if not exists network_region on network(region)")
+			Expect(st.Operation).To(Equal("CREATE INDEX"))
+			Expect(st.Object).To(Equal("network"))
+			Expect(st.Destructive).To(BeFalse())
+
+			st = ClassifyStatement("ALTER TABLE user ADD age int")
+			Expect(st.Operation).To(Equal("ALTER TABLE"))
+			Expect(st.Destructive).To(BeFalse())
+		})
+
+		It("should recognise DML", func() {
+			st := ClassifyStatement("INSERT INTO network (id, region) VALUES (uuid(), 'LO3')")
+			Expect(st.Kind).To(Equal(DMLStatement))
+			Expect(st.Object).To(Equal("network"))
+
+			st = ClassifyStatement("DELETE region FROM \"Network\" WHERE id = 1")
+			Expect(st.Kind).To(Equal(DMLStatement))
+			Expect(st.Object).To(Equal("Network"))
+		})
+
+		It("should flag destructive statements", func() {
+			for _, text := range []string{
+				"DROP TABLE user",
+				"drop columnfamily if exists mystack.user",
+				"DROP KEYSPACE mystack",
+				"TRUNCATE user",
+				"ALTER TABLE user DROP email",
+			} {
+				Expect(ClassifyStatement(text).Destructive).To(BeTrue(), text)
+			}
+			Expect(ClassifyStatement("DROP INDEX network_region").Destructive).To(BeFalse())
+
+			st := ClassifyStatement("ALTER TABLE user DROP COMPACT STORAGE")
+			Expect(st.Destructive).To(BeFalse())
+			Expect(st.Columns).To(BeEmpty())
+		})
+
+		It("should find the columns dropped by an ALTER TABLE", func() {
+			st := ClassifyStatement("ALTER TABLE mystack.user DROP (email, \"Teams\")")
+			Expect(st.Operation).To(Equal("ALTER TABLE"))
+			Expect(st.Object).To(Equal("user"))
+			Expect(st.Columns).To(Equal([]string{"email", "Teams"}))
+		})
+	})
+
+	Context("Guarding against destructive migrations", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "cassandra-migrate")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should list exactly which statements in which file are destructive", func() {
+			path := filepath.Join(dir, "201501020600_drop_team.all.cql")
+			Expect(ioutil.WriteFile(path, []byte("CREATE TABLE t (id int PRIMARY KEY);\nDROP TABLE team;\n"), 0644)).To(Succeed())
+
+			m, err := MigrationFromFile(path)
+			Expect(err).NotTo(HaveOccurred())
+
+			changes, errs := FindDestructiveChanges(Migrations{m})
+			Expect(errs).To(BeNil())
+			Expect(len(changes)).To(Equal(1))
+			Expect(changes[0].Statement.Operation).To(Equal("DROP TABLE"))
+			Expect(changes.Error()).To(ContainSubstring(path + ": DROP TABLE team"))
+		})
+
+		It("should find nothing destructive in the test migrations", func() {
+			updates, errs := ListMigrationFiles("../migrations/test")
+			Expect(errs).To(BeNil())
+
+			changes, errs := FindDestructiveChanges(updates)
+			Expect(errs).To(BeNil())
+			Expect(changes).To(BeEmpty())
+		})
+	})
+})
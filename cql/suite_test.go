@@ -1,7 +1,9 @@
 package cql
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	. "github.com/onsi/ginkgo"
@@ -17,3 +19,43 @@ func TestCassandraMigrate(t *testing.T) {
 		RunSpecs(t, "Cassandra CQL")
 	}
 }
+
+//
+// A directory for a test's files, made before each test in the enclosing Describe and
+// removed after it.
+//
+type tempDir struct {
+	dir string
+}
+
+func useTempDir() *tempDir {
+	t := &tempDir{}
+	BeforeEach(func() {
+		var err error
+		t.dir, err = ioutil.TempDir("", "cassandra-migrate")
+		Expect(err).NotTo(HaveOccurred())
+	})
+	AfterEach(func() {
+		os.RemoveAll(t.dir)
+	})
+	return t
+}
+
+//
+// Write a file (and the directories it's in) under the directory, returning its path.
+//
+func (t *tempDir) write(name, content string) string {
+	path := filepath.Join(t.dir, name)
+	Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+	Expect(ioutil.WriteFile(path, []byte(content), 0644)).To(Succeed())
+	return path
+}
+
+//
+// Write a migration file and read it back.
+//
+func (t *tempDir) migration(name, content string) *Migration {
+	m, err := MigrationFromFile(t.write(name, content))
+	Expect(err).NotTo(HaveOccurred())
+	return m
+}
@@ -0,0 +1,82 @@
+package cql
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+// Variables every template gets, whatever the environment defines.
+const (
+	keyspaceVariable    = "keyspace"
+	environmentVariable = "environment"
+)
+
+const templateAnnotation = "template"
+
+//
+// The variables for rendering templates in an environment: its own, plus the keyspace
+// and environment name.
+//
+func TemplateVariables(keyspace, env string, vars map[string]string) map[string]string {
+	all := map[string]string{}
+	for k, v := range vars {
+		all[k] = v
+	}
+	all[keyspaceVariable] = keyspace
+	all[environmentVariable] = env
+	return all
+}
+
+//
+// Give each of the template migrations in the list the variables to render it with.
+// Data migrations, backfills and parallel ones get them too, for the keyspace their
+// tables are in.
+//
+func (s Migrations) SetVariables(vars map[string]string) {
+	for _, m := range s {
+		if m.Template || m.Data != "" || m.Scan != "" || m.Parallel() {
+			m.Variables = vars
+		}
+	}
+}
+
+//
+// Render a migration file annotated '@template', e.g.
+//
+//   -- @template
+//   CREATE TABLE events (...) WITH default_time_to_live = {{ .ttl }};
+//
+// Using a variable that isn't defined is an error, not an empty string.
+//
+func (m *Migration) render(content []byte) ([]byte, error) {
+	if !m.Template {
+		return content, nil
+	}
+	if m.Variables == nil {
+		return nil, fmt.Errorf("'%s' is a template, and there's no environment to render it for", m.File)
+	}
+	tmpl, err := template.New(m.File).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, m.Variables); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//
+// The statements in the Migration's file, rendered if it's a template.
+//
+func (m *Migration) readCQL() ([]string, error) {
+	content, err := m.readFile()
+	if err != nil {
+		return nil, err
+	}
+	if content, err = m.render(content); err != nil {
+		return nil, err
+	}
+	return ReadCQLFile(bytes.NewReader(content))
+}
@@ -0,0 +1,82 @@
+package cql
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Templates", func() {
+
+	var dir string
+
+	const template = `-- @template
+CREATE TABLE {{ .keyspace }}.events (id uuid PRIMARY KEY, body text)
+    WITH default_time_to_live = {{ .ttl }};
+`
+
+	load := func(content string) *Migration {
+		path := filepath.Join(dir, "201501010600_create_events.all.cql")
+		Expect(ioutil.WriteFile(path, []byte(content), 0644)).To(Succeed())
+		m, err := MigrationFromFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		return m
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "cassandra-migrate")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("Renders with the environment's variables", func() {
+		m := load(template)
+		Expect(m.Template).To(BeTrue())
+		Migrations{m}.SetVariables(TemplateVariables("mystack", "prod", map[string]string{"ttl": "86400"}))
+
+		statements, err := m.Statements()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(statements).To(HaveLen(1))
+		Expect(statements[0].Text).To(ContainSubstring("CREATE TABLE mystack.events"))
+		Expect(statements[0].Text).To(ContainSubstring("default_time_to_live = 86400"))
+	})
+
+	It("Fails on undefined variables", func() {
+		m := load(template)
+		m.Variables = TemplateVariables("mystack", "prod", nil)
+		_, err := m.Statements()
+		Expect(err).To(MatchError(ContainSubstring("ttl")))
+	})
+
+	It("Fails when there's no environment to render for", func() {
+		_, err := load(template).Statements()
+		Expect(err).To(MatchError(ContainSubstring("is a template")))
+	})
+
+	It("Checksums the template rather than what it renders to", func() {
+		m := load(template)
+		m.Variables = TemplateVariables("mystack", "prod", map[string]string{"ttl": "86400"})
+		unchanged, err := m.VerifyChecksum(m.Sum)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unchanged).To(BeTrue())
+
+		m.Variables["ttl"] = "3600"
+		unchanged, err = m.VerifyChecksum(m.Sum)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unchanged).To(BeTrue())
+	})
+
+	It("Leaves files which aren't templates alone", func() {
+		m := load("INSERT INTO t (id, m) VALUES (1, {{1, 2}: 'x'});\n")
+		statements, err := m.Statements()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(statements[0].Text).To(ContainSubstring("{{1, 2}: 'x'}"))
+	})
+})
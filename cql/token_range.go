@@ -0,0 +1,175 @@
+package cql
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+
+	"github.com/gocql/gocql"
+)
+
+//
+// A range of the Murmur3 token ring, exclusive of Start and inclusive of End, which
+// is how Cassandra thinks about ranges too.
+//
+type TokenRange struct {
+	Start int64
+	End   int64
+}
+
+func (r TokenRange) String() string {
+	return fmt.Sprintf("(%d,%d]", r.Start, r.End)
+}
+
+//
+// Chop the whole Murmur3 token ring up into 'n' (roughly) equally sized ranges.
+//
+func SplitTokenRing(n int) []TokenRange {
+	if n < 1 {
+		n = 1
+	}
+	min := big.NewInt(math.MinInt64)
+	width := new(big.Int).Sub(big.NewInt(math.MaxInt64), min)
+	step := new(big.Int).Div(width, big.NewInt(int64(n)))
+
+	ranges := make([]TokenRange, n)
+	start := min
+	for i := 0; i < n; i++ {
+		end := new(big.Int).Add(start, step)
+		if i == n-1 {
+			end = big.NewInt(math.MaxInt64)
+		}
+		ranges[i] = TokenRange{Start: start.Int64(), End: end.Int64()}
+		start = end
+	}
+	return ranges
+}
+
+//
+// Page through every row of 'table', selecting just 'columns', one token range at a
+// time and call 'fn' with each row. A token range scan only makes sense for the Murmur3
+// partitioner so anything else gets a single full table scan (which gocql still pages
+// through for us), with no ranges to report done. 'done' is called as each range is
+// finished; it may be nil.
+//
+func scanTable(session *gocql.Session, table *Table, columns []*Column, ranges []TokenRange,
+	fn func(row map[string]interface{}) error, done func(r TokenRange) error) error {
+
+	selectCQL := fmt.Sprintf("SELECT %s FROM %s", quoteIdents(columns), table.QualifiedName())
+
+	byRange, err := scansByTokenRange(session)
+	if err != nil {
+		return err
+	}
+	if !byRange {
+		return scanRange(session.Query(selectCQL), fn)
+	}
+
+	token := fmt.Sprintf("token(%s)", quoteIdents(table.PartitionKey()))
+	rangeCQL := fmt.Sprintf("%s WHERE %s > ? AND %s <= ?", selectCQL, token, token)
+	for _, r := range ranges {
+		if err := scanRange(session.Query(rangeCQL, r.Start, r.End), fn); err != nil {
+			return fmt.Errorf("Scanning %s of %s: %s", r, table.QualifiedName(), err.Error())
+		}
+		if done != nil {
+			if err := done(r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//
+// Can the cluster's tables be scanned a token range at a time? Only if it uses the
+// Murmur3 partitioner.
+//
+func scansByTokenRange(session *gocql.Session) (bool, error) {
+	partitioner, err := readPartitioner(session)
+	if err != nil {
+		return false, fmt.Errorf("Failed to read the cluster's partitioner: %s", err.Error())
+	}
+	return partitioner == "Murmur3Partitioner", nil
+}
+
+func scanRange(query *gocql.Query, fn func(row map[string]interface{}) error) error {
+	iter := query.PageSize(1000).Iter()
+	for {
+		row := map[string]interface{}{}
+		for _, c := range iter.Columns() {
+			if c.TypeInfo.Type == gocql.TypeVarchar || c.TypeInfo.Type == gocql.TypeAscii {
+				row[c.Name] = &scannedText{}
+			}
+		}
+		if !iter.MapScan(row) {
+			break
+		}
+		for name, v := range row {
+			if t, ok := v.(scannedText); ok {
+				row[name] = t.Value()
+			}
+		}
+		if err := fn(row); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+//
+// A text column as it's scanned. gocql reads a null one as "", which would be written
+// back as '' rather than null.
+//
+type scannedText struct {
+	value string
+	null  bool
+}
+
+func (t *scannedText) UnmarshalCQL(info *gocql.TypeInfo, data []byte) error {
+	t.value, t.null = string(data), data == nil
+	return nil
+}
+
+func (t scannedText) Value() interface{} {
+	if t.null {
+		return nil
+	}
+	return t.value
+}
+
+//
+// Check that gocql knows how to read and write every column's type before we start
+// scanning since it will panic, rather than error, on the ones it doesn't.
+//
+func checkSupportedTypes(table *Table, columns []*Column) error {
+	var unsupported []string
+	for _, c := range columns {
+		t, err := ParseType(c.Type)
+		if err != nil || !isSupportedType(t) {
+			unsupported = append(unsupported, c.Name+" "+c.Type)
+		}
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("Unsupported column types in %s: %s", table.QualifiedName(), strings.Join(unsupported, ", "))
+	}
+	return nil
+}
+
+func isSupportedType(t *DataType) bool {
+	t = t.Unfrozen()
+	switch t.Name {
+	case "ascii", "text", "varchar", "inet", "bigint", "counter", "timestamp", "blob", "boolean",
+		"float", "double", "int", "decimal", "uuid", "timeuuid", "varint":
+		return true
+	case "list", "set", "map":
+		for _, p := range t.Params {
+			if !isSupportedType(p) {
+				return false
+			}
+		}
+		return len(t.Params) > 0
+	}
+	return false
+}
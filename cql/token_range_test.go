@@ -0,0 +1,43 @@
+package cql
+
+import (
+	"math"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Token Ranges", func() {
+
+	It("should cover the whole ring without gaps or overlaps", func() {
+		ranges := SplitTokenRing(16)
+		Expect(len(ranges)).To(Equal(16))
+		Expect(ranges[0].Start).To(Equal(int64(math.MinInt64)))
+		Expect(ranges[15].End).To(Equal(int64(math.MaxInt64)))
+		for i := 1; i < len(ranges); i++ {
+			Expect(ranges[i].Start).To(Equal(ranges[i-1].End))
+			Expect(ranges[i].End).To(BeNumerically(">", ranges[i].Start))
+		}
+	})
+
+	It("should always give at least one range", func() {
+		Expect(SplitTokenRing(0)).To(Equal([]TokenRange{{math.MinInt64, math.MaxInt64}}))
+	})
+
+	It("should refuse to scan types gocql can't handle", func() {
+		table := &Table{Name: "t", Columns: []*Column{
+			{Name: "id", Type: "uuid", Kind: PartitionKeyColumn},
+			{Name: "day", Type: "date"},
+		}}
+		Expect(checkSupportedTypes(table, table.Columns[:1])).To(Succeed())
+		Expect(checkSupportedTypes(table, table.Columns)).To(MatchError(ContainSubstring("day date")))
+	})
+
+	It("should read null text as nil and empty text as ''", func() {
+		null, empty := &scannedText{}, &scannedText{}
+		Expect(null.UnmarshalCQL(nil, nil)).To(Succeed())
+		Expect(empty.UnmarshalCQL(nil, []byte{})).To(Succeed())
+		Expect(null.Value()).To(BeNil())
+		Expect(empty.Value()).To(Equal(""))
+	})
+})
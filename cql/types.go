@@ -0,0 +1,243 @@
+package cql
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+//
+// A parsed CQL data type such as 'text', 'map<uuid, text>' or 'frozen<list<int>>'.
+// Name is always lower case; Params holds the element type(s) of collections and
+// frozen types, and the field types of tuples.
+//
+type DataType struct {
+	Name   string
+	Params []*DataType
+}
+
+//
+// Parse the CQL type 'text' as it would appear in a CREATE TABLE statement. Anything
+// we don't know about is kept by name (it's probably a user defined type).
+//
+func ParseType(text string) (*DataType, error) {
+	t, rest, err := parseType(strings.TrimSpace(text))
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(rest) != "" {
+		return nil, fmt.Errorf("Unexpected '%s' after type in '%s'", rest, text)
+	}
+	return t, nil
+}
+
+func parseType(text string) (*DataType, string, error) {
+	text = strings.TrimLeft(text, " \t\r\n")
+	end := strings.IndexAny(text, "<>, \t\r\n")
+	if end < 0 {
+		end = len(text)
+	}
+	if end == 0 {
+		return nil, text, fmt.Errorf("Expected a type name in '%s'", text)
+	}
+
+	t := &DataType{Name: strings.ToLower(text[:end])}
+	if strings.HasPrefix(text[:end], "\"") {
+		t.Name = strings.Trim(text[:end], "\"")
+	}
+	rest := strings.TrimLeft(text[end:], " \t\r\n")
+	if !strings.HasPrefix(rest, "<") {
+		return t, rest, nil
+	}
+
+	rest = rest[1:]
+	for {
+		param, r, err := parseType(rest)
+		if err != nil {
+			return nil, r, err
+		}
+		t.Params = append(t.Params, param)
+		rest = strings.TrimLeft(r, " \t\r\n")
+		switch {
+		case strings.HasPrefix(rest, ","):
+			rest = rest[1:]
+		case strings.HasPrefix(rest, ">"):
+			return t, rest[1:], nil
+		default:
+			return nil, rest, fmt.Errorf("Unterminated type parameters in '%s'", text)
+		}
+	}
+}
+
+//
+// Is this one of list, set or map?
+//
+func (t *DataType) IsCollection() bool {
+	switch t.Name {
+	case "list", "set", "map":
+		return true
+	}
+	return false
+}
+
+//
+// The type with any frozen<> wrapper taken off.
+//
+func (t *DataType) Unfrozen() *DataType {
+	for t.Name == "frozen" && len(t.Params) == 1 {
+		t = t.Params[0]
+	}
+	return t
+}
+
+//
+// Canonical CQL for the type, e.g. 'map<uuid, text>'.
+//
+func (t *DataType) String() string {
+	if len(t.Params) == 0 {
+		return t.Name
+	}
+	params := make([]string, len(t.Params))
+	for i, p := range t.Params {
+		params[i] = p.String()
+	}
+	return t.Name + "<" + strings.Join(params, ", ") + ">"
+}
+
+//
+// The names of any types within this one which aren't built in to CQL, i.e. the user
+// defined types it uses.
+//
+func (t *DataType) typeNames() (names []string) {
+	if len(t.Params) == 0 && !builtinTypes[t.Name] {
+		return []string{t.Name}
+	}
+	for _, p := range t.Params {
+		names = append(names, p.typeNames()...)
+	}
+	return names
+}
+
+var builtinTypes = map[string]bool{
+	"ascii": true, "bigint": true, "blob": true, "boolean": true, "counter": true,
+	"date": true, "decimal": true, "double": true, "duration": true, "float": true,
+	"inet": true, "int": true, "smallint": true, "text": true, "time": true,
+	"timestamp": true, "timeuuid": true, "tinyint": true, "uuid": true, "varchar": true,
+	"varint": true,
+}
+
+const legacyTypePrefix = "org.apache.cassandra.db.marshal."
+
+var legacyTypes = map[string]string{
+	"AsciiType":         "ascii",
+	"LongType":          "bigint",
+	"BytesType":         "blob",
+	"BooleanType":       "boolean",
+	"CounterColumnType": "counter",
+	"DecimalType":       "decimal",
+	"DoubleType":        "double",
+	"FloatType":         "float",
+	"InetAddressType":   "inet",
+	"Int32Type":         "int",
+	"ShortType":         "smallint",
+	"ByteType":          "tinyint",
+	"UTF8Type":          "text",
+	"TimestampType":     "timestamp",
+	"DateType":          "timestamp",
+	"SimpleDateType":    "date",
+	"TimeType":          "time",
+	"UUIDType":          "uuid",
+	"TimeUUIDType":      "timeuuid",
+	"IntegerType":       "varint",
+	"DurationType":      "duration",
+}
+
+//
+// Convert one of the Java class names that pre-3.0 Cassandra keeps in the system schema
+// tables (e.g. 'org.apache.cassandra.db.marshal.MapType(...UUIDType,...UTF8Type)') into
+// CQL. Reports whether the type was wrapped in a ReversedType (i.e. a DESC clustering
+// column).
+//
+func LegacyTypeToCQL(validator string) (cqlType string, reversed bool, err error) {
+	t, rest, err := parseLegacyType(validator)
+	if err != nil {
+		return "", false, err
+	}
+	if strings.TrimSpace(rest) != "" {
+		return "", false, fmt.Errorf("Unexpected '%s' after type in '%s'", rest, validator)
+	}
+	if t.Name == "reversed" {
+		return t.Params[0].String(), true, nil
+	}
+	return t.String(), false, nil
+}
+
+func parseLegacyType(text string) (*DataType, string, error) {
+	text = strings.TrimSpace(text)
+	end := strings.IndexAny(text, "(),")
+	if end < 0 {
+		end = len(text)
+	}
+	class := strings.TrimPrefix(text[:end], legacyTypePrefix)
+	rest := text[end:]
+
+	var params []*DataType
+	var raw []string
+	if strings.HasPrefix(rest, "(") {
+		rest = rest[1:]
+		for !strings.HasPrefix(rest, ")") {
+			// UserType parameters are a mix of hex encoded names and field:Type pairs.
+			// We only need the keyspace and name (the first two) so keep them raw.
+			if class == "UserType" && len(raw) < 2 {
+				n := strings.IndexAny(rest, ",)")
+				if n < 0 {
+					return nil, rest, fmt.Errorf("Unterminated type parameters in '%s'", text)
+				}
+				raw = append(raw, rest[:n])
+				rest = strings.TrimPrefix(rest[n:], ",")
+				continue
+			}
+			if i := strings.Index(rest, ":"); i >= 0 && i < strings.IndexAny(rest, "(),") {
+				rest = rest[i+1:]
+			}
+			p, r, err := parseLegacyType(rest)
+			if err != nil {
+				return nil, r, err
+			}
+			params = append(params, p)
+			rest = strings.TrimPrefix(strings.TrimSpace(r), ",")
+			if rest == "" {
+				return nil, rest, fmt.Errorf("Unterminated type parameters in '%s'", text)
+			}
+		}
+		rest = rest[1:]
+	}
+
+	switch class {
+	case "ReversedType":
+		return &DataType{Name: "reversed", Params: params}, rest, nil
+	case "FrozenType":
+		return &DataType{Name: "frozen", Params: params}, rest, nil
+	case "ListType":
+		return &DataType{Name: "list", Params: params}, rest, nil
+	case "SetType":
+		return &DataType{Name: "set", Params: params}, rest, nil
+	case "MapType":
+		return &DataType{Name: "map", Params: params}, rest, nil
+	case "TupleType":
+		return &DataType{Name: "tuple", Params: params}, rest, nil
+	case "UserType":
+		if len(raw) < 2 {
+			return nil, rest, fmt.Errorf("Malformed UserType in '%s'", text)
+		}
+		name, err := hex.DecodeString(raw[1])
+		if err != nil {
+			return nil, rest, fmt.Errorf("Malformed UserType name in '%s': %s", text, err.Error())
+		}
+		return &DataType{Name: string(name)}, rest, nil
+	}
+	if name, ok := legacyTypes[class]; ok {
+		return &DataType{Name: name}, rest, nil
+	}
+	return nil, rest, fmt.Errorf("Unknown Cassandra type '%s'", class)
+}
@@ -0,0 +1,65 @@
+package cql
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CQL Types", func() {
+
+	Context("Parsing CQL types", func() {
+		It("should parse simple and collection types", func() {
+			t, err := ParseType("TEXT")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(t.String()).To(Equal("text"))
+
+			t, err = ParseType("map< uuid,text >")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(t.Name).To(Equal("map"))
+			Expect(t.IsCollection()).To(BeTrue())
+			Expect(t.String()).To(Equal("map<uuid, text>"))
+
+			t, err = ParseType("frozen<list<set<int>>>")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(t.Unfrozen().String()).To(Equal("list<set<int>>"))
+		})
+
+		It("should reject rubbish", func() {
+			_, err := ParseType("map<uuid, text")
+			Expect(err).To(HaveOccurred())
+			_, err = ParseType("text text")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Converting pre-3.0 validator classes", func() {
+		It("should convert simple and collection types", func() {
+			t, reversed, err := LegacyTypeToCQL("org.apache.cassandra.db.marshal.UTF8Type")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(t).To(Equal("text"))
+			Expect(reversed).To(BeFalse())
+
+			t, _, err = LegacyTypeToCQL("org.apache.cassandra.db.marshal.MapType(org.apache.cassandra.db.marshal.UUIDType,org.apache.cassandra.db.marshal.UTF8Type)")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(t).To(Equal("map<uuid, text>"))
+		})
+
+		It("should spot reversed (DESC) clustering columns", func() {
+			t, reversed, err := LegacyTypeToCQL("org.apache.cassandra.db.marshal.ReversedType(org.apache.cassandra.db.marshal.TimestampType)")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(t).To(Equal("timestamp"))
+			Expect(reversed).To(BeTrue())
+		})
+
+		It("should name user defined types", func() {
+			t, _, err := LegacyTypeToCQL("org.apache.cassandra.db.marshal.FrozenType(org.apache.cassandra.db.marshal.UserType(mystack,61646472657373,737472656574:org.apache.cassandra.db.marshal.UTF8Type))")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(t).To(Equal("frozen<address>"))
+		})
+
+		It("should complain about types it doesn't know", func() {
+			_, _, err := LegacyTypeToCQL("org.apache.cassandra.db.marshal.MadeUpType")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,241 @@
+package cql
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"speter.net/go/exp/math/dec/inf"
+)
+
+//
+// Turn a value read by gocql into something encoding/json will write out in a form we
+// can read back: UUIDs, decimals and varints become strings, timestamps RFC 3339,
+// blobs '0x' prefixed hex, and map keys strings.
+//
+func ToJSONValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case gocql.UUID:
+		return val.String()
+	case time.Time:
+		if val.IsZero() {
+			return nil
+		}
+		return val.UTC().Format(time.RFC3339Nano)
+	case []byte:
+		if val == nil {
+			return nil
+		}
+		return "0x" + hex.EncodeToString(val)
+	case *inf.Dec:
+		if val == nil {
+			return nil
+		}
+		return val.String()
+	case *big.Int:
+		if val == nil {
+			return nil
+		}
+		return val.String()
+	case string, bool, int, int32, int64, float32, float64:
+		return val
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return nil
+		}
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			list[i] = ToJSONValue(rv.Index(i).Interface())
+		}
+		return list
+	case reflect.Map:
+		if rv.IsNil() {
+			return nil
+		}
+		m := make(map[string]interface{}, rv.Len())
+		for _, k := range rv.MapKeys() {
+			m[fmt.Sprint(ToJSONValue(k.Interface()))] = ToJSONValue(rv.MapIndex(k).Interface())
+		}
+		return m
+	}
+	return fmt.Sprint(v)
+}
+
+//
+// The reverse of ToJSONValue: convert 'raw', which is either something decoded from
+// JSON (with UseNumber) or a string from a CSV file, into a Go value gocql will bind
+// to a column of type 'cqlType'. Collections in a CSV file are expected to be JSON.
+// Empty strings are null for anything other than text, and '\N' in a CSV file (see
+// csvNull) is null for anything.
+//
+func ConvertValue(cqlType string, raw interface{}) (interface{}, error) {
+	t, err := ParseType(cqlType)
+	if err != nil {
+		return nil, err
+	}
+	return convertValue(t, raw)
+}
+
+func convertValue(t *DataType, raw interface{}) (interface{}, error) {
+	t = t.Unfrozen()
+	if raw == nil {
+		return nil, nil
+	}
+	s, isString := raw.(string)
+	if isString && s == "" && !isTextType(t.Name) {
+		return nil, nil
+	}
+
+	switch t.Name {
+	case "ascii", "text", "varchar":
+		if isString {
+			return s, nil
+		}
+		return fmt.Sprint(raw), nil
+
+	case "inet":
+		return fmt.Sprint(raw), nil
+
+	case "int":
+		n, err := strconv.ParseInt(numberString(raw), 10, 32)
+		return int(n), err
+
+	case "bigint", "counter":
+		return strconv.ParseInt(numberString(raw), 10, 64)
+
+	case "varint":
+		n, ok := new(big.Int).SetString(numberString(raw), 10)
+		if !ok {
+			return nil, fmt.Errorf("Invalid varint '%v'", raw)
+		}
+		return n, nil
+
+	case "float":
+		f, err := strconv.ParseFloat(numberString(raw), 32)
+		return float32(f), err
+
+	case "double":
+		return strconv.ParseFloat(numberString(raw), 64)
+
+	case "decimal":
+		d, ok := new(inf.Dec).SetString(numberString(raw))
+		if !ok {
+			return nil, fmt.Errorf("Invalid decimal '%v'", raw)
+		}
+		return d, nil
+
+	case "boolean":
+		if b, ok := raw.(bool); ok {
+			return b, nil
+		}
+		return strconv.ParseBool(fmt.Sprint(raw))
+
+	case "uuid", "timeuuid":
+		return gocql.ParseUUID(fmt.Sprint(raw))
+
+	case "timestamp":
+		if n, ok := raw.(json.Number); ok {
+			ms, err := n.Int64()
+			return time.Unix(0, ms*int64(time.Millisecond)).UTC(), err
+		}
+		if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return time.Unix(0, ms*int64(time.Millisecond)).UTC(), nil
+		}
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05Z0700", "2006-01-02 15:04:05", "2006-01-02"} {
+			if ts, err := time.Parse(layout, s); err == nil {
+				return ts, nil
+			}
+		}
+		return nil, fmt.Errorf("Invalid timestamp '%v'", raw)
+
+	case "blob":
+		return hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(fmt.Sprint(raw), "0x"), "0X"))
+
+	case "list", "set":
+		items, err := decodeCollection(raw)
+		if err != nil {
+			return nil, err
+		}
+		list, ok := items.([]interface{})
+		if !ok || len(t.Params) != 1 {
+			return nil, fmt.Errorf("Invalid %s '%v'", t, raw)
+		}
+		values := make([]interface{}, len(list))
+		for i, item := range list {
+			if values[i], err = convertValue(t.Params[0], item); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+
+	case "map":
+		items, err := decodeCollection(raw)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := items.(map[string]interface{})
+		if !ok || len(t.Params) != 2 {
+			return nil, fmt.Errorf("Invalid %s '%v'", t, raw)
+		}
+		values := make(map[interface{}]interface{}, len(m))
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			key, err := convertValue(t.Params[0], k)
+			if err != nil {
+				return nil, err
+			}
+			if reflect.TypeOf(key) != nil && !reflect.TypeOf(key).Comparable() {
+				return nil, fmt.Errorf("Unsupported map key type %s", t.Params[0])
+			}
+			if values[key], err = convertValue(t.Params[1], m[k]); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("Unsupported column type '%s'", t)
+}
+
+func isTextType(name string) bool {
+	return name == "text" || name == "varchar" || name == "ascii"
+}
+
+func numberString(raw interface{}) string {
+	return strings.TrimSpace(fmt.Sprint(raw))
+}
+
+//
+// Collections come either already decoded (from a JSON file) or as JSON text (from a
+// CSV cell).
+//
+func decodeCollection(raw interface{}) (interface{}, error) {
+	s, ok := raw.(string)
+	if !ok {
+		return raw, nil
+	}
+	var decoded interface{}
+	d := json.NewDecoder(bytes.NewReader([]byte(s)))
+	d.UseNumber()
+	if err := d.Decode(&decoded); err != nil {
+		return nil, fmt.Errorf("Invalid collection '%s': %s", s, err.Error())
+	}
+	return decoded, nil
+}
@@ -0,0 +1,140 @@
+package cql
+
+import (
+	"bytes"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/gocql/gocql"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Column Values", func() {
+
+	id, _ := gocql.ParseUUID("5b6962dd-3f90-4c93-8f61-eabfa4a803e2")
+	when := time.Date(2015, 1, 2, 6, 0, 0, 0, time.UTC)
+
+	Context("Converting values", func() {
+		It("should convert strings into the column's type", func() {
+			for cqlType, expected := range map[string]interface{}{
+				"text":      "hello",
+				"int":       42,
+				"bigint":    int64(42),
+				"double":    42.5,
+				"boolean":   true,
+				"uuid":      id,
+				"timestamp": when,
+				"blob":      []byte{0xca, 0xfe},
+			} {
+				raw := map[string]string{
+					"text": "hello", "int": "42", "bigint": "42", "double": "42.5", "boolean": "true",
+					"uuid": id.String(), "timestamp": "2015-01-02T06:00:00Z", "blob": "0xcafe",
+				}[cqlType]
+				v, err := ConvertValue(cqlType, raw)
+				Expect(err).NotTo(HaveOccurred(), cqlType)
+				Expect(v).To(Equal(expected), cqlType)
+			}
+		})
+
+		It("should treat empty strings as null for anything but text", func() {
+			v, err := ConvertValue("int", "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(v).To(BeNil())
+
+			v, err = ConvertValue("text", "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(v).To(Equal(""))
+		})
+
+		It("should convert JSON encoded collections", func() {
+			v, err := ConvertValue("map<uuid, text>", `{"`+id.String()+`": "team a"}`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(v).To(Equal(map[interface{}]interface{}{id: "team a"}))
+
+			v, err = ConvertValue("set<int>", `[1, 2]`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(v).To(Equal([]interface{}{1, 2}))
+		})
+
+		It("should complain about values that don't fit", func() {
+			_, err := ConvertValue("int", "forty-two")
+			Expect(err).To(HaveOccurred())
+			_, err = ConvertValue("uuid", "not-a-uuid")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Writing and reading rows", func() {
+		row := map[string]interface{}{
+			"id":      id,
+			"name":    "bob",
+			"created": when,
+			"count":   big.NewInt(7),
+			"teams":   map[gocql.UUID]string{id: "team a"},
+		}
+		columns := []*Column{
+			{Name: "id", Type: "uuid"},
+			{Name: "name", Type: "text"},
+			{Name: "created", Type: "timestamp"},
+			{Name: "count", Type: "varint"},
+			{Name: "teams", Type: "map<uuid, text>"},
+		}
+
+		for _, format := range []string{JSONLinesFormat, CSVFormat} {
+			format := format
+			It("should round trip rows through "+format, func() {
+				buf := &bytes.Buffer{}
+				w, err := NewRowWriter(format, buf, []string{"id", "name", "created", "count", "teams"})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(w.Write(row)).To(Succeed())
+				Expect(w.Flush()).To(Succeed())
+
+				r, err := NewRowReader(format, buf)
+				Expect(err).NotTo(HaveOccurred())
+				read, err := r.Read()
+				Expect(err).NotTo(HaveOccurred())
+
+				for _, c := range columns {
+					v, err := ConvertValue(c.Type, read[c.Name])
+					Expect(err).NotTo(HaveOccurred(), c.Name)
+					switch c.Name {
+					case "teams":
+						Expect(v).To(Equal(map[interface{}]interface{}{id: "team a"}))
+					case "count":
+						Expect(v.(*big.Int).Int64()).To(Equal(int64(7)))
+					default:
+						Expect(v).To(Equal(row[c.Name]), c.Name)
+					}
+				}
+
+				_, err = r.Read()
+				Expect(err).To(Equal(io.EOF))
+			})
+
+			It("should tell null text from empty text through "+format, func() {
+				buf := &bytes.Buffer{}
+				w, err := NewRowWriter(format, buf, []string{"null", "empty", "marker"})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(w.Write(map[string]interface{}{"null": nil, "empty": "", "marker": `\N`})).To(Succeed())
+				Expect(w.Flush()).To(Succeed())
+
+				r, err := NewRowReader(format, buf)
+				Expect(err).NotTo(HaveOccurred())
+				read, err := r.Read()
+				Expect(err).NotTo(HaveOccurred())
+
+				v, err := ConvertValue("text", read["null"])
+				Expect(err).NotTo(HaveOccurred())
+				Expect(v).To(BeNil())
+				v, err = ConvertValue("text", read["empty"])
+				Expect(err).NotTo(HaveOccurred())
+				Expect(v).To(Equal(""))
+				v, err = ConvertValue("text", read["marker"])
+				Expect(err).NotTo(HaveOccurred())
+				Expect(v).To(Equal(`\N`))
+			})
+		}
+	})
+})
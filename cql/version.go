@@ -0,0 +1,264 @@
+package cql
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// 'YYYYMMDDhhmm' in local time. What we've always used, but two people creating
+	// migrations in the same minute get the same version.
+	TimestampVersions = "timestamp"
+
+	// 'YYYYMMDDhhmmss' in UTC. Older 'timestamp' versions compare against these as if
+	// their seconds were zero, but they're local time: in zones ahead of UTC, the first
+	// new versions after switching can sort before the last local ones. Check with
+	// 'list' that they come out in order.
+	UTCTimestampVersions = "utc"
+
+	// 1, 2, 3... New migrations get one more than the latest, zero padded to the same
+	// width.
+	SequenceVersions = "sequence"
+
+	// Semantic versions like '1.4.0' (or '2.0.0-rc.1'), ordered by semver precedence.
+	// New migrations get the latest's next minor version unless given one.
+	SemanticVersions = "semver"
+)
+
+const (
+	utcTimeFormat = "20060102150405"
+
+	// Versioned migration file names. Patterns must have each of the placeholders once.
+	DefaultFileNamePattern = "{version}_{name}.{env}.cql"
+)
+
+var (
+	// The version scheme in use. Set from the 'versionscheme' scripts setting.
+	DefaultVersionScheme = TimestampVersions
+
+	// How versioned migrations are named. Set from the 'filenamepattern' scripts setting.
+	FileNamePattern = DefaultFileNamePattern
+)
+
+var versionPatterns = map[string]string{
+	TimestampVersions:    `\d{12}`,
+	UTCTimestampVersions: `\d{12}(?:\d{2})?`,
+	SequenceVersions:     `\d+`,
+	SemanticVersions:     `\d+\.\d+\.\d+(?:-[0-9A-Za-z.-]+)?`,
+}
+
+var versionFormats = map[string]string{
+	TimestampVersions:    "YYYYMMDDhhmm",
+	UTCTimestampVersions: "YYYYMMDDhhmmss",
+	SequenceVersions:     "a whole number",
+	SemanticVersions:     "MAJOR.MINOR.PATCH",
+}
+
+func checkVersionScheme(scheme string) error {
+	if _, ok := versionPatterns[scheme]; !ok {
+		return fmt.Errorf("Unknown version scheme '%s' (expected '%s', '%s', '%s' or '%s')",
+			scheme, TimestampVersions, UTCTimestampVersions, SequenceVersions, SemanticVersions)
+	}
+	return nil
+}
+
+//
+// Check 'version' is in the format of the version scheme in use.
+//
+func ValidVersion(version string) error {
+	re := regexp.MustCompile("^" + versionPatterns[DefaultVersionScheme] + "$")
+	if !re.MatchString(version) {
+		return fmt.Errorf("Migration version '%s' is not in the format '%s'", version, versionFormats[DefaultVersionScheme])
+	}
+	return nil
+}
+
+//
+// Order two versions, returning -1, 0 or 1 as 'a' is before, the same as or after 'b'.
+//
+func CompareVersions(a, b string) int {
+	switch DefaultVersionScheme {
+	case SequenceVersions:
+		return compareNumbers(a, b)
+	case SemanticVersions:
+		return compareSemver(a, b)
+	default:
+		// Minutes sort before the seconds within them: '201501010600' is '20150101060000'.
+		for len(a) < len(b) {
+			a += "0"
+		}
+		for len(b) < len(a) {
+			b += "0"
+		}
+		return strings.Compare(a, b)
+	}
+}
+
+//
+// Compare two strings of digits as numbers, however long they are.
+//
+func compareNumbers(a, b string) int {
+	a = strings.TrimLeft(a, "0")
+	b = strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func compareSemver(a, b string) int {
+	aCore, aPre := splitSemver(a)
+	bCore, bPre := splitSemver(b)
+	for i := 0; i < 3; i++ {
+		if c := compareNumbers(aCore[i], bCore[i]); c != 0 {
+			return c
+		}
+	}
+
+	// A pre-release comes before the release itself.
+	switch {
+	case aPre == bPre:
+		return 0
+	case aPre == "":
+		return 1
+	case bPre == "":
+		return -1
+	}
+	aIds := strings.Split(aPre, ".")
+	bIds := strings.Split(bPre, ".")
+	for i := 0; i < len(aIds) && i < len(bIds); i++ {
+		_, aErr := strconv.ParseUint(aIds[i], 10, 64)
+		_, bErr := strconv.ParseUint(bIds[i], 10, 64)
+		var c int
+		switch {
+		case aErr == nil && bErr == nil:
+			c = compareNumbers(aIds[i], bIds[i])
+		case aErr == nil:
+			c = -1
+		case bErr == nil:
+			c = 1
+		default:
+			c = strings.Compare(aIds[i], bIds[i])
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return compareNumbers(strconv.Itoa(len(aIds)), strconv.Itoa(len(bIds)))
+}
+
+func splitSemver(v string) (core [3]string, pre string) {
+	if i := strings.Index(v, "-"); i >= 0 {
+		v, pre = v[:i], v[i+1:]
+	}
+	parts := strings.SplitN(v, ".", 3)
+	copy(core[:], parts)
+	return core, pre
+}
+
+//
+// The version for a new migration, given the ones there are already. Timestamps come
+// from the clock; sequences and semantic versions carry on from the latest of 'updates'.
+//
+func NextVersion(updates Migrations) string {
+	now := time.Now()
+	last := ""
+	if m := updates.Latest(); m != nil {
+		last = m.Version
+	}
+
+	switch DefaultVersionScheme {
+	case UTCTimestampVersions:
+		return now.UTC().Format(utcTimeFormat)
+	case SequenceVersions:
+		if last == "" {
+			return "0001"
+		}
+		n, err := strconv.ParseUint(last, 10, 64)
+		if err != nil {
+			return ""
+		}
+		return fmt.Sprintf("%0*d", len(last), n+1)
+	case SemanticVersions:
+		if last == "" {
+			return "0.1.0"
+		}
+		core, _ := splitSemver(last)
+		minor, err := strconv.ParseUint(core[1], 10, 64)
+		if err != nil {
+			return ""
+		}
+		return fmt.Sprintf("%s.%d.0", core[0], minor+1)
+	default:
+		return now.Format(migrationTimeFormat)
+	}
+}
+
+//
+// Turn a file name pattern into a regular expression matching the version, name and
+// environment, in that order, of the files it names.
+//
+func fileNameRe(pattern string) (*regexp.Regexp, error) {
+	// The default also takes a '.' after the version, and doesn't mind what comes
+	// before it, as file names always have.
+	if pattern == DefaultFileNamePattern {
+		return regexp.MustCompile("(" + versionPatterns[DefaultVersionScheme] + ")[_.]([A-Za-z0-9_-]+)\\.(" + environmentPattern + ")\\.cql"), nil
+	}
+	if !strings.HasSuffix(pattern, ".cql") {
+		return nil, fmt.Errorf("File name pattern '%s' doesn't end in '.cql'", pattern)
+	}
+
+	groups := map[string]string{
+		"{version}": "(?P<version>" + versionPatterns[DefaultVersionScheme] + ")",
+		"{name}":    "(?P<name>[A-Za-z0-9_-]+)",
+		"{env}":     "(?P<env>" + environmentPattern + ")",
+	}
+	expr := regexp.QuoteMeta(pattern)
+	for placeholder, group := range groups {
+		quoted := regexp.QuoteMeta(placeholder)
+		if strings.Count(expr, quoted) != 1 {
+			return nil, fmt.Errorf("File name pattern '%s' must have '%s' in it once", pattern, placeholder)
+		}
+		expr = strings.Replace(expr, quoted, group, 1)
+	}
+	return regexp.Compile("^" + expr + "$")
+}
+
+//
+// Pick the version, name and environment out of a file name, if it matches 'pattern'.
+//
+func parseFileName(pattern, filename string) (version, name, env string, ok bool) {
+	re, err := fileNameRe(pattern)
+	if err != nil {
+		return "", "", "", false
+	}
+	matcher := re.FindStringSubmatch(filename)
+	if matcher == nil {
+		return "", "", "", false
+	}
+	if pattern == DefaultFileNamePattern {
+		return matcher[1], matcher[2], matcher[3], true
+	}
+	return matcher[re.SubexpIndex("version")], matcher[re.SubexpIndex("name")], matcher[re.SubexpIndex("env")], true
+}
+
+//
+// The name of the file for a versioned migration, following FileNamePattern.
+//
+func versionedFileName(version, name, env string) string {
+	return strings.NewReplacer("{version}", version, "{name}", name, "{env}", env).Replace(FileNamePattern)
+}
+
+//
+// Check a file name pattern will work with the version scheme in use.
+//
+func checkFileNamePattern(pattern string) error {
+	_, err := fileNameRe(pattern)
+	return err
+}
@@ -0,0 +1,103 @@
+package cql
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Version Schemes", func() {
+
+	var oldScheme, oldPattern string
+
+	BeforeEach(func() {
+		oldScheme, oldPattern = DefaultVersionScheme, FileNamePattern
+	})
+
+	AfterEach(func() {
+		DefaultVersionScheme, FileNamePattern = oldScheme, oldPattern
+	})
+
+	useScheme := func(scheme, pattern string) {
+		DefaultVersionScheme, FileNamePattern = scheme, pattern
+	}
+
+	versions := func(vs ...string) (updates Migrations) {
+		for _, v := range vs {
+			updates = append(updates, &Migration{Version: v, Name: "m" + v, Environment: "all"})
+		}
+		return updates
+	}
+
+	sorted := func(updates Migrations) (vs []string) {
+		sort.Sort(updates)
+		for _, m := range updates {
+			vs = append(vs, m.Version)
+		}
+		return vs
+	}
+
+	It("Sorts minute timestamps among ones with seconds", func() {
+		useScheme(UTCTimestampVersions, DefaultFileNamePattern)
+		Expect(sorted(versions("20150101060030", "201501010600", "201501010559"))).To(Equal(
+			[]string{"201501010559", "201501010600", "20150101060030"}))
+		Expect(ValidVersion("20150101060030")).To(Succeed())
+		Expect(ValidVersion("2015")).NotTo(Succeed())
+	})
+
+	It("Sorts sequences numerically and carries them on", func() {
+		useScheme(SequenceVersions, DefaultFileNamePattern)
+		updates := versions("10", "9", "0002")
+		Expect(sorted(updates)).To(Equal([]string{"0002", "9", "10"}))
+		Expect(NextVersion(updates)).To(Equal("11"))
+		Expect(NextVersion(versions("0041"))).To(Equal("0042"))
+		Expect(NextVersion(nil)).To(Equal("0001"))
+	})
+
+	It("Sorts semantic versions by precedence", func() {
+		useScheme(SemanticVersions, DefaultFileNamePattern)
+		updates := versions("1.10.0", "1.2.0", "1.10.0-rc.2", "1.10.0-rc.10", "1.10.0-beta", "0.9.1")
+		Expect(sorted(updates)).To(Equal([]string{"0.9.1", "1.2.0", "1.10.0-beta", "1.10.0-rc.2", "1.10.0-rc.10", "1.10.0"}))
+		Expect(NextVersion(updates)).To(Equal("1.11.0"))
+		Expect(ValidVersion("1.2")).NotTo(Succeed())
+	})
+
+	It("Names files following the pattern", func() {
+		useScheme(SequenceVersions, "V{version}__{name}.{env}.cql")
+		dir, err := ioutil.TempDir("", "cassandra-migrate")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		m := CreateMigration("add team", "uat1")
+		Expect(m.CreateMigrationFile(dir)).To(Succeed())
+		Expect(filepath.Base(m.File)).To(Equal("V0001__add_team.uat1.cql"))
+
+		read, err := MigrationFromFile(m.File)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(read.Version).To(Equal("0001"))
+		Expect(read.Name).To(Equal("add_team"))
+		Expect(read.Environment).To(Equal("uat1"))
+
+		Expect(m.CreateMigrationFile(dir)).NotTo(Succeed())
+
+		ioutil.WriteFile(filepath.Join(dir, "0002_other.all.cql"), nil, 0644)
+		_, err = MigrationFromFile(filepath.Join(dir, "0002_other.all.cql"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Rejects patterns missing a placeholder", func() {
+		Expect(checkFileNamePattern("{version}_{name}.cql")).To(MatchError(ContainSubstring("{env}")))
+		Expect(checkFileNamePattern("{version}_{name}.{env}.sql")).NotTo(Succeed())
+	})
+
+	It("Finds a migration using the same version", func() {
+		useScheme(SequenceVersions, DefaultFileNamePattern)
+		updates := versions("0001", "0002")
+		Expect(updates.SameVersion(&Migration{Version: "2", Environment: "uat1"})).To(Equal(updates[1]))
+		Expect(updates.SameVersion(&Migration{Version: "3", Environment: "all"})).To(BeNil())
+	})
+})
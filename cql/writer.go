@@ -0,0 +1,174 @@
+package cql
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gocql/gocql"
+)
+
+//
+// A statement with the values to bind to it. gocql prepares statements with values
+// the first time it sees them and reuses them after that.
+//
+type boundStatement struct {
+	cql    string
+	values []interface{}
+}
+
+//
+// Runs writes on a bounded number of goroutines. Writes to the same partition are
+// grouped into unlogged batches of up to batchSize, which Cassandra applies as one
+// mutation; writes to different partitions are never batched together since that
+// just makes the coordinator do the work of spreading them out.
+//
+type parallelWriter struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
+	session     *gocql.Session
+	consistency gocql.Consistency
+	batchSize   int
+
+	work chan []*boundStatement
+	wg   sync.WaitGroup
+
+	// Writes waiting for more to the same partition to fill a batch.
+	pending  map[string][]*boundStatement
+	buffered int
+
+	mu  sync.Mutex
+	err error
+}
+
+// How many writes can be held back waiting for a batch to fill, per worker.
+const pendingWritesPerWorker = 256
+
+func newParallelWriter(ctx context.Context, session *gocql.Session, concurrency, batchSize int) *parallelWriter {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	w := &parallelWriter{
+		session:   session,
+		batchSize: batchSize,
+		work:      make(chan []*boundStatement, concurrency),
+		pending:   map[string][]*boundStatement{},
+	}
+	w.ctx, w.cancel = context.WithCancel(ctx)
+	for i := 0; i < concurrency; i++ {
+		w.wg.Add(1)
+		go w.run()
+	}
+	return w
+}
+
+func (w *parallelWriter) run() {
+	defer w.wg.Done()
+	for statements := range w.work {
+		if w.ctx.Err() != nil {
+			continue
+		}
+		if err := w.exec(statements); err != nil {
+			w.fail(err)
+		}
+	}
+}
+
+func (w *parallelWriter) exec(statements []*boundStatement) error {
+	if len(statements) == 1 {
+		query := w.session.Query(statements[0].cql, statements[0].values...)
+		if w.consistency > 0 {
+			query.Consistency(w.consistency)
+		}
+		return execContext(w.ctx, query)
+	}
+	batch := w.session.NewBatch(gocql.UnloggedBatch)
+	if w.consistency > 0 {
+		batch.Cons = w.consistency
+	}
+	for _, st := range statements {
+		batch.Query(st.cql, st.values...)
+	}
+	return w.session.ExecuteBatch(batch)
+}
+
+func (w *parallelWriter) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+		w.cancel()
+	}
+}
+
+func (w *parallelWriter) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	return w.ctx.Err()
+}
+
+//
+// Queue a write to 'partition'. Returns the first error any write has had so far, after
+// which there's no point adding more.
+//
+func (w *parallelWriter) Add(partition string, st *boundStatement) error {
+	if err := w.Err(); err != nil {
+		return err
+	}
+	if w.batchSize == 1 {
+		return w.send([]*boundStatement{st})
+	}
+
+	w.pending[partition] = append(w.pending[partition], st)
+	w.buffered++
+	if len(w.pending[partition]) >= w.batchSize {
+		w.buffered -= len(w.pending[partition])
+		statements := w.pending[partition]
+		delete(w.pending, partition)
+		return w.send(statements)
+	}
+	if w.buffered >= pendingWritesPerWorker*cap(w.work) {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *parallelWriter) send(statements []*boundStatement) error {
+	select {
+	case w.work <- statements:
+		return nil
+	case <-w.ctx.Done():
+		return w.Err()
+	}
+}
+
+func (w *parallelWriter) flush() error {
+	for partition, statements := range w.pending {
+		delete(w.pending, partition)
+		if err := w.send(statements); err != nil {
+			return err
+		}
+	}
+	w.buffered = 0
+	return nil
+}
+
+//
+// Send anything still waiting for a batch to fill and wait for all the writes to finish.
+//
+func (w *parallelWriter) Close() error {
+	flushErr := w.flush()
+	close(w.work)
+	w.wg.Wait()
+	err := w.Err()
+	w.cancel()
+	if err != nil {
+		return err
+	}
+	return flushErr
+}